@@ -0,0 +1,287 @@
+package api
+
+import (
+	"fmt"
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// periods activities are grouped by, in athlete local time
+const (
+	PERIOD_DAY   = "day"
+	PERIOD_WEEK  = "week"
+	PERIOD_MONTH = "month"
+	PERIOD_YEAR  = "year"
+)
+
+// AggregateResponse is rollup of activities by period, buckets are
+// ascending and gaps between them are filled with empty buckets.
+type AggregateResponse struct {
+	Period  string            `json:"period"`
+	Metrics []string          `json:"metrics"`
+	Buckets []AggregateBucket `json:"buckets"`
+}
+
+type AggregateBucket struct {
+	// e.g. 2017-01-02, 2017-W01, 2017-01 or 2017
+	Key string `json:"key"`
+	// local date of the first day of period
+	Start string `json:"start"`
+	// number of activities, metrics count activities having value
+	Count int `json:"count"`
+	// nil for metrics without values in period
+	Metrics map[string]*MetricStats `json:"metrics"`
+}
+
+// metrics Strava reports as zero when activity was recorded without sensor,
+// so zero means value is missing
+var sensorMetrics = map[string]bool{
+	"average_heartrate":      true,
+	"max_heartrate":          true,
+	"average_watts":          true,
+	"weighted_average_watts": true,
+	"max_watts":              true,
+	"kilojoules":             true,
+	"average_cadence":        true,
+	"suffer_score":           true,
+}
+
+type MetricStats struct {
+	Count int     `json:"count"`
+	Sum   float64 `json:"sum"`
+	Mean  float64 `json:"mean"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+func (s *MetricStats) add(value float64) {
+	if s.Count == 0 || value < s.Min {
+		s.Min = value
+	}
+	if s.Count == 0 || value > s.Max {
+		s.Max = value
+	}
+	s.Count++
+	s.Sum += value
+	s.Mean = s.Sum / float64(s.Count)
+}
+
+var metricFieldsOnce sync.Once
+var metricFields map[string][]int
+
+// activityMetricFields maps json names of numeric activity fields to their
+// indexes, so every numeric field Strava reports can be aggregated
+func activityMetricFields() map[string][]int {
+	metricFieldsOnce.Do(func() {
+		metricFields = make(map[string][]int)
+		collectMetricFields(reflect.TypeOf(strava.ActivitySummary{}), nil)
+	})
+	return metricFields
+}
+
+func collectMetricFields(t reflect.Type, prefix []int) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		index := append(append([]int(nil), prefix...), i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			collectMetricFields(field.Type, index)
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" || field.PkgPath != "" {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			if name != "id" {
+				metricFields[name] = index
+			}
+		}
+	}
+}
+
+func metricValue(activity *strava.ActivitySummary, index []int) float64 {
+	value := reflect.ValueOf(activity).Elem().FieldByIndex(index)
+	switch value.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return value.Float()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint())
+	default:
+		return float64(value.Int())
+	}
+}
+
+// localStart returns wall clock start time of activity in athlete time zone
+func localStart(activity *strava.ActivitySummary) time.Time {
+	if !activity.StartDateLocal.IsZero() {
+		// Strava reports local time as if it was UTC
+		local := activity.StartDateLocal
+		return time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), 0, time.UTC)
+	}
+	// time zone looks like "(GMT-08:00) America/Los_Angeles"
+	fields := strings.Fields(activity.TimeZone)
+	if len(fields) > 0 {
+		if location, err := time.LoadLocation(fields[len(fields)-1]); err == nil {
+			local := activity.StartDate.In(location)
+			return time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), 0, time.UTC)
+		}
+	}
+	return activity.StartDate.UTC()
+}
+
+// periodStart returns the first day of period containing local time
+func periodStart(period string, local time.Time) time.Time {
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case PERIOD_WEEK:
+		// ISO weeks start on Monday
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case PERIOD_MONTH:
+		return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case PERIOD_YEAR:
+		return time.Date(day.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day
+	}
+}
+
+func nextPeriod(period string, start time.Time) time.Time {
+	switch period {
+	case PERIOD_WEEK:
+		return start.AddDate(0, 0, 7)
+	case PERIOD_MONTH:
+		return start.AddDate(0, 1, 0)
+	case PERIOD_YEAR:
+		return start.AddDate(1, 0, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+func periodKey(period string, start time.Time) string {
+	switch period {
+	case PERIOD_WEEK:
+		year, week := start.ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week)
+	case PERIOD_MONTH:
+		return start.Format("2006-01")
+	case PERIOD_YEAR:
+		return start.Format("2006")
+	default:
+		return start.Format("2006-01-02")
+	}
+}
+
+func newAggregateBucket(metrics []string) *AggregateBucket {
+	bucket := &AggregateBucket{Metrics: make(map[string]*MetricStats)}
+	for _, metric := range metrics {
+		bucket.Metrics[metric] = nil
+	}
+	return bucket
+}
+
+// aggregateActivities groups activities by period and computes stats of
+// metrics, metrics should be known to activityMetricFields
+func aggregateActivities(activities cache.ActivityList, period string, metrics []string) []AggregateBucket {
+	fields := activityMetricFields()
+	byStart := make(map[time.Time]*AggregateBucket)
+	for _, activity := range activities {
+		start := periodStart(period, localStart(activity))
+		bucket, ok := byStart[start]
+		if !ok {
+			bucket = newAggregateBucket(metrics)
+			byStart[start] = bucket
+		}
+		bucket.Count++
+		for _, metric := range metrics {
+			value := metricValue(activity, fields[metric])
+			if value == 0 && sensorMetrics[metric] {
+				continue
+			}
+			if bucket.Metrics[metric] == nil {
+				bucket.Metrics[metric] = &MetricStats{}
+			}
+			bucket.Metrics[metric].add(value)
+		}
+	}
+	starts := make([]time.Time, 0, len(byStart))
+	for start := range byStart {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	buckets := make([]AggregateBucket, 0, len(starts))
+	if len(starts) == 0 {
+		return buckets
+	}
+	for start := starts[0]; !start.After(starts[len(starts)-1]); start = nextPeriod(period, start) {
+		bucket, ok := byStart[start]
+		if !ok {
+			bucket = newAggregateBucket(metrics)
+		}
+		bucket.Key = periodKey(period, start)
+		bucket.Start = start.Format("2006-01-02")
+		buckets = append(buckets, *bucket)
+	}
+	return buckets
+}
+
+// getAggregate rolls up activities matching /activities filters by period,
+// metrics are json names of numeric activity fields
+func (api *AnalysisApi) getAggregate(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	auth := authFromContext(ctx)
+	values := r.URL.Query()
+	period := values.Get("period")
+	switch period {
+	case PERIOD_DAY, PERIOD_WEEK, PERIOD_MONTH, PERIOD_YEAR:
+	case "":
+		period = PERIOD_WEEK
+	default:
+		return badRequest(fmt.Sprintf("Invalid period value %q, expected day, week, month or year", period))
+	}
+	metrics := make([]string, 0)
+	for _, value := range values["metric"] {
+		for _, metric := range strings.Split(value, ",") {
+			if metric = strings.TrimSpace(metric); metric == "" {
+				continue
+			}
+			if _, ok := activityMetricFields()[metric]; !ok {
+				return badRequest(fmt.Sprintf("Unknown metric %q", metric))
+			}
+			metrics = append(metrics, metric)
+		}
+	}
+	if len(metrics) == 0 {
+		return badRequest("At least one metric is required")
+	}
+	query, err := parseActivityQuery(values)
+	if err != nil {
+		return err
+	}
+	fullActivities, err := api.retrieveActivities(ctx, auth.Token, auth.AthleteId)
+	if err != nil {
+		return err
+	}
+	matching := make(cache.ActivityList, 0, len(fullActivities))
+	for _, activity := range fullActivities {
+		if activity != nil && query.Matches(activity) {
+			matching = append(matching, activity)
+		}
+	}
+	writeJson(w, http.StatusOK, AggregateResponse{
+		Period:  period,
+		Metrics: metrics,
+		Buckets: aggregateActivities(matching, period, metrics),
+	})
+	return nil
+}
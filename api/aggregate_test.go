@@ -0,0 +1,135 @@
+package api
+
+import (
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"github.com/strava/go.strava"
+	"testing"
+	"time"
+)
+
+func localActivity(id int64, local time.Time, distance float64, movingTime int) *strava.ActivitySummary {
+	return &strava.ActivitySummary{
+		Id:             id,
+		StartDate:      local.Add(8 * time.Hour),
+		StartDateLocal: local,
+		TimeZone:       "(GMT-08:00) America/Los_Angeles",
+		Distance:       distance,
+		MovingTime:     movingTime,
+	}
+}
+
+func TestPeriodStart(t *testing.T) {
+	// Sunday evening belongs to ISO week started on Monday before
+	local := time.Date(2017, 1, 8, 22, 0, 0, 0, time.UTC)
+	cases := []struct {
+		period   string
+		expected string
+		key      string
+	}{
+		{PERIOD_DAY, "2017-01-08", "2017-01-08"},
+		{PERIOD_WEEK, "2017-01-02", "2017-W01"},
+		{PERIOD_MONTH, "2017-01-01", "2017-01"},
+		{PERIOD_YEAR, "2017-01-01", "2017"},
+	}
+	for _, c := range cases {
+		start := periodStart(c.period, local)
+		if actual := start.Format("2006-01-02"); actual != c.expected {
+			t.Errorf("%v: expected %v, got %v", c.period, c.expected, actual)
+		}
+		if actual := periodKey(c.period, start); actual != c.key {
+			t.Errorf("%v: expected key %v, got %v", c.period, c.key, actual)
+		}
+	}
+	// first days of 2016 belong to last ISO week of 2015
+	if key := periodKey(PERIOD_WEEK, periodStart(PERIOD_WEEK, time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC))); key != "2015-W53" {
+		t.Errorf("Expected 2015-W53, got %v", key)
+	}
+}
+
+func TestLocalStart(t *testing.T) {
+	local := time.Date(2017, 1, 8, 22, 0, 0, 0, time.UTC)
+	activity := localActivity(1, local, 0, 0)
+	if actual := localStart(activity); !actual.Equal(local) {
+		t.Errorf("Expected local start %v, got %v", local, actual)
+	}
+	// time zone is used when local start is missing
+	activity.StartDateLocal = time.Time{}
+	expected := local
+	if _, err := time.LoadLocation("America/Los_Angeles"); err != nil {
+		expected = activity.StartDate
+	}
+	if actual := localStart(activity); !actual.Equal(expected) {
+		t.Errorf("Expected start %v, got %v", expected, actual)
+	}
+}
+
+func TestAggregateActivities(t *testing.T) {
+	activities := cache.ActivityList{
+		// local Sunday, but Monday in UTC
+		localActivity(1, time.Date(2017, 1, 8, 22, 0, 0, 0, time.UTC), 1000, 60),
+		localActivity(2, time.Date(2017, 1, 2, 8, 0, 0, 0, time.UTC), 3000, 180),
+		localActivity(3, time.Date(2017, 1, 24, 8, 0, 0, 0, time.UTC), 2000, 120),
+	}
+	buckets := aggregateActivities(activities, PERIOD_WEEK, []string{"distance", "moving_time"})
+	if len(buckets) != 4 {
+		t.Fatalf("Expected 4 weeks with gaps filled, got %+v", buckets)
+	}
+	first := buckets[0]
+	if first.Key != "2017-W01" || first.Start != "2017-01-02" || first.Count != 2 {
+		t.Errorf("Unexpected first bucket %+v", first)
+	}
+	expected := MetricStats{Count: 2, Sum: 4000, Mean: 2000, Min: 1000, Max: 3000}
+	if *first.Metrics["distance"] != expected {
+		t.Errorf("Expected %+v, got %+v", expected, first.Metrics["distance"])
+	}
+	if first.Metrics["moving_time"].Sum != 240 {
+		t.Errorf("Expected moving time 240, got %+v", first.Metrics["moving_time"])
+	}
+	for _, gap := range buckets[1:3] {
+		if distance, ok := gap.Metrics["distance"]; gap.Count != 0 || !ok || distance != nil {
+			t.Errorf("Expected empty bucket, got %+v", gap)
+		}
+	}
+	if buckets[3].Key != "2017-W04" || buckets[3].Metrics["distance"].Max != 2000 {
+		t.Errorf("Unexpected last bucket %+v", buckets[3])
+	}
+}
+
+func TestAggregateSkipsMissingSensorData(t *testing.T) {
+	withHeartrate := localActivity(1, time.Date(2017, 1, 2, 8, 0, 0, 0, time.UTC), 1000, 60)
+	withHeartrate.AverageHeartrate = 150
+	otherWithHeartrate := localActivity(2, time.Date(2017, 1, 3, 8, 0, 0, 0, time.UTC), 2000, 120)
+	otherWithHeartrate.AverageHeartrate = 130
+	withoutHeartrate := localActivity(3, time.Date(2017, 1, 4, 8, 0, 0, 0, time.UTC), 3000, 180)
+	onlyWithoutHeartrate := localActivity(4, time.Date(2017, 1, 10, 8, 0, 0, 0, time.UTC), 4000, 240)
+	activities := cache.ActivityList{withHeartrate, otherWithHeartrate, withoutHeartrate, onlyWithoutHeartrate}
+
+	buckets := aggregateActivities(activities, PERIOD_WEEK, []string{"average_heartrate", "distance"})
+	if len(buckets) != 2 || buckets[0].Count != 3 {
+		t.Fatalf("Unexpected buckets %+v", buckets)
+	}
+	expected := MetricStats{Count: 2, Sum: 280, Mean: 140, Min: 130, Max: 150}
+	if heartrate := buckets[0].Metrics["average_heartrate"]; heartrate == nil || *heartrate != expected {
+		t.Errorf("Expected %+v, got %+v", expected, heartrate)
+	}
+	if distance := buckets[0].Metrics["distance"]; distance == nil || distance.Count != 3 {
+		t.Errorf("Distance should count every activity, got %+v", distance)
+	}
+	if heartrate, ok := buckets[1].Metrics["average_heartrate"]; !ok || heartrate != nil {
+		t.Errorf("Period without heart rate data should have no stats, got %+v", heartrate)
+	}
+}
+
+func TestActivityMetricFields(t *testing.T) {
+	fields := activityMetricFields()
+	for _, metric := range []string{"distance", "moving_time", "total_elevation_gain", "kilojoules"} {
+		if _, ok := fields[metric]; !ok {
+			t.Errorf("Expected %v to be metric", metric)
+		}
+	}
+	for _, field := range []string{"id", "name", "type", "start_date", "trainer"} {
+		if _, ok := fields[field]; ok {
+			t.Errorf("Field %v should not be metric", field)
+		}
+	}
+}
@@ -1,15 +1,12 @@
 package api
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/chemikadze/strava-analysis-ui/cache"
 	"github.com/strava/go.strava"
 	"golang.org/x/net/context"
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/log"
 	"net/http"
-	"strconv"
+	"strings"
 )
 
 var pageSize = 200
@@ -19,9 +16,20 @@ type Params struct {
 	ClientId               int
 	ClientSecret           string
 	RequestClientGenerator func(r *http.Request) *http.Client
-	ActivityCacheAccessor  func(ctx context.Context) cache.ActivityCache
-	ZonesEnabled           bool
-	StaticServerType       string
+	// client of work outliving request, e.g. downloads shared by requests
+	ContextClientGenerator func(ctx context.Context) *http.Client
+	// context of work outliving request, context.Background() if nil
+	BackgroundContext     func() context.Context
+	RateLimits            *RateLimits // Strava budget used by generated clients
+	ActivityCacheAccessor func(ctx context.Context) cache.ActivityCache
+	SessionStoreAccessor  func(ctx context.Context) SessionStore
+	SessionSecret         []byte // key signing session cookies
+	// session cookie is sent over plain http too, for local development only
+	InsecureCookies   bool
+	ListTTLPolicy     cache.TTLPolicy
+	ActivityTTLPolicy cache.TTLPolicy
+	ZonesEnabled      bool
+	StaticServerType  string
 }
 
 const (
@@ -31,168 +39,357 @@ const (
 
 type AnalysisApi struct {
 	Params Params
+	// concurrent downloads of the same athlete list or activity are shared
+	flights flightGroup
+	// background retrieval of activity details
+	jobs jobRegistry
+	// slots of concurrent activity downloads
+	downloads chan struct{}
 }
 
 type ZoneInfoResponse struct {
 	Activities []ActivityZoneInfo
+	// time in zones summed over activities, by zone type
+	Totals map[string][]ZoneTotal
+	// activities missing from partial response
+	Skipped []SkippedActivity
 }
 
 type ActivityZoneInfo struct {
 	ActivityInfo *strava.ActivitySummary
-	ZoneInfo     *strava.ZonesSummary
+	// heart rate zones
+	ZoneInfo *strava.ZonesSummary
+	// requested zone distributions by type
+	Zones map[string]*strava.ZonesSummary
+	// requested zone types unknown for activity cached before they were kept
+	MissingZones []string
+}
+
+// ZoneTotal is time spent in zone by all activities, zones are matched by
+// position, boundaries are taken from the latest activity.
+type ZoneTotal struct {
+	Min  int
+	Max  int
+	Time int
+	// activities having this zone
+	Activities int
 }
 
 func NewApi(params Params) *AnalysisApi {
 	return &AnalysisApi{
-		params,
+		Params:    params,
+		flights:   flightGroup{background: params.BackgroundContext},
+		downloads: make(chan struct{}, maxActivityDownloads),
 	}
 }
 
-func (api *AnalysisApi) AttachHandlers(mux *http.ServeMux) {
-	mux.HandleFunc("/activities", api.getActivities)
-	if api.Params.ZonesEnabled {
-		mux.HandleFunc("/zones", api.getZonesData)
+// backgroundContext returns context of work outliving request
+func (api *AnalysisApi) backgroundContext() context.Context {
+	if api.Params.BackgroundContext != nil {
+		return api.Params.BackgroundContext()
 	}
+	return context.Background()
 }
 
-func (api *AnalysisApi) getStravaClient(r *http.Request) (client *strava.Client) {
-	// TODO: YOLO error handling
-	tokenCookie, _ := r.Cookie(cookieStravaToken)
-	token := tokenCookie.Value
-	if api.Params.RequestClientGenerator != nil {
-		httpClient := api.Params.RequestClientGenerator(r)
-		client = strava.NewClient(token, httpClient)
-	} else {
-		client = strava.NewClient(token)
+func (api *AnalysisApi) AttachHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/activities", handle(api.authenticated(api.getActivities)))
+	mux.HandleFunc("/aggregate", handle(api.authenticated(api.getAggregate)))
+	mux.HandleFunc("/streams", handle(api.authenticated(api.getStreams)))
+	mux.HandleFunc("/ratelimit", handle(api.authenticated(api.getRateLimit)))
+	if api.Params.ZonesEnabled {
+		mux.HandleFunc("/zones", handle(api.authenticated(api.getZonesData)))
+		mux.HandleFunc("/jobs/hydrate", handle(api.authenticated(api.getHydration)))
+		mux.HandleFunc("/jobs/hydrate/events", handle(api.authenticated(api.getHydrationEvents)))
 	}
-	return client
 }
 
-func (api *AnalysisApi) getAthleteId(r *http.Request) int64 {
-	athleteCookie, _ := r.Cookie(cookieAthleteId)
-	athleteIdInt, _ := strconv.Atoi(athleteCookie.Value)
-	athleteId := int64(athleteIdInt)
-	return athleteId
+func (api *AnalysisApi) retrieveActivities(ctx context.Context, token string, athleteId int64) (cache.ActivityList, error) {
+	key := fmt.Sprintf("activities/%v", athleteId)
+	result, err := api.flights.Do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return api.loadActivities(ctx, token, athleteId)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(cache.ActivityList), nil
 }
 
-func (api *AnalysisApi) retrieveActivities(ctx context.Context, client *strava.Client, athleteId int64) (fullActivities cache.ActivityList) {
-	athletes := strava.NewAthletesService(client)
-	fullActivities = make(cache.ActivityList, 0)
+// loadActivities returns cached list, stale list is returned immediately and
+// refreshed in background
+func (api *AnalysisApi) loadActivities(ctx context.Context, token string, athleteId int64) (cache.ActivityList, error) {
 	cacheClient := api.Params.ActivityCacheAccessor(ctx)
-	if cached, ok := cacheClient.Get(athleteId); ok {
-		fullActivities = cached
-	} else {
-		for page := 1; ; page++ {
-			call := athletes.ListActivities(athleteId)
-			call.PerPage(pageSize)
-			call.Page(page)
-			log.Debugf(ctx, "Loading athlete %v page %v", athleteId, page)
-			activities, err := call.Do()
-			if err != nil {
-				log.Criticalf(ctx, err.Error())
-				panic(err.Error())
-			}
-			if len(activities) == 0 {
-				break
-			}
-			fullActivities = append(fullActivities, activities...)
-		}
-		cacheClient.Store(athleteId, fullActivities)
+	cached, freshness, err := cache.LookupActivityList(ctx, cacheClient, api.Params.ListTTLPolicy, athleteId)
+	if err != nil {
+		warningf(ctx, "Failed to load activities of athlete %v from cache, downloading: %v", athleteId, err)
+	}
+	switch freshness {
+	case cache.FRESH:
+		return cached, nil
+	case cache.STALE:
+		api.refreshActivities(token, athleteId, cached)
+		return cached, nil
+	default:
+		return api.syncActivities(ctx, api.stravaClient(ctx, token), athleteId, nil, nil)
 	}
-	return fullActivities
 }
 
-func (api *AnalysisApi) retrieveActivity(ctx context.Context, client *strava.Client, activityId int64) (*cache.ExtendedActivityInfo, error) {
-
-	cacheClient := api.Params.ActivityCacheAccessor(ctx)
-	if activity, ok := cacheClient.GetActivity(activityId); ok {
-		log.Debugf(ctx, "using activity %v from cache", activityId)
-		return activity, nil
-	} else {
-		log.Debugf(ctx, "did not find activity %v in cache, downloading", activityId)
-		activitiesService := strava.NewActivitiesService(client)
-		activityCall := activitiesService.Get(activityId)
-		activity, err := activityCall.Do()
+// refreshActivities syncs stored list in background, requests finding list
+// stale meanwhile share the sync
+func (api *AnalysisApi) refreshActivities(token string, athleteId int64, stored cache.ActivityList) {
+	api.flights.Go(fmt.Sprintf("sync/%v", athleteId), func(ctx context.Context) (interface{}, error) {
+		cacheClient := api.Params.ActivityCacheAccessor(ctx)
+		state, err := cacheClient.GetSyncState(ctx, athleteId)
 		if err != nil {
-			return nil, err
+			if !cache.IsNotFound(err) {
+				warningf(ctx, "Failed to load sync state of athlete %v from cache: %v", athleteId, err)
+			}
+			state = nil
 		}
-
-		zonesCall := activitiesService.ListZones(activityId)
-		zones, err := zonesCall.Do()
+		activities, err := api.syncActivities(ctx, api.stravaClient(ctx, token), athleteId, stored, state)
 		if err != nil {
-			return nil, err
+			warningf(ctx, "Failed to refresh stale activities of athlete %v: %v", athleteId, err)
 		}
+		return activities, err
+	})
+}
 
-		var hrZone *strava.ZonesSummary
+// activityFlight is result of shared activity retrieval
+type activityFlight struct {
+	activity *cache.ExtendedActivityInfo
+	upgraded bool
+}
 
-		for _, zone := range zones {
-			if zone.Type == "heartrate" {
-				hrZone = zone
-				break
-			}
+// retrieveActivity returns activity details, upgrade makes cached entry
+// predating some zone types download again
+func (api *AnalysisApi) retrieveActivity(ctx context.Context, token string, athleteId int64, activityId int64, upgrade bool) (*cache.ExtendedActivityInfo, error) {
+	key := fmt.Sprintf("activity/%v/%v", athleteId, activityId)
+	retrieve := func() (*activityFlight, error) {
+		// caller abandoning download keeps its worker until download stops
+		result, err := api.flights.DoSettled(ctx, key, func(ctx context.Context) (interface{}, error) {
+			activity, err := api.loadActivity(ctx, api.stravaClient(ctx, token), athleteId, activityId, upgrade)
+			return &activityFlight{activity, upgrade}, err
+		})
+		if err != nil {
+			return nil, err
 		}
+		return result.(*activityFlight), nil
+	}
+	result, err := retrieve()
+	if err == nil && upgrade && !result.upgraded && !result.activity.HasAllZones() {
+		// joined retrieval which kept cached entry predating some zone types
+		result, err = retrieve()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result.activity, nil
+}
 
-		activityInfo := cache.ExtendedActivityInfo{
-			Activity:     activity,
-			ZonesSummary: hrZone,
-		}
+func (api *AnalysisApi) loadActivity(ctx context.Context, client *strava.Client, athleteId int64, activityId int64, upgrade bool) (*cache.ExtendedActivityInfo, error) {
+	cacheClient := api.Params.ActivityCacheAccessor(ctx)
+	cached, freshness, err := cache.LookupActivity(ctx, cacheClient, api.Params.ActivityTTLPolicy, athleteId, activityId)
+	if err != nil {
+		warningf(ctx, "failed to load activity %v from cache, downloading: %v", activityId, err)
+	}
+	if freshness == cache.FRESH && upgrade && !cached.HasAllZones() {
+		debugf(ctx, "activity %v in cache has heart rate zones only", activityId)
+		freshness = cache.STALE
+	}
+	switch freshness {
+	case cache.FRESH:
+		debugf(ctx, "using activity %v from cache", activityId)
+		return cached, nil
+	case cache.STALE:
+		debugf(ctx, "activity %v in cache is stale, downloading", activityId)
+	default:
+		debugf(ctx, "did not find activity %v in cache, downloading", activityId)
+	}
 
-		cacheClient.StoreActivity(activityId, &activityInfo)
+	var activityInfo *cache.ExtendedActivityInfo
+	select {
+	case api.downloads <- struct{}{}:
+		activityInfo, err = downloadActivity(ctx, client, activityId)
+		<-api.downloads
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		if cached != nil {
+			warningf(ctx, "failed to refresh activity %v, using stale copy: %v", activityId, err)
+			return cached, nil
+		}
+		return nil, err
+	}
 
-		return &activityInfo, nil
+	if err := cacheClient.StoreActivity(ctx, athleteId, activityId, activityInfo); err != nil {
+		warningf(ctx, "failed to store activity %v in cache: %v", activityId, err)
 	}
+
+	return activityInfo, nil
 }
 
-func (api *AnalysisApi) getActivities(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+func downloadActivity(ctx context.Context, client *strava.Client, activityId int64) (*cache.ExtendedActivityInfo, error) {
+	activitiesService := strava.NewActivitiesService(client)
+	activityCall := activitiesService.Get(activityId)
+	activity, err := activityCall.Do()
+	if err != nil {
+		return nil, stravaCallError(err)
+	}
 
-	defer func() {
-		if r := recover(); r != nil {
-			log.Warningf(ctx, "Recovered: %v", r)
-			fmt.Fprintln(w, r) // TODO proper json response
-		}
-	}()
+	zonesCall := activitiesService.ListZones(activityId)
+	zones, err := zonesCall.Do()
+	if err != nil {
+		return nil, stravaCallError(err)
+	}
 
-	// TODO: YOLO error handling
-	athleteId := api.getAthleteId(r)
-	client := api.getStravaClient(r)
-	fullActivities := api.retrieveActivities(ctx, client, athleteId)
-	content, _ := json.MarshalIndent(fullActivities, "", " ")
-	fmt.Fprint(w, string(content))
+	if zones == nil {
+		zones = make([]*strava.ZonesSummary, 0)
+	}
+	info := &cache.ExtendedActivityInfo{
+		Activity: activity,
+		Zones:    zones,
+	}
+	// kept for readers of cache which predate other zone types
+	info.ZonesSummary = info.ZonesOfType(cache.ZONES_HEARTRATE)
+	return info, nil
 }
 
-func (api *AnalysisApi) getZonesData(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+func (api *AnalysisApi) getActivities(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	auth := authFromContext(ctx)
+	query, err := parseActivityQuery(r.URL.Query())
+	if err != nil {
+		return err
+	}
+	fullActivities, err := api.retrieveActivities(ctx, auth.Token, auth.AthleteId)
+	if err != nil {
+		return err
+	}
+	response := query.Apply(fullActivities)
+	if !query.Paged() {
+		// clients predating pagination expect bare list
+		writeJson(w, http.StatusOK, response.Activities)
+		return nil
+	}
+	writeJson(w, http.StatusOK, response)
+	return nil
+}
 
-	defer func() {
-		if r := recover(); r != nil {
-			log.Warningf(ctx, "Recovered: %v", r)
-			fmt.Fprintln(w, r) // TODO proper json response
+// addZoneTotals adds time in zones of activity to totals, activities are
+// expected newest first
+func addZoneTotals(totals []ZoneTotal, zones *strava.ZonesSummary) []ZoneTotal {
+	for i, bucket := range zones.Buckets {
+		if bucket == nil {
+			continue
 		}
-	}()
+		if i == len(totals) {
+			totals = append(totals, ZoneTotal{Min: bucket.Min, Max: bucket.Max})
+		}
+		totals[i].Time += bucket.Time
+		totals[i].Activities++
+	}
+	return totals
+}
 
-	athleteId := api.getAthleteId(r)
-	client := api.getStravaClient(r)
-	fullActivities := api.retrieveActivities(ctx, client, athleteId)
-	histogramData := make([]ActivityZoneInfo, 0)
+// getZonesData returns zone distributions of public activities, zone types
+// are selected by repeated or comma separated type parameter
+func (api *AnalysisApi) getZonesData(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	auth := authFromContext(ctx)
+	zoneTypes, err := parseZoneTypes(r.URL.Query()["type"])
+	if err != nil {
+		return err
+	}
+	fullActivities, err := api.retrieveActivities(ctx, auth.Token, auth.AthleteId)
+	if err != nil {
+		return err
+	}
+	public := make(cache.ActivityList, 0, len(fullActivities))
 	for _, activity := range fullActivities {
-		if activity.Private {
-			continue
+		if !activity.Private {
+			public = append(public, activity)
 		}
-		activityExtended, err := api.retrieveActivity(ctx, client, activity.Id)
-		if err != nil {
-			log.Warningf(ctx, "Failed to retrieve activity %v: %v", activity.Id, err.Error())
+	}
+	details, skipped := api.hydrateActivities(ctx, auth.Token, auth.AthleteId, public, zoneTypes)
+	histogramData := make([]ActivityZoneInfo, 0, len(public))
+	totals := make(map[string][]ZoneTotal)
+	for _, zoneType := range zoneTypes {
+		totals[zoneType] = make([]ZoneTotal, 0)
+	}
+	for i, activity := range public {
+		if details[i] == nil {
 			continue
 		}
 		zoneInfo := ActivityZoneInfo{
 			ActivityInfo: activity,
-			ZoneInfo:     activityExtended.ZonesSummary,
+			ZoneInfo:     details[i].ZonesOfType(cache.ZONES_HEARTRATE),
+			Zones:        make(map[string]*strava.ZonesSummary),
+		}
+		for _, zoneType := range zoneTypes {
+			if zones := details[i].ZonesOfType(zoneType); zones != nil {
+				zoneInfo.Zones[zoneType] = zones
+				totals[zoneType] = addZoneTotals(totals[zoneType], zones)
+			} else if !details[i].KnowsZones(zoneType) {
+				zoneInfo.MissingZones = append(zoneInfo.MissingZones, zoneType)
+			}
 		}
 		histogramData = append(histogramData, zoneInfo)
 	}
+	if len(skipped) > 0 {
+		warningf(ctx, "Skipped %v of %v activities of athlete %v", len(skipped), len(public), auth.AthleteId)
+	}
 	response := ZoneInfoResponse{
 		Activities: histogramData,
+		Totals:     totals,
+		Skipped:    skipped,
+	}
+	writeJson(w, http.StatusOK, response)
+	return nil
+}
+
+// needsZoneUpgrade tells whether activity cached before zone types other than
+// heart rate were kept should be downloaded again, only power zones may be
+// missing and only activities with power data have them
+func needsZoneUpgrade(activity *strava.ActivitySummary, zoneTypes []string) bool {
+	if activity.AveragePower == 0 {
+		return false
+	}
+	for _, zoneType := range zoneTypes {
+		if zoneType == cache.ZONES_POWER {
+			return true
+		}
+	}
+	return false
+}
+
+func parseZoneTypes(values []string) ([]string, error) {
+	zoneTypes := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, zoneType := range strings.Split(value, ",") {
+			switch zoneType = strings.TrimSpace(zoneType); zoneType {
+			case "":
+			case cache.ZONES_HEARTRATE, cache.ZONES_POWER:
+				if !seen[zoneType] {
+					seen[zoneType] = true
+					zoneTypes = append(zoneTypes, zoneType)
+				}
+			default:
+				return nil, badRequest(fmt.Sprintf("Invalid zone type %q, expected heartrate or power", zoneType))
+			}
+		}
+	}
+	if len(zoneTypes) == 0 {
+		return []string{cache.ZONES_HEARTRATE, cache.ZONES_POWER}, nil
+	}
+	return zoneTypes, nil
+}
+
+// getRateLimit reports Strava request budget left, so clients can tell
+// whether loading more data is feasible
+func (api *AnalysisApi) getRateLimit(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if api.Params.RateLimits == nil {
+		writeJson(w, http.StatusOK, RateLimitBudget{})
+		return nil
 	}
-	content, _ := json.MarshalIndent(response, "", " ")
-	fmt.Fprint(w, string(content))
+	writeJson(w, http.StatusOK, api.Params.RateLimits.Budget())
+	return nil
 }
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
+	"reflect"
+	"testing"
+)
+
+func TestParseZoneTypes(t *testing.T) {
+	cases := []struct {
+		values   []string
+		expected []string
+	}{
+		{nil, []string{"heartrate", "power"}},
+		{[]string{"power"}, []string{"power"}},
+		{[]string{"power,heartrate", "power"}, []string{"power", "heartrate"}},
+	}
+	for _, c := range cases {
+		actual, err := parseZoneTypes(c.values)
+		if err != nil || !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%v: expected %v, got %v, %v", c.values, c.expected, actual, err)
+		}
+	}
+	if _, err := parseZoneTypes([]string{"pace"}); err == nil {
+		t.Errorf("Unknown zone type should be rejected")
+	}
+}
+
+func TestAddZoneTotals(t *testing.T) {
+	latest := &strava.ZonesSummary{Type: "power", Buckets: []*strava.ZoneBucket{
+		{Min: 0, Max: 150, Time: 100},
+		{Min: 150, Max: -1, Time: 50},
+	}}
+	older := &strava.ZonesSummary{Type: "power", Buckets: []*strava.ZoneBucket{
+		{Min: 0, Max: 140, Time: 10},
+		{Min: 140, Max: 200, Time: 20},
+		{Min: 200, Max: -1, Time: 30},
+	}}
+	totals := addZoneTotals(addZoneTotals(nil, latest), older)
+	expected := []ZoneTotal{
+		{Min: 0, Max: 150, Time: 110, Activities: 2},
+		{Min: 150, Max: -1, Time: 70, Activities: 2},
+		{Min: 200, Max: -1, Time: 30, Activities: 1},
+	}
+	if !reflect.DeepEqual(totals, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, totals)
+	}
+}
+
+func TestLegacyActivityIsServedWithoutUpgrade(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewMapActivityCache()
+	activity := &strava.ActivityDetailed{}
+	activity.Id = 10
+	activity.Athlete.Id = 1
+	legacy := &cache.ExtendedActivityInfo{Activity: activity, ZonesSummary: &strava.ZonesSummary{Type: cache.ZONES_HEARTRATE}}
+	if err := c.StoreActivity(ctx, 1, 10, legacy); err != nil {
+		t.Fatal(err)
+	}
+	api := NewApi(Params{ActivityCacheAccessor: func(ctx context.Context) cache.ActivityCache { return c }})
+	info, err := api.loadActivity(ctx, nil, 1, 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.HasAllZones() || info.ZonesOfType(cache.ZONES_HEARTRATE) == nil {
+		t.Errorf("Legacy entry should be served from cache, got %+v", info)
+	}
+}
+
+func TestNeedsZoneUpgrade(t *testing.T) {
+	withPower := &strava.ActivitySummary{AveragePower: 180}
+	withoutPower := &strava.ActivitySummary{}
+	both := []string{cache.ZONES_HEARTRATE, cache.ZONES_POWER}
+	if !needsZoneUpgrade(withPower, both) {
+		t.Error("Activity with power data should be upgraded when power zones are requested")
+	}
+	if needsZoneUpgrade(withPower, []string{cache.ZONES_HEARTRATE}) || needsZoneUpgrade(withoutPower, both) {
+		t.Error("Upgrade should be needed only for power zones of activity with power data")
+	}
+}
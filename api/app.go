@@ -5,25 +5,25 @@ import (
 	"github.com/chemikadze/strava-analysis-ui/templates"
 	"github.com/chemikadze/strava-analysis-ui/ui/static"
 	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/log"
 	"html/template"
 	"net/http"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 )
 
-var cookieStravaToken = "strava-token"
-var cookieAthleteId = "athlete-id"
-var cookieAthleteName = "athlete-name"
+// cookies used before server-side sessions, removed on login
+var legacyCookies = []string{"strava-token", "athlete-id", "athlete-name"}
 
 var epoch = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
 
 type AnalysisApp struct {
 	Params Params
 	auth   *strava.OAuthAuthenticator
+	// concurrent refreshes of session token are shared
+	flights flightGroup
 }
 
 type templateContext struct {
@@ -32,6 +32,7 @@ type templateContext struct {
 	AthleteId       int64
 	LoginLink       string
 	GraphScriptLink string
+	ZonesEnabled    bool
 }
 
 func callbackUrl(rootUrl string) string {
@@ -46,16 +47,12 @@ func NewApp(params Params) *AnalysisApp {
 	strava.ClientId = params.ClientId
 	strava.ClientSecret = params.ClientSecret
 	return &AnalysisApp{
-		params,
-		auth,
+		Params:  params,
+		auth:    auth,
+		flights: flightGroup{background: params.BackgroundContext},
 	}
 }
 
-func forceAtoI64(s string) int64 {
-	x, _ := strconv.Atoi(s)
-	return int64(x)
-}
-
 func (app *AnalysisApp) AttachHandlers(mux *http.ServeMux) {
 	path, err := app.auth.CallbackPath()
 	if err != nil {
@@ -63,9 +60,10 @@ func (app *AnalysisApp) AttachHandlers(mux *http.ServeMux) {
 	}
 
 	mux.HandleFunc("/", app.getIndex)
+	mux.HandleFunc("/login", app.getLogin)
 	mux.HandleFunc("/logout", app.getLogout)
 	mux.Handle("/static/", NewStaticServer(app.Params.StaticServerType))
-	mux.HandleFunc(path, app.auth.HandlerFunc(app.oAuthSuccess, app.oAuthFailure))
+	mux.HandleFunc(path, app.exchangeToken)
 }
 
 func (app *AnalysisApp) graphFromRequest(r *http.Request) string {
@@ -77,27 +75,42 @@ func (app *AnalysisApp) graphFromRequest(r *http.Request) string {
 	return fmt.Sprintf("/static/graphs/%s.js", graph[0])
 }
 
-func (app *AnalysisApp) getTemplateContext(r *http.Request) templateContext {
-	athleteIdCookie, err := r.Cookie(cookieAthleteId)
-	athleteNameCookie, _ := r.Cookie(cookieAthleteName)
-	if err != nil || len(athleteIdCookie.Value) == 0 {
-		ctx := appengine.NewContext(r)
-		defaultHostname, _ := appengine.ModuleHostname(ctx, "", "", "")
-		log.Debugf(ctx, "Default hostname: %s", defaultHostname)
-		// TODO: not thread-safe
-		if !strings.Contains(app.auth.CallbackURL, defaultHostname) {
-			app.auth.CallbackURL = callbackUrl("http://" + defaultHostname)
+func (app *AnalysisApp) loginLink(r *http.Request) string {
+	ctx := appengine.NewContext(r)
+	defaultHostname, _ := appengine.ModuleHostname(ctx, "", "", "")
+	debugf(ctx, "Default hostname: %s", defaultHostname)
+	// TODO: not thread-safe
+	if !strings.Contains(app.auth.CallbackURL, defaultHostname) {
+		app.auth.CallbackURL = callbackUrl(rootUrlScheme(app.Params.RootUrl) + "://" + defaultHostname)
+	}
+	return app.auth.AuthorizationURL("state1", strava.Permissions.ViewPrivate, true)
+}
+
+// getTemplateContext shows login link unless session token is still usable,
+// session which lost Strava authorization is forgotten by browser
+func (app *AnalysisApp) getTemplateContext(w http.ResponseWriter, r *http.Request) templateContext {
+	ctx := appengine.NewContext(r)
+	sessionId, session, err := loadSession(ctx, app.Params, r)
+	if err == nil {
+		_, err = getAccessToken(ctx, app.Params, &app.flights, sessionId, session)
+	}
+	if err != nil {
+		if classifyError(err).status == http.StatusUnauthorized {
+			http.SetCookie(w, sessionCookie(app.Params, "", -1))
+		} else if err != ErrSessionNotFound {
+			errorf(ctx, "Failed to load session: %v", err)
 		}
 		return templateContext{
 			LoggedIn:  false,
-			LoginLink: app.auth.AuthorizationURL("state1", strava.Permissions.ViewPrivate, true),
+			LoginLink: app.loginLink(r),
 		}
 	} else {
 		return templateContext{
 			LoggedIn:        true,
-			AthleteName:     athleteNameCookie.Value,
-			AthleteId:       forceAtoI64(athleteIdCookie.Value),
+			AthleteName:     session.AthleteName,
+			AthleteId:       session.AthleteId,
 			GraphScriptLink: app.graphFromRequest(r),
+			ZonesEnabled:    app.Params.ZonesEnabled,
 		}
 	}
 }
@@ -116,7 +129,7 @@ type StaticServer struct{}
 
 func (StaticServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
-	log.Infof(ctx, "Seen: %v", r.URL)
+	infof(ctx, "Seen: %v", r.URL)
 	asset, err := static.Asset(r.URL.Path)
 	if err != nil {
 		http.NotFound(w, r)
@@ -152,7 +165,7 @@ func (app *AnalysisApp) getIndex(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	ctx := app.getTemplateContext(r)
+	ctx := app.getTemplateContext(w, r)
 	template := parseTemplateResources("templates/main.html", "templates/index.html")
 
 	err := template.ExecuteTemplate(w, "main", ctx)
@@ -161,10 +174,43 @@ func (app *AnalysisApp) getIndex(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (app *AnalysisApp) oAuthSuccess(auth *strava.AuthorizationResponse, w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{Name: cookieStravaToken, Value: auth.AccessToken})
-	http.SetCookie(w, &http.Cookie{Name: cookieAthleteName, Value: auth.Athlete.FirstName})
-	http.SetCookie(w, &http.Cookie{Name: cookieAthleteId, Value: strconv.Itoa(int(auth.Athlete.Id))})
+// exchangeToken handles OAuth callback, keeping refresh token server-side
+func (app *AnalysisApp) exchangeToken(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	query := r.URL.Query()
+	if query.Get("error") == "access_denied" {
+		app.oAuthFailure(strava.OAuthAuthorizationDeniedErr, w, r)
+		return
+	}
+	code := query.Get("code")
+	if code == "" {
+		app.oAuthFailure(strava.OAuthInvalidCodeErr, w, r)
+		return
+	}
+	httpClient := requestHttpClient(app.Params, r)
+	token, athlete, err := exchangeCode(httpClient, app.Params.ClientId, app.Params.ClientSecret, code)
+	if err != nil {
+		warningf(ctx, "Failed to exchange authorization code: %v", err)
+		app.oAuthFailure(err, w, r)
+		return
+	}
+	app.oAuthSuccess(ctx, token, athlete, w, r)
+}
+
+func (app *AnalysisApp) oAuthSuccess(ctx context.Context, token *OAuthToken, athlete *strava.AthleteDetailed, w http.ResponseWriter, r *http.Request) {
+	session := &Session{
+		AthleteId:   athlete.Id,
+		AthleteName: athlete.FirstName,
+		Token:       *token,
+	}
+	if err := startSession(ctx, app.Params, w, session); err != nil {
+		errorf(ctx, "Failed to start session of athlete %v: %v", athlete.Id, err)
+		app.oAuthFailure(err, w, r)
+		return
+	}
+	for _, name := range legacyCookies {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: "", Expires: epoch})
+	}
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -187,9 +233,19 @@ func (app *AnalysisApp) oAuthFailure(err error, w http.ResponseWriter, r *http.R
 	}
 }
 
+func (app *AnalysisApp) getLogin(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, app.loginLink(r), http.StatusSeeOther)
+}
+
 func (app *AnalysisApp) getLogout(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if err := endSession(ctx, app.Params, w, r); err != nil {
+		warningf(ctx, "Failed to delete session: %v", err)
+	}
 	for _, cookie := range r.Cookies() {
-		http.SetCookie(w, &http.Cookie{Name: cookie.Name, Value: "", Expires: epoch})
+		if cookie.Name != cookieSession {
+			http.SetCookie(w, &http.Cookie{Name: cookie.Name, Value: "", Expires: epoch})
+		}
 	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"fmt"
+	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
+	"net/http"
+	"time"
+)
+
+type contextKey int
+
+const authContextKey contextKey = 0
+
+// requestAuth is identity of athlete making API request
+type requestAuth struct {
+	AthleteId int64
+	SessionId string
+	// Strava access token, clients are built for context they are used in
+	Token string
+}
+
+// authenticated resolves athlete identity and Strava token once per request,
+// handler gets them from context with authFromContext
+func (api *AnalysisApi) authenticated(handler apiHandler) apiHandler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		err := api.authenticate(ctx, w, r, handler)
+		if err != nil && classifyError(err).status == http.StatusUnauthorized {
+			// browser forgets session which can not be used anymore
+			http.SetCookie(w, sessionCookie(api.Params, "", -1))
+		}
+		return err
+	}
+}
+
+func (api *AnalysisApi) authenticate(ctx context.Context, w http.ResponseWriter, r *http.Request, handler apiHandler) error {
+	sessionId, session, err := loadSession(ctx, api.Params, r)
+	if err == ErrSessionNotFound {
+		return unauthorized("Not logged in", nil)
+	} else if err != nil {
+		return err
+	}
+	token, err := getAccessToken(ctx, api.Params, &api.flights, sessionId, session)
+	if err != nil {
+		return err
+	}
+	ctx = context.WithValue(ctx, authContextKey, &requestAuth{session.AthleteId, sessionId, token})
+	return handler(ctx, w, r.WithContext(ctx))
+}
+
+// authFromContext returns identity stored by authenticated middleware
+func authFromContext(ctx context.Context) *requestAuth {
+	auth, _ := ctx.Value(authContextKey).(*requestAuth)
+	return auth
+}
+
+// contextTransport binds requests to context, so they are cancelled with it
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req.WithContext(t.ctx))
+}
+
+// contextHttpClient returns client for work which is not bound to request,
+// e.g. shared downloads, its requests are cancelled with ctx
+func contextHttpClient(params Params, ctx context.Context) *http.Client {
+	client := &http.Client{}
+	if params.ContextClientGenerator != nil {
+		generated := *params.ContextClientGenerator(ctx)
+		client = &generated
+	}
+	client.Transport = &contextTransport{ctx, client.Transport}
+	return client
+}
+
+// stravaClient returns Strava client authorized with token for use in ctx
+func (api *AnalysisApi) stravaClient(ctx context.Context, token string) *strava.Client {
+	return strava.NewClient(token, contextHttpClient(api.Params, ctx))
+}
+
+func requestHttpClient(params Params, r *http.Request) *http.Client {
+	if params.RequestClientGenerator != nil {
+		return params.RequestClientGenerator(r)
+	}
+	return http.DefaultClient
+}
+
+// getAccessToken returns session access token, refreshing it if it expires
+// soon
+func getAccessToken(ctx context.Context, params Params, flights *flightGroup, sessionId string, session *Session) (string, error) {
+	token := &session.Token
+	if token.ExpiresSoon(time.Now()) {
+		// concurrent requests share one refresh, as Strava may rotate refresh token
+		result, err := flights.Do(ctx, fmt.Sprintf("session/%v", sessionId), func(ctx context.Context) (interface{}, error) {
+			return refreshSessionToken(ctx, params, sessionId)
+		})
+		if err != nil {
+			return "", err
+		}
+		token = result.(*OAuthToken)
+	}
+	return token.AccessToken, nil
+}
+
+// sessionToken returns current access token of session, so work outliving
+// request keeps working after token it started with expired
+func (api *AnalysisApi) sessionToken(ctx context.Context, sessionId string) (string, error) {
+	session, err := api.Params.SessionStoreAccessor(ctx).GetSession(ctx, sessionId)
+	if err == ErrSessionNotFound {
+		return "", unauthorized("Not logged in", nil)
+	} else if err != nil {
+		return "", err
+	}
+	return getAccessToken(ctx, api.Params, &api.flights, sessionId, session)
+}
+
+func refreshSessionToken(ctx context.Context, params Params, sessionId string) (*OAuthToken, error) {
+	store := params.SessionStoreAccessor(ctx)
+	// token might be refreshed by request which finished meanwhile
+	session, err := store.GetSession(ctx, sessionId)
+	if err == ErrSessionNotFound {
+		return nil, unauthorized("Not logged in", nil)
+	} else if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !session.Token.ExpiresSoon(now) {
+		return &session.Token, nil
+	}
+	httpClient := contextHttpClient(params, ctx)
+	refreshed, err := refreshToken(httpClient, params.ClientId, params.ClientSecret, &session.Token)
+	if err != nil {
+		if !session.Token.Expired(now) {
+			warningf(ctx, "Failed to refresh token of athlete %v, using current one: %v", session.AthleteId, err)
+			return &session.Token, nil
+		}
+		if tokenErr, ok := err.(*tokenError); ok && tokenErr.rejected() {
+			if err := store.DeleteSession(ctx, sessionId); err != nil {
+				warningf(ctx, "Failed to delete session with rejected token: %v", err)
+			}
+		}
+		return nil, unauthorized("Strava authorization expired, please log in again", err)
+	}
+	debugf(ctx, "Refreshed token of athlete %v, expires at %v", session.AthleteId, refreshed.ExpiresAt)
+	session.Token = *refreshed
+	if err := store.StoreSession(ctx, sessionId, session); err != nil {
+		return nil, err
+	}
+	return refreshed, nil
+}
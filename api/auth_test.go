@@ -0,0 +1,202 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testSessionSecret = []byte("test secret")
+
+func newSessionTestApi(store SessionStore) *AnalysisApi {
+	return NewApi(Params{
+		ClientId:             7,
+		ClientSecret:         "secret",
+		SessionStoreAccessor: func(ctx context.Context) SessionStore { return store },
+		SessionSecret:        testSessionSecret,
+	})
+}
+
+// loggedIn stores session for athlete and returns its cookie
+func loggedIn(t *testing.T, store SessionStore, athleteId int64, token OAuthToken) *http.Cookie {
+	recorder := httptest.NewRecorder()
+	params := Params{
+		SessionStoreAccessor: func(ctx context.Context) SessionStore { return store },
+		SessionSecret:        testSessionSecret,
+	}
+	if err := startSession(context.Background(), params, recorder, &Session{AthleteId: athleteId, Token: token}); err != nil {
+		t.Fatal(err)
+	}
+	return recorder.Result().Cookies()[0]
+}
+
+func serveAuthenticated(api *AnalysisApi, cookies ...*http.Cookie) (*httptest.ResponseRecorder, *requestAuth) {
+	var seen *requestAuth
+	handler := handle(api.authenticated(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		seen = authFromContext(ctx)
+		if authFromContext(r.Context()) != seen {
+			panic("request context should have the same identity")
+		}
+		return nil
+	}))
+	request := httptest.NewRequest("GET", "/activities", nil)
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	return recorder, seen
+}
+
+func TestAuthenticatedResolvesIdentity(t *testing.T) {
+	store := NewMemorySessionStore()
+	cookie := loggedIn(t, store, 42, OAuthToken{AccessToken: "a1"})
+	recorder, auth := serveAuthenticated(newSessionTestApi(store), cookie)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %v: %v", recorder.Code, recorder.Body.String())
+	}
+	if auth == nil || auth.AthleteId != 42 || auth.Token != "a1" {
+		t.Errorf("Unexpected identity %+v", auth)
+	}
+}
+
+func TestAuthenticatedRejectsAnonymous(t *testing.T) {
+	store := NewMemorySessionStore()
+	valid := loggedIn(t, store, 42, OAuthToken{AccessToken: "a1"})
+	id, _ := verifySessionId(testSessionSecret, valid.Value)
+	unknownId, _ := newSessionId()
+	cases := map[string][]*http.Cookie{
+		"no cookies":      nil,
+		"legacy cookies":  {{Name: "strava-token", Value: "a1"}, {Name: "athlete-id", Value: "42"}},
+		"unsigned id":     {{Name: cookieSession, Value: id}},
+		"forged id":       {{Name: cookieSession, Value: signSessionId([]byte("other secret"), id)}},
+		"unknown session": {{Name: cookieSession, Value: signSessionId(testSessionSecret, unknownId)}},
+	}
+	for name, cookies := range cases {
+		recorder, auth := serveAuthenticated(newSessionTestApi(store), cookies...)
+		var response ErrorResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		if recorder.Code != http.StatusUnauthorized || response.Error.Code != ERROR_UNAUTHORIZED {
+			t.Errorf("%v: unexpected response %v %v", name, recorder.Code, recorder.Body.String())
+		}
+		if auth != nil {
+			t.Errorf("%v: handler should not be called", name)
+		}
+	}
+}
+
+func TestAuthenticatedRefreshesExpiringToken(t *testing.T) {
+	var calls int32
+	defer tokenServer(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		r.ParseForm()
+		if r.Form.Get("refresh_token") != "r1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"a2","refresh_token":"r2","expires_at":%v}`, time.Now().Add(6*time.Hour).Unix())
+	})()
+	store := NewMemorySessionStore()
+	cookie := loggedIn(t, store, 42, OAuthToken{AccessToken: "a1", RefreshToken: "r1", ExpiresAt: time.Now().Add(time.Minute)})
+	api := newSessionTestApi(store)
+
+	for i := 0; i < 2; i++ {
+		if recorder, _ := serveAuthenticated(api, cookie); recorder.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %v: %v", recorder.Code, recorder.Body.String())
+		}
+	}
+	id, _ := verifySessionId(testSessionSecret, cookie.Value)
+	session, _ := store.GetSession(context.Background(), id)
+	if session.Token.AccessToken != "a2" || session.Token.RefreshToken != "r2" {
+		t.Errorf("Refreshed token should be stored, got %+v", session.Token)
+	}
+	if calls != 1 {
+		t.Errorf("Expected single refresh, got %v", calls)
+	}
+}
+
+func TestAuthenticatedRefreshFailure(t *testing.T) {
+	defer tokenServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"message":"Bad Request"}`)
+	})()
+	store := NewMemorySessionStore()
+	api := newSessionTestApi(store)
+
+	expiring := loggedIn(t, store, 42, OAuthToken{AccessToken: "a1", RefreshToken: "r1", ExpiresAt: time.Now().Add(time.Minute)})
+	if recorder, _ := serveAuthenticated(api, expiring); recorder.Code != http.StatusOK {
+		t.Errorf("Token not yet expired should be used, got %v", recorder.Code)
+	}
+
+	expired := loggedIn(t, store, 42, OAuthToken{AccessToken: "a1", RefreshToken: "r1", ExpiresAt: time.Now().Add(-time.Minute)})
+	recorder, _ := serveAuthenticated(api, expired)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expired token should require login, got %v", recorder.Code)
+	}
+	if !clearsSessionCookie(recorder) {
+		t.Errorf("Session cookie should be cleared, got %v", recorder.Header())
+	}
+	id, _ := verifySessionId(testSessionSecret, expired.Value)
+	if _, err := store.GetSession(context.Background(), id); err != ErrSessionNotFound {
+		t.Errorf("Session with rejected token should be deleted, got %v", err)
+	}
+}
+
+func TestContextHttpClientIsCancelledWithContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	client := contextHttpClient(Params{}, ctx)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := client.Get(server.URL); err == nil {
+		t.Error("Request should fail when context is cancelled")
+	}
+}
+
+func clearsSessionCookie(recorder *httptest.ResponseRecorder) bool {
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == cookieSession && cookie.MaxAge < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestIndexRequiresUsableToken(t *testing.T) {
+	defer tokenServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"message":"Bad Request"}`)
+	})()
+	store := NewMemorySessionStore()
+	app := NewApp(newSessionTestApi(store).Params)
+
+	valid := loggedIn(t, store, 42, OAuthToken{AccessToken: "a1", RefreshToken: "r1", ExpiresAt: time.Now().Add(time.Hour)})
+	request := httptest.NewRequest("GET", "/", nil)
+	request.AddCookie(valid)
+	if page := app.getTemplateContext(httptest.NewRecorder(), request); !page.LoggedIn || page.AthleteId != 42 {
+		t.Errorf("Athlete with usable token should be logged in, got %+v", page)
+	}
+
+	rejected := loggedIn(t, store, 42, OAuthToken{AccessToken: "a1", RefreshToken: "r1", ExpiresAt: time.Now().Add(-time.Minute)})
+	request = httptest.NewRequest("GET", "/", nil)
+	request.AddCookie(rejected)
+	recorder := httptest.NewRecorder()
+	if page := app.getTemplateContext(recorder, request); page.LoggedIn {
+		t.Errorf("Athlete with rejected token should get login link, got %+v", page)
+	}
+	if !clearsSessionCookie(recorder) {
+		t.Errorf("Session cookie should be cleared, got %v", recorder.Header())
+	}
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// machine-readable error codes reported to frontend
+const (
+	ERROR_BAD_REQUEST  = "bad_request"
+	ERROR_UNAUTHORIZED = "unauthorized"
+	ERROR_RATE_LIMITED = "rate_limited"
+	ERROR_UPSTREAM     = "upstream_error"
+	ERROR_INTERNAL     = "internal_error"
+)
+
+// ErrorResponse is body of every failed API response.
+type ErrorResponse struct {
+	Error ErrorInfo `json:"error"`
+}
+
+type ErrorInfo struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// whether the same request may succeed later
+	Retryable bool `json:"retryable"`
+	// seconds to wait before retrying, if known
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// apiError is error with known response status, message is shown to user
+// while cause is only logged
+type apiError struct {
+	status     int
+	code       string
+	message    string
+	retryable  bool
+	retryAfter time.Duration
+	cause      error
+}
+
+func (e *apiError) Error() string {
+	if e.cause != nil {
+		return fmt.Sprintf("%s: %s", e.message, e.cause.Error())
+	}
+	return e.message
+}
+
+func badRequest(message string) *apiError {
+	return &apiError{status: http.StatusBadRequest, code: ERROR_BAD_REQUEST, message: message}
+}
+
+func unauthorized(message string, cause error) *apiError {
+	return &apiError{status: http.StatusUnauthorized, code: ERROR_UNAUTHORIZED, message: message, cause: cause}
+}
+
+func rateLimited(cause error, retryAfter time.Duration) *apiError {
+	return &apiError{
+		status:     http.StatusTooManyRequests,
+		code:       ERROR_RATE_LIMITED,
+		message:    "Strava rate limit exceeded",
+		retryable:  true,
+		retryAfter: retryAfter,
+		cause:      cause,
+	}
+}
+
+func upstreamError(cause error) *apiError {
+	return &apiError{
+		status:    http.StatusBadGateway,
+		code:      ERROR_UPSTREAM,
+		message:   "Strava request failed",
+		retryable: true,
+		cause:     cause,
+	}
+}
+
+func internalError(cause error) *apiError {
+	return &apiError{status: http.StatusInternalServerError, code: ERROR_INTERNAL, message: "Internal error", cause: cause}
+}
+
+// classifyError maps error returned by handler to response
+func classifyError(err error) *apiError {
+	switch e := err.(type) {
+	case *apiError:
+		return e
+	case strava.Error:
+		return classifyStravaError(&e)
+	case *strava.Error:
+		return classifyStravaError(e)
+	case *RateLimitError:
+		return rateLimited(err, e.RetryAfter)
+	case *url.Error:
+		if limitErr, ok := e.Err.(*RateLimitError); ok {
+			return rateLimited(err, limitErr.RetryAfter)
+		}
+		// Strava is the only remote service requested by http client
+		return upstreamError(err)
+	default:
+		return internalError(err)
+	}
+}
+
+// stravaCallError marks error of go.strava call which is not recognized
+// by classifyError as upstream failure, e.g. error reported for 5xx response
+// without JSON body
+func stravaCallError(err error) error {
+	switch err.(type) {
+	case strava.Error, *strava.Error, *RateLimitError, *url.Error, *apiError:
+		return err
+	default:
+		return upstreamError(err)
+	}
+}
+
+// go.strava drops response status, so it is restored from error content
+func classifyStravaError(err *strava.Error) *apiError {
+	if strings.Contains(strings.ToLower(err.Message), "rate limit") {
+		// RateLimitTransport reports exhausted daily limit as RateLimitError,
+		// so limit reported by Strava is the short one
+		return rateLimited(err, untilNextWindow(time.Now()))
+	}
+	if strings.Contains(strings.ToLower(err.Message), "authorization") {
+		return unauthorized("Strava authorization expired, please log in again", err)
+	}
+	for _, detail := range err.Errors {
+		if detail != nil && detail.Field == "access_token" {
+			return unauthorized("Strava authorization expired, please log in again", err)
+		}
+	}
+	return upstreamError(err)
+}
+
+func writeError(ctx context.Context, w http.ResponseWriter, err error) {
+	apiErr := classifyError(err)
+	if apiErr.status >= http.StatusInternalServerError {
+		errorf(ctx, "Request failed: %v", err)
+	} else {
+		infof(ctx, "Request rejected: %v", err)
+	}
+	response := ErrorResponse{ErrorInfo{
+		Code:       apiErr.code,
+		Message:    apiErr.message,
+		Retryable:  apiErr.retryable,
+		RetryAfter: int((apiErr.retryAfter + time.Second - 1) / time.Second),
+	}}
+	if response.Error.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(response.Error.RetryAfter))
+	}
+	writeJson(w, apiErr.status, response)
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		status = http.StatusInternalServerError
+		content = []byte(`{"error":{"code":"` + ERROR_INTERNAL + `","message":"Internal error"}}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(content)
+}
+
+// apiHandler returns error instead of writing failed response itself
+type apiHandler func(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+
+// handle converts errors and panics of handler to JSON error responses
+func handle(handler apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		defer func() {
+			if p := recover(); p != nil {
+				writeError(ctx, w, internalError(fmt.Errorf("recovered: %v", p)))
+			}
+		}()
+		if err := handler(ctx, w, r); err != nil {
+			writeError(ctx, w, err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{badRequest("bad"), http.StatusBadRequest, ERROR_BAD_REQUEST},
+		{strava.Error{Message: "Authorization Error"}, http.StatusUnauthorized, ERROR_UNAUTHORIZED},
+		{&strava.Error{
+			Message: "Bad Request",
+			Errors:  []*strava.ErrorDetailed{{Resource: "Athlete", Field: "access_token", Code: "invalid"}},
+		}, http.StatusUnauthorized, ERROR_UNAUTHORIZED},
+		{strava.Error{Message: "Rate Limit Exceeded"}, http.StatusTooManyRequests, ERROR_RATE_LIMITED},
+		{strava.Error{Message: "Record Not Found"}, http.StatusBadGateway, ERROR_UPSTREAM},
+		{&url.Error{Op: "Get", URL: "https://www.strava.com/api/v3", Err: errors.New("timeout")}, http.StatusBadGateway, ERROR_UPSTREAM},
+		{errors.New("cache is broken"), http.StatusInternalServerError, ERROR_INTERNAL},
+		{stravaCallError(errors.New("server error")), http.StatusBadGateway, ERROR_UPSTREAM},
+		{stravaCallError(strava.Error{Message: "Authorization Error"}), http.StatusUnauthorized, ERROR_UNAUTHORIZED},
+	}
+	for _, c := range cases {
+		apiErr := classifyError(c.err)
+		if apiErr.status != c.status || apiErr.code != c.code {
+			t.Errorf("%v: expected %v %v, got %v %v", c.err, c.status, c.code, apiErr.status, apiErr.code)
+		}
+	}
+}
+
+func TestUntilNextWindow(t *testing.T) {
+	now := time.Date(2017, 1, 1, 10, 7, 30, 0, time.UTC)
+	if actual := untilNextWindow(now); actual != 7*time.Minute+30*time.Second {
+		t.Errorf("Unexpected wait %v", actual)
+	}
+}
+
+func serve(handler apiHandler) (*httptest.ResponseRecorder, ErrorResponse) {
+	recorder := httptest.NewRecorder()
+	handle(handler)(recorder, httptest.NewRequest("GET", "/activities", nil))
+	var response ErrorResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder, response
+}
+
+func TestHandleWritesErrorEnvelope(t *testing.T) {
+	recorder, response := serve(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		return strava.Error{Message: "Rate Limit Exceeded: secret details"}
+	})
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("Unexpected status %v", recorder.Code)
+	}
+	if recorder.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Unexpected content type %v", recorder.Header().Get("Content-Type"))
+	}
+	if recorder.Header().Get("Retry-After") == "" {
+		t.Error("Rate limited response should have Retry-After header")
+	}
+	if response.Error.Code != ERROR_RATE_LIMITED || !response.Error.Retryable || response.Error.RetryAfter <= 0 {
+		t.Errorf("Unexpected error %+v", response.Error)
+	}
+	if response.Error.Message != "Strava rate limit exceeded" {
+		t.Errorf("Strava error text should not be exposed, got %v", response.Error.Message)
+	}
+}
+
+func TestHandleRecoversPanic(t *testing.T) {
+	recorder, response := serve(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		panic("nil pointer")
+	})
+	if recorder.Code != http.StatusInternalServerError || response.Error.Code != ERROR_INTERNAL {
+		t.Errorf("Unexpected response %v %+v", recorder.Code, response.Error)
+	}
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+// number of activities retrieved concurrently by one request
+var hydrationWorkers = 8
+
+// number of activities downloaded from Strava concurrently by all requests
+var maxActivityDownloads = 8
+
+// how long retrieving single activity may take
+var activityDeadline = 15 * time.Second
+
+// reasons for skipping activity, besides error codes
+const (
+	SKIP_TIMEOUT   = "timeout"
+	SKIP_CANCELLED = "cancelled"
+)
+
+// SkippedActivity explains why activity is missing from partial response.
+type SkippedActivity struct {
+	ActivityId int64  `json:"activity_id"`
+	Code       string `json:"code"`
+	Reason     string `json:"reason"`
+}
+
+// forEachConcurrently calls fn for indexes 0..count-1 on bounded number of
+// workers, every call gets its own deadline unless it is zero. Errors are
+// returned by index, calls not started before ctx is done get ctx error.
+func forEachConcurrently(ctx context.Context, count int, workers int, deadline time.Duration, fn func(ctx context.Context, i int) error) []error {
+	errs := make([]error, count)
+	if workers < 1 {
+		workers = 1
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < count; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if deadline == 0 {
+					errs[i] = fn(ctx, i)
+					continue
+				}
+				callCtx, cancel := context.WithTimeout(ctx, deadline)
+				errs[i] = fn(callCtx, i)
+				cancel()
+			}
+		}()
+	}
+	next := 0
+dispatch:
+	for ; next < count; next++ {
+		select {
+		case indexes <- next:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	for i := next; i < count; i++ {
+		errs[i] = ctx.Err()
+	}
+	return errs
+}
+
+func skipReason(activityId int64, err error) SkippedActivity {
+	switch err {
+	case context.DeadlineExceeded:
+		return SkippedActivity{activityId, SKIP_TIMEOUT, "Activity was not loaded in time"}
+	case context.Canceled:
+		return SkippedActivity{activityId, SKIP_CANCELLED, "Request was cancelled"}
+	}
+	apiErr := classifyError(err)
+	return SkippedActivity{activityId, apiErr.code, apiErr.message}
+}
+
+// hydrateActivities retrieves details of activities concurrently, results
+// keep order of activities, failed ones are nil and listed as skipped. Cached
+// activities missing requested zone types are upgraded.
+func (api *AnalysisApi) hydrateActivities(ctx context.Context, token string, athleteId int64, activities cache.ActivityList, zoneTypes []string) ([]*cache.ExtendedActivityInfo, []SkippedActivity) {
+	details := make([]*cache.ExtendedActivityInfo, len(activities))
+	errs := forEachConcurrently(ctx, len(activities), hydrationWorkers, activityDeadline, func(ctx context.Context, i int) (err error) {
+		details[i], err = api.retrieveActivity(ctx, token, athleteId, activities[i].Id, needsZoneUpgrade(activities[i], zoneTypes))
+		return err
+	})
+	skipped := make([]SkippedActivity, 0)
+	for i, err := range errs {
+		if err != nil {
+			details[i] = nil
+			skipped = append(skipped, skipReason(activities[i].Id, err))
+		}
+	}
+	return details, skipped
+}
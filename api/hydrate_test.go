@@ -0,0 +1,115 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForEachConcurrentlyBoundsWorkers(t *testing.T) {
+	var running, maxRunning int32
+	errs := forEachConcurrently(context.Background(), 20, 3, time.Second, func(ctx context.Context, i int) error {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			seen := atomic.LoadInt32(&maxRunning)
+			if current <= seen || atomic.CompareAndSwapInt32(&maxRunning, seen, current) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		if i%2 == 1 {
+			return errors.New("odd")
+		}
+		return nil
+	})
+	if maxRunning > 3 {
+		t.Errorf("Expected at most 3 concurrent calls, got %v", maxRunning)
+	}
+	for i, err := range errs {
+		if (err != nil) != (i%2 == 1) {
+			t.Errorf("Error of call %v is out of order: %v", i, err)
+		}
+	}
+}
+
+func TestForEachConcurrentlyDeadlines(t *testing.T) {
+	errs := forEachConcurrently(context.Background(), 3, 3, 10*time.Millisecond, func(ctx context.Context, i int) error {
+		if i == 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	if errs[0] != nil || errs[1] != context.DeadlineExceeded || errs[2] != nil {
+		t.Errorf("Only slow call should time out, got %v", errs)
+	}
+}
+
+func TestForEachConcurrentlySkipsAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int32
+	errs := forEachConcurrently(ctx, 10, 1, time.Second, func(ctx context.Context, i int) error {
+		if atomic.AddInt32(&calls, 1) == 2 {
+			cancel()
+		}
+		return nil
+	})
+	if calls >= 10 {
+		t.Errorf("Calls should stop after cancel, got %v", calls)
+	}
+	if errs[9] != context.Canceled {
+		t.Errorf("Calls not started should be cancelled, got %v", errs[9])
+	}
+}
+
+func TestForEachConcurrentlyBoundsAbandonedFlights(t *testing.T) {
+	var group flightGroup
+	var running, maxRunning int32
+	errs := forEachConcurrently(context.Background(), 12, 3, 5*time.Millisecond, func(ctx context.Context, i int) error {
+		_, err := group.DoSettled(ctx, fmt.Sprintf("activity/%v", i), func(ctx context.Context) (interface{}, error) {
+			current := atomic.AddInt32(&running, 1)
+			for {
+				seen := atomic.LoadInt32(&maxRunning)
+				if current <= seen || atomic.CompareAndSwapInt32(&maxRunning, seen, current) {
+					break
+				}
+			}
+			// download ignoring cancellation outlives deadline
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return nil, nil
+		})
+		return err
+	})
+	if maxRunning > 3 {
+		t.Errorf("Expected at most 3 concurrent downloads, got %v", maxRunning)
+	}
+	for i, err := range errs {
+		if err != context.DeadlineExceeded {
+			t.Errorf("Call %v should time out, got %v", i, err)
+		}
+	}
+}
+
+func TestSkipReason(t *testing.T) {
+	cases := []struct {
+		err  error
+		code string
+	}{
+		{context.DeadlineExceeded, SKIP_TIMEOUT},
+		{context.Canceled, SKIP_CANCELLED},
+		{&RateLimitError{RetryAfter: time.Minute}, ERROR_RATE_LIMITED},
+		{strava.Error{Message: "Record Not Found"}, ERROR_UPSTREAM},
+	}
+	for _, c := range cases {
+		skipped := skipReason(42, c.err)
+		if skipped.ActivityId != 42 || skipped.Code != c.code || skipped.Reason == "" {
+			t.Errorf("%v: unexpected %+v", c.err, skipped)
+		}
+	}
+}
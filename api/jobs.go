@@ -0,0 +1,468 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"golang.org/x/net/context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// checkpoint is persisted after this many activities are processed
+var checkpointInterval = 20
+
+// how many times retrieval of single activity waits for rate limit window
+var jobRateLimitPauses = 3
+
+// longer rate limit waits, e.g. for daily limit, skip activity instead
+var jobMaxPause = rateLimitWindow + time.Minute
+
+// states of background job
+const (
+	JOB_NONE    = "none"
+	JOB_RUNNING = "running"
+	JOB_DONE    = "done"
+	JOB_FAILED  = "failed"
+	// checkpoint says job is running, but it is not, e.g. after restart
+	JOB_INTERRUPTED = "interrupted"
+)
+
+// JobStatus is progress of background retrieval of activity details.
+type JobStatus struct {
+	State string `json:"state"`
+	Total int    `json:"total"`
+	// activities retrieved or skipped
+	Processed int               `json:"processed"`
+	Skipped   []SkippedActivity `json:"skipped"`
+	StartedAt time.Time         `json:"started_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	Error     string            `json:"error,omitempty"`
+}
+
+func jobStatusOf(state *cache.HydrationState) JobStatus {
+	skipped := make([]SkippedActivity, 0, len(state.Skipped))
+	for _, skip := range state.Skipped {
+		skipped = append(skipped, SkippedActivity{skip.ActivityId, skip.Code, skip.Reason})
+	}
+	return JobStatus{
+		State:     state.State,
+		Total:     state.Total,
+		Processed: len(state.Processed) + len(state.Skipped),
+		Skipped:   skipped,
+		StartedAt: state.StartedAt,
+		UpdatedAt: state.UpdatedAt,
+		Error:     state.Error,
+	}
+}
+
+// hydrationJob retrieves details of all athlete activities in background, so
+// they are cached before being requested
+type hydrationJob struct {
+	athleteId int64
+	mutex     sync.Mutex
+	state     cache.HydrationState
+	// subscribers get latest status, older unread one is replaced
+	subscribers map[chan JobStatus]bool
+	// number of processed activities and state in last persisted checkpoint
+	persisted      int
+	persistedState string
+	persistMutex   sync.Mutex
+	done           chan struct{}
+}
+
+func newHydrationJob(athleteId int64) *hydrationJob {
+	return &hydrationJob{
+		athleteId:   athleteId,
+		state:       cache.HydrationState{State: JOB_RUNNING, StartedAt: time.Now(), UpdatedAt: time.Now()},
+		subscribers: make(map[chan JobStatus]bool),
+		done:        make(chan struct{}),
+	}
+}
+
+func (j *hydrationJob) status() JobStatus {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return jobStatusOf(&j.state)
+}
+
+// subscribe returns channel receiving status on every change, starting with
+// current one
+func (j *hydrationJob) subscribe() (<-chan JobStatus, func()) {
+	updates := make(chan JobStatus, 1)
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	updates <- jobStatusOf(&j.state)
+	j.subscribers[updates] = true
+	return updates, func() {
+		j.mutex.Lock()
+		defer j.mutex.Unlock()
+		delete(j.subscribers, updates)
+	}
+}
+
+// update changes state and notifies subscribers, returns copy of new state
+func (j *hydrationJob) update(fn func(state *cache.HydrationState)) cache.HydrationState {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	fn(&j.state)
+	j.state.UpdatedAt = time.Now()
+	status := jobStatusOf(&j.state)
+	for updates := range j.subscribers {
+		// only sender is holding mutex, so drained channel has room
+		select {
+		case <-updates:
+		default:
+		}
+		updates <- status
+	}
+	snapshot := j.state
+	snapshot.Processed = append([]int64(nil), j.state.Processed...)
+	snapshot.Skipped = append([]cache.HydrationSkip(nil), j.state.Skipped...)
+	return snapshot
+}
+
+// persist stores checkpoint unless newer one was stored already
+func (j *hydrationJob) persist(ctx context.Context, c cache.ActivityCache, state cache.HydrationState) {
+	j.persistMutex.Lock()
+	defer j.persistMutex.Unlock()
+	processed := len(state.Processed) + len(state.Skipped)
+	if processed < j.persisted && state.State == JOB_RUNNING {
+		return
+	}
+	if err := c.StoreHydrationState(ctx, j.athleteId, &state); err != nil {
+		warningf(ctx, "Failed to store hydration checkpoint of athlete %v: %v", j.athleteId, err)
+		return
+	}
+	j.persisted = processed
+	j.persistedState = state.State
+}
+
+// finished tells whether job finished and its final state is persisted
+func (j *hydrationJob) finished() bool {
+	j.persistMutex.Lock()
+	defer j.persistMutex.Unlock()
+	return j.persistedState == JOB_DONE || j.persistedState == JOB_FAILED
+}
+
+// jobRegistry keeps running hydration jobs, finished ones are reported by
+// their checkpoint
+type jobRegistry struct {
+	mutex sync.Mutex
+	jobs  map[int64]*hydrationJob
+}
+
+func (r *jobRegistry) get(athleteId int64) *hydrationJob {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.jobs[athleteId]
+}
+
+// start runs job for athlete unless one is running already, returns running job
+func (r *jobRegistry) start(athleteId int64, run func(job *hydrationJob)) *hydrationJob {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.jobs == nil {
+		r.jobs = make(map[int64]*hydrationJob)
+	}
+	if job, ok := r.jobs[athleteId]; ok {
+		select {
+		case <-job.done:
+		default:
+			return job
+		}
+	}
+	job := newHydrationJob(athleteId)
+	r.jobs[athleteId] = job
+	go func() {
+		defer close(job.done)
+		run(job)
+		r.evict(job)
+	}()
+	return job
+}
+
+// evict forgets job whose final state is persisted, job which failed to
+// persist it stays to report its status
+func (r *jobRegistry) evict(job *hydrationJob) {
+	if !job.finished() {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.jobs[job.athleteId] == job {
+		delete(r.jobs, job.athleteId)
+	}
+}
+
+// startHydration starts retrieval of details of athlete activities in
+// background, unless job is running or finished job left nothing to
+// retrieve. Job runs on its own context, takes current token of session for
+// every request and resumes from checkpoint left by previous job.
+func (api *AnalysisApi) startHydration(ctx context.Context, auth *requestAuth) (JobStatus, error) {
+	status, err := api.hydrationStatus(ctx, auth.AthleteId)
+	if err != nil || status.State == JOB_RUNNING {
+		return status, err
+	}
+	if status.State == JOB_DONE {
+		if pending, err := api.hydrationPending(ctx, auth); err != nil || !pending {
+			return status, err
+		}
+	}
+	athleteId, sessionId := auth.AthleteId, auth.SessionId
+	job := api.jobs.start(athleteId, func(job *hydrationJob) {
+		jobCtx, cancel := context.WithCancel(api.backgroundContext())
+		defer cancel()
+		defer func() {
+			if p := recover(); p != nil {
+				api.finishHydration(jobCtx, job, fmt.Errorf("recovered: %v", p))
+			}
+		}()
+		token, err := api.sessionToken(jobCtx, sessionId)
+		if err != nil {
+			api.finishHydration(jobCtx, job, err)
+			return
+		}
+		activities, err := api.retrieveActivities(jobCtx, token, athleteId)
+		if err != nil {
+			api.finishHydration(jobCtx, job, err)
+			return
+		}
+		// entries cached before power zones were kept are upgraded as well
+		withPower := make(map[int64]bool)
+		for _, activity := range activities {
+			withPower[activity.Id] = needsZoneUpgrade(activity, []string{cache.ZONES_POWER})
+		}
+		api.runHydration(jobCtx, job, activities, func(ctx context.Context, activityId int64) error {
+			// rate limit pauses may outlive token
+			token, err := api.sessionToken(ctx, sessionId)
+			if err != nil {
+				return err
+			}
+			_, err = api.retrieveActivity(ctx, token, athleteId, activityId, withPower[activityId])
+			return err
+		})
+	})
+	return job.status(), nil
+}
+
+// hydrationPending tells whether finished job skipped some activities, or
+// activities were added after it finished
+func (api *AnalysisApi) hydrationPending(ctx context.Context, auth *requestAuth) (bool, error) {
+	checkpoint, err := api.Params.ActivityCacheAccessor(ctx).GetHydrationState(ctx, auth.AthleteId)
+	if cache.IsNotFound(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	if len(checkpoint.Skipped) > 0 {
+		return true, nil
+	}
+	activities, err := api.retrieveActivities(ctx, auth.Token, auth.AthleteId)
+	if err != nil {
+		return false, err
+	}
+	retrieved := make(map[int64]bool)
+	for _, id := range checkpoint.Processed {
+		retrieved[id] = true
+	}
+	for _, activity := range activities {
+		if !activity.Private && !retrieved[activity.Id] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (api *AnalysisApi) finishHydration(ctx context.Context, job *hydrationJob, err error) {
+	errorf(ctx, "Hydration of athlete %v failed: %v", job.athleteId, err)
+	state := job.update(func(state *cache.HydrationState) {
+		state.State = JOB_FAILED
+		state.Error = classifyError(err).message
+	})
+	job.persist(ctx, api.Params.ActivityCacheAccessor(ctx), state)
+}
+
+// runHydration fetches public activities which are not retrieved according
+// to checkpoint, activities skipped previously and ones added after finished
+// job are fetched
+func (api *AnalysisApi) runHydration(ctx context.Context, job *hydrationJob, activities cache.ActivityList, fetch func(ctx context.Context, activityId int64) error) {
+	cacheClient := api.Params.ActivityCacheAccessor(ctx)
+	retrieved := make(map[int64]bool)
+	checkpoint, err := cacheClient.GetHydrationState(ctx, job.athleteId)
+	if err == nil {
+		for _, id := range checkpoint.Processed {
+			retrieved[id] = true
+		}
+	} else if err != nil && !cache.IsNotFound(err) {
+		warningf(ctx, "Failed to load hydration checkpoint of athlete %v, starting over: %v", job.athleteId, err)
+	}
+
+	processed := make([]int64, 0, len(activities))
+	pending := make([]int64, 0, len(activities))
+	for _, activity := range activities {
+		if activity.Private {
+			continue
+		}
+		if retrieved[activity.Id] {
+			processed = append(processed, activity.Id)
+		} else {
+			pending = append(pending, activity.Id)
+		}
+	}
+	if len(processed) > 0 {
+		infof(ctx, "Resuming hydration of athlete %v, %v activities retrieved already", job.athleteId, len(processed))
+	}
+	state := job.update(func(state *cache.HydrationState) {
+		state.Total = len(processed) + len(pending)
+		state.Processed = processed
+	})
+	job.persist(ctx, cacheClient, state)
+
+	// rate limit pauses count into deadline of request, so deadline is per attempt
+	forEachConcurrently(ctx, len(pending), hydrationWorkers, 0, func(ctx context.Context, i int) error {
+		err := fetchPatiently(ctx, pending[i], fetch)
+		state := job.update(func(state *cache.HydrationState) {
+			if err == nil {
+				state.Processed = append(state.Processed, pending[i])
+			} else {
+				skipped := skipReason(pending[i], err)
+				state.Skipped = append(state.Skipped, cache.HydrationSkip{ActivityId: skipped.ActivityId, Code: skipped.Code, Reason: skipped.Reason})
+			}
+		})
+		if (len(state.Processed)+len(state.Skipped))%checkpointInterval == 0 {
+			job.persist(ctx, cacheClient, state)
+		}
+		return err
+	})
+
+	state = job.update(func(state *cache.HydrationState) {
+		state.State = JOB_DONE
+	})
+	job.persist(ctx, cacheClient, state)
+	infof(ctx, "Hydration of athlete %v done, %v of %v activities skipped", job.athleteId, len(state.Skipped), state.Total)
+}
+
+// fetchPatiently waits for next rate limit window instead of skipping activity
+func fetchPatiently(ctx context.Context, activityId int64, fetch func(ctx context.Context, activityId int64) error) error {
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, activityDeadline)
+		err := fetch(attemptCtx, activityId)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		apiErr := classifyError(err)
+		if apiErr.code != ERROR_RATE_LIMITED || attempt >= jobRateLimitPauses || apiErr.retryAfter > jobMaxPause {
+			return err
+		}
+		timer := time.NewTimer(apiErr.retryAfter)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// hydrationStatus returns status of running or finished job, or of
+// checkpoint left by previous process
+func (api *AnalysisApi) hydrationStatus(ctx context.Context, athleteId int64) (JobStatus, error) {
+	if job := api.jobs.get(athleteId); job != nil {
+		return job.status(), nil
+	}
+	checkpoint, err := api.Params.ActivityCacheAccessor(ctx).GetHydrationState(ctx, athleteId)
+	if cache.IsNotFound(err) {
+		return JobStatus{State: JOB_NONE, Skipped: []SkippedActivity{}}, nil
+	} else if err != nil {
+		return JobStatus{}, err
+	}
+	status := jobStatusOf(checkpoint)
+	if status.State == JOB_RUNNING {
+		status.State = JOB_INTERRUPTED
+	}
+	return status, nil
+}
+
+// getHydration reports job status on GET and starts job on POST
+func (api *AnalysisApi) getHydration(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	auth := authFromContext(ctx)
+	switch r.Method {
+	case "GET":
+		status, err := api.hydrationStatus(ctx, auth.AthleteId)
+		if err != nil {
+			return err
+		}
+		writeJson(w, http.StatusOK, status)
+	case "POST":
+		status, err := api.startHydration(ctx, auth)
+		if err != nil {
+			return err
+		}
+		if status.State == JOB_DONE {
+			writeJson(w, http.StatusOK, status)
+		} else {
+			writeJson(w, http.StatusAccepted, status)
+		}
+	default:
+		return &apiError{status: http.StatusMethodNotAllowed, code: ERROR_BAD_REQUEST, message: "Unsupported method " + r.Method}
+	}
+	return nil
+}
+
+// getHydrationEvents streams job status as Server-Sent Events until job
+// finishes or client disconnects
+func (api *AnalysisApi) getHydrationEvents(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return internalError(errors.New("response streaming is not supported"))
+	}
+	auth := authFromContext(ctx)
+	job := api.jobs.get(auth.AthleteId)
+	var updates <-chan JobStatus
+	if job != nil {
+		var unsubscribe func()
+		updates, unsubscribe = job.subscribe()
+		defer unsubscribe()
+	} else {
+		// nothing runs, so stored status is the only event
+		status, err := api.hydrationStatus(ctx, auth.AthleteId)
+		if err != nil {
+			return err
+		}
+		single := make(chan JobStatus, 1)
+		single <- status
+		updates = single
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for {
+		select {
+		case status := <-updates:
+			if err := writeEvent(w, "status", status); err != nil {
+				debugf(ctx, "Hydration events of athlete %v stopped: %v", auth.AthleteId, err)
+				return nil
+			}
+			flusher.Flush()
+			if status.State != JOB_RUNNING {
+				return nil
+			}
+		case <-r.Context().Done():
+			return nil
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
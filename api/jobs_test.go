@@ -0,0 +1,243 @@
+package api
+
+import (
+	"errors"
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newJobTestApi(c cache.ActivityCache) *AnalysisApi {
+	return NewApi(Params{
+		ActivityCacheAccessor: func(ctx context.Context) cache.ActivityCache { return c },
+	})
+}
+
+func TestRunHydrationResumesFromCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewMapActivityCache()
+	c.StoreHydrationState(ctx, 1, &cache.HydrationState{
+		State:     JOB_RUNNING,
+		Processed: []int64{10},
+		Skipped:   []cache.HydrationSkip{{ActivityId: 20, Code: SKIP_TIMEOUT}},
+	})
+	private := activityAt(30, "private", 3)
+	private.Private = true
+	activities := cache.ActivityList{activityAt(10, "done", 1), activityAt(20, "skipped", 2), private, activityAt(40, "new", 4)}
+
+	api := newJobTestApi(c)
+	job := newHydrationJob(1)
+	var mutex sync.Mutex
+	fetched := make(map[int64]bool)
+	api.runHydration(ctx, job, activities, func(ctx context.Context, activityId int64) error {
+		mutex.Lock()
+		fetched[activityId] = true
+		mutex.Unlock()
+		if activityId == 40 {
+			return errors.New("broken")
+		}
+		return nil
+	})
+
+	if len(fetched) != 2 || !fetched[20] || !fetched[40] {
+		t.Errorf("Expected only skipped and new activities to be fetched, got %v", fetched)
+	}
+	status := job.status()
+	if status.State != JOB_DONE || status.Total != 3 || status.Processed != 3 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	if len(status.Skipped) != 1 || status.Skipped[0].ActivityId != 40 || status.Skipped[0].Code != ERROR_INTERNAL {
+		t.Errorf("Expected failed activity to be skipped, got %+v", status.Skipped)
+	}
+	checkpoint, err := c.GetHydrationState(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.State != JOB_DONE || len(checkpoint.Processed) != 2 || len(checkpoint.Skipped) != 1 {
+		t.Errorf("Unexpected checkpoint %+v", checkpoint)
+	}
+}
+
+func TestFetchPatientlyWaitsForRateLimit(t *testing.T) {
+	calls := 0
+	err := fetchPatiently(context.Background(), 1, func(ctx context.Context, activityId int64) error {
+		calls++
+		if calls == 1 {
+			return &RateLimitError{RetryAfter: time.Millisecond}
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("Expected retry after rate limit pause, got %v after %v calls", err, calls)
+	}
+
+	calls = 0
+	err = fetchPatiently(context.Background(), 1, func(ctx context.Context, activityId int64) error {
+		calls++
+		return &RateLimitError{RetryAfter: 24 * time.Hour, Daily: true}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("Daily limit should not be waited for, got %v after %v calls", err, calls)
+	}
+}
+
+func TestHydrationStatusWithoutJob(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewMapActivityCache()
+	api := newJobTestApi(c)
+	if status, err := api.hydrationStatus(ctx, 1); err != nil || status.State != JOB_NONE {
+		t.Errorf("Expected no job, got %+v, %v", status, err)
+	}
+	c.StoreHydrationState(ctx, 1, &cache.HydrationState{State: JOB_RUNNING, Total: 5, Processed: []int64{1, 2}})
+	status, err := api.hydrationStatus(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != JOB_INTERRUPTED || status.Total != 5 || status.Processed != 2 {
+		t.Errorf("Checkpoint of stopped job should be interrupted, got %+v", status)
+	}
+}
+
+func TestHydrationEventsStreamUntilDone(t *testing.T) {
+	api := newJobTestApi(cache.NewMapActivityCache())
+	release := make(chan struct{})
+	api.jobs.start(1, func(job *hydrationJob) {
+		job.update(func(state *cache.HydrationState) { state.Total = 2 })
+		<-release
+		job.update(func(state *cache.HydrationState) {
+			state.Processed = []int64{1, 2}
+			state.State = JOB_DONE
+		})
+	})
+
+	ctx := context.WithValue(context.Background(), authContextKey, &requestAuth{AthleteId: 1})
+	request := httptest.NewRequest("GET", "/jobs/hydrate/events", nil)
+	recorder := httptest.NewRecorder()
+	finished := make(chan error)
+	go func() {
+		finished <- api.getHydrationEvents(ctx, recorder, request)
+	}()
+	close(release)
+	select {
+	case err := <-finished:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event stream did not end after job finished")
+	}
+
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Unexpected response %v %v", recorder.Code, recorder.Header())
+	}
+	body := recorder.Body.String()
+	if !strings.HasPrefix(body, "event: status\ndata: {") || !strings.HasSuffix(body, "\n\n") {
+		t.Errorf("Malformed event stream %q", body)
+	}
+	if !strings.Contains(body, `"state":"done","total":2,"processed":2`) {
+		t.Errorf("Last event should report finished job, got %q", body)
+	}
+}
+
+func TestStartHydrationRestartsFinishedJobWithPendingActivities(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewMapActivityCache()
+	api := NewApi(Params{
+		ActivityCacheAccessor: func(ctx context.Context) cache.ActivityCache { return c },
+		SessionStoreAccessor:  func(ctx context.Context) SessionStore { return NewMemorySessionStore() },
+	})
+	c.Store(ctx, 1, cache.ActivityList{activityAt(10, "done", 1), activityAt(20, "done", 2)})
+	c.StoreHydrationState(ctx, 1, &cache.HydrationState{State: JOB_DONE, Total: 2, Processed: []int64{10, 20}})
+	auth := &requestAuth{AthleteId: 1, SessionId: "gone", Token: "token"}
+	status, err := api.startHydration(ctx, auth)
+	if err != nil || status.State != JOB_DONE || status.Processed != 2 {
+		t.Errorf("Finished job should be reported, got %+v, %v", status, err)
+	}
+	if api.jobs.get(1) != nil {
+		t.Error("Finished job without pending activities should not be started again")
+	}
+
+	c.Store(ctx, 1, cache.ActivityList{activityAt(10, "done", 1), activityAt(20, "done", 2), activityAt(30, "new", 3)})
+	if status, err := api.startHydration(ctx, auth); err != nil || status.State != JOB_RUNNING {
+		t.Errorf("Job should be started for new activity, got %+v, %v", status, err)
+	}
+	waitJobEvicted(t, api, 1)
+
+	c.StoreHydrationState(ctx, 1, &cache.HydrationState{
+		State:     JOB_DONE,
+		Total:     3,
+		Processed: []int64{10, 20, 30},
+		Skipped:   []cache.HydrationSkip{{ActivityId: 20, Code: SKIP_TIMEOUT}},
+	})
+	if status, err := api.startHydration(ctx, auth); err != nil || status.State != JOB_RUNNING {
+		t.Errorf("Job should be started for skipped activity, got %+v, %v", status, err)
+	}
+	waitJobEvicted(t, api, 1)
+	// session is gone, so job fails taking token for its first request
+	if status, err := api.hydrationStatus(ctx, 1); err != nil || status.State != JOB_FAILED {
+		t.Errorf("Status of evicted job should come from checkpoint, got %+v, %v", status, err)
+	}
+}
+
+func waitJobEvicted(t *testing.T, api *AnalysisApi, athleteId int64) {
+	for i := 0; i < 100 && api.jobs.get(athleteId) != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if api.jobs.get(athleteId) != nil {
+		t.Fatal("Finished job should be evicted")
+	}
+}
+
+func TestJobRegistryEvictsPersistedJobs(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewMapActivityCache()
+	var registry jobRegistry
+	done := registry.start(1, func(job *hydrationJob) {
+		job.persist(ctx, c, job.update(func(state *cache.HydrationState) { state.State = JOB_DONE }))
+	})
+	<-done.done
+	if registry.get(1) != nil {
+		t.Error("Persisted finished job should be evicted")
+	}
+
+	unpersisted := registry.start(2, func(job *hydrationJob) {
+		job.update(func(state *cache.HydrationState) { state.State = JOB_FAILED })
+	})
+	<-unpersisted.done
+	if registry.get(2) != unpersisted {
+		t.Error("Job which did not persist its state should be kept")
+	}
+	restarted := registry.start(2, func(job *hydrationJob) {})
+	if restarted == unpersisted {
+		t.Error("Finished job should be started again")
+	}
+	<-restarted.done
+
+	release := make(chan struct{})
+	running := registry.start(3, func(job *hydrationJob) { <-release })
+	if registry.start(3, func(job *hydrationJob) { t.Error("Running job should not be started twice") }) != running {
+		t.Error("Running job should be returned")
+	}
+	close(release)
+	<-running.done
+}
+
+func TestRunHydrationResumesFinishedJob(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewMapActivityCache()
+	c.StoreHydrationState(ctx, 1, &cache.HydrationState{State: JOB_DONE, Processed: []int64{10}})
+	api := newJobTestApi(c)
+	var fetched []int64
+	api.runHydration(ctx, newHydrationJob(1), cache.ActivityList{activityAt(10, "done", 1), activityAt(20, "new", 2)}, func(ctx context.Context, activityId int64) error {
+		fetched = append(fetched, activityId)
+		return nil
+	})
+	if len(fetched) != 1 || fetched[0] != 20 {
+		t.Errorf("Only activity added after finished job should be fetched, got %v", fetched)
+	}
+}
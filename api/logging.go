@@ -0,0 +1,15 @@
+package api
+
+import (
+	"google.golang.org/appengine/log"
+)
+
+// logging requires App Engine context, replaced in tests which run handlers
+// outside of App Engine
+var (
+	debugf    = log.Debugf
+	infof     = log.Infof
+	warningf  = log.Warningf
+	errorf    = log.Errorf
+	criticalf = log.Criticalf
+)
@@ -0,0 +1,18 @@
+package api
+
+import (
+	"golang.org/x/net/context"
+	"log"
+)
+
+func init() {
+	// App Engine logging requires App Engine context
+	stdLogf := func(ctx context.Context, format string, args ...interface{}) {
+		log.Printf(format, args...)
+	}
+	debugf = func(ctx context.Context, format string, args ...interface{}) {}
+	infof = stdLogf
+	warningf = stdLogf
+	errorf = stdLogf
+	criticalf = stdLogf
+}
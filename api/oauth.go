@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/strava/go.strava"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// go.strava exchanges authorization code itself, but drops refresh token and
+// expiration time, so token endpoint is called directly
+var oauthTokenUrl = "https://www.strava.com/oauth/token"
+
+// token is refreshed when it expires sooner than this
+var tokenRefreshMargin = 5 * time.Minute
+
+// OAuthToken is Strava access token with means to renew it.
+type OAuthToken struct {
+	AccessToken  string    `datastore:",noindex"`
+	RefreshToken string    `datastore:",noindex"`
+	ExpiresAt    time.Time `datastore:",noindex"`
+}
+
+// ExpiresSoon tells whether token should be refreshed before use.
+func (t *OAuthToken) ExpiresSoon(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && now.Add(tokenRefreshMargin).After(t.ExpiresAt)
+}
+
+// Expired tells whether token can not be used anymore.
+func (t *OAuthToken) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+type tokenResponse struct {
+	AccessToken  string                  `json:"access_token"`
+	RefreshToken string                  `json:"refresh_token"`
+	ExpiresAt    int64                   `json:"expires_at"`
+	Athlete      *strava.AthleteDetailed `json:"athlete"`
+}
+
+// tokenError is failure reported by token endpoint
+type tokenError struct {
+	status int
+	body   string
+}
+
+func (e *tokenError) Error() string {
+	return fmt.Sprintf("token endpoint returned %v: %v", e.status, e.body)
+}
+
+// rejected tells whether request can not succeed on retry, as opposed to
+// Strava outage
+func (e *tokenError) rejected() bool {
+	return e.status/100 == 4
+}
+
+func requestToken(httpClient *http.Client, clientId int, clientSecret string, form url.Values) (*tokenResponse, error) {
+	form.Set("client_id", strconv.Itoa(clientId))
+	form.Set("client_secret", clientSecret)
+	resp, err := httpClient.PostForm(oauthTokenUrl, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &tokenError{resp.StatusCode, string(body)}
+	}
+	var response tokenResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	if response.AccessToken == "" {
+		return nil, fmt.Errorf("token endpoint returned no access token")
+	}
+	return &response, nil
+}
+
+func (r *tokenResponse) token() *OAuthToken {
+	token := &OAuthToken{AccessToken: r.AccessToken, RefreshToken: r.RefreshToken}
+	if r.ExpiresAt != 0 {
+		token.ExpiresAt = time.Unix(r.ExpiresAt, 0).UTC()
+	}
+	return token
+}
+
+// exchangeCode trades authorization code from OAuth callback for token
+func exchangeCode(httpClient *http.Client, clientId int, clientSecret string, code string) (*OAuthToken, *strava.AthleteDetailed, error) {
+	response, err := requestToken(httpClient, clientId, clientSecret, url.Values{
+		"code":       {code},
+		"grant_type": {"authorization_code"},
+	})
+	if err != nil {
+		if tokenErr, ok := err.(*tokenError); ok {
+			if tokenErr.status == http.StatusUnauthorized {
+				return nil, nil, strava.OAuthInvalidCredentialsErr
+			} else if tokenErr.rejected() {
+				return nil, nil, strava.OAuthInvalidCodeErr
+			}
+			return nil, nil, strava.OAuthServerErr
+		}
+		return nil, nil, err
+	}
+	if response.Athlete == nil {
+		return nil, nil, fmt.Errorf("token endpoint returned no athlete")
+	}
+	return response.token(), response.Athlete, nil
+}
+
+// refreshToken obtains new access token, Strava may rotate refresh token too
+func refreshToken(httpClient *http.Client, clientId int, clientSecret string, token *OAuthToken) (*OAuthToken, error) {
+	response, err := requestToken(httpClient, clientId, clientSecret, url.Values{
+		"refresh_token": {token.RefreshToken},
+		"grant_type":    {"refresh_token"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	refreshed := response.token()
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = token.RefreshToken
+	}
+	return refreshed, nil
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// tokenServer serves token endpoint with given handler until stopped
+func tokenServer(handler http.HandlerFunc) (stop func()) {
+	server := httptest.NewServer(handler)
+	previous := oauthTokenUrl
+	oauthTokenUrl = server.URL
+	return func() {
+		oauthTokenUrl = previous
+		server.Close()
+	}
+}
+
+func TestExchangeCode(t *testing.T) {
+	defer tokenServer(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "secret-code" || r.Form.Get("grant_type") != "authorization_code" || r.Form.Get("client_id") != "7" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"a1","refresh_token":"r1","expires_at":1500000000,"athlete":{"id":42,"firstname":"Eddy"}}`)
+	})()
+	token, athlete, err := exchangeCode(http.DefaultClient, 7, "secret", "secret-code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "a1" || token.RefreshToken != "r1" || !token.ExpiresAt.Equal(time.Unix(1500000000, 0)) {
+		t.Errorf("Unexpected token %+v", token)
+	}
+	if athlete.Id != 42 || athlete.FirstName != "Eddy" {
+		t.Errorf("Unexpected athlete %+v", athlete)
+	}
+	if _, _, err := exchangeCode(http.DefaultClient, 7, "secret", "wrong-code"); err == nil {
+		t.Error("Rejected code should fail exchange")
+	}
+}
+
+func TestRefreshTokenKeepsRefreshToken(t *testing.T) {
+	defer tokenServer(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token":"a2","expires_at":1500000000}`)
+	})()
+	refreshed, err := refreshToken(http.DefaultClient, 7, "secret", &OAuthToken{AccessToken: "a1", RefreshToken: "r1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.AccessToken != "a2" || refreshed.RefreshToken != "r1" {
+		t.Errorf("Unexpected token %+v", refreshed)
+	}
+}
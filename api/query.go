@@ -0,0 +1,235 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"github.com/strava/go.strava"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sort orders of activity list, by start date
+const (
+	ORDER_DESC = "desc"
+	ORDER_ASC  = "asc"
+)
+
+// ActivityQuery selects page of athlete activities, zero fields match any
+// activity.
+type ActivityQuery struct {
+	// sport types, e.g. Ride or Run
+	Types []strava.ActivityType
+	// activities started at or after After and before Before
+	After  time.Time
+	Before time.Time
+	GearId string
+	// flag filters, nil matches both values
+	Trainer *bool
+	Manual  *bool
+	Commute *bool
+	Private *bool
+	Order   string
+	// page size, zero returns all matching activities
+	Limit int
+	// position after last activity of previous page
+	Cursor *activityCursor
+}
+
+// ActivitiesResponse is page of activities, NextCursor is empty on last page.
+type ActivitiesResponse struct {
+	Activities cache.ActivityList `json:"activities"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+}
+
+// activityCursor points to activity by its sort key, so pages stay
+// consistent when activities are added between requests
+type activityCursor struct {
+	StartDate time.Time
+	Id        int64
+}
+
+func (c *activityCursor) String() string {
+	raw := fmt.Sprintf("%d:%d", c.StartDate.UnixNano(), c.Id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseCursor(value string) (*activityCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &activityCursor{time.Unix(0, nanos).UTC(), id}, nil
+}
+
+func cursorOf(activity *strava.ActivitySummary) *activityCursor {
+	return &activityCursor{activity.StartDate, activity.Id}
+}
+
+// before tells whether activity a goes before b in ascending order
+func (a *activityCursor) before(b *activityCursor) bool {
+	if !a.StartDate.Equal(b.StartDate) {
+		return a.StartDate.Before(b.StartDate)
+	}
+	return a.Id < b.Id
+}
+
+// parseTime accepts RFC 3339 timestamp or date, which is midnight UTC
+func parseTime(value string) (time.Time, error) {
+	// offset sign left unescaped in query string is decoded as space
+	value = strings.Replace(value, " ", "+", -1)
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func parseFlag(query url.Values, name string) (*bool, error) {
+	value := query.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	flag, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, badRequest(fmt.Sprintf("Invalid %s value %q, expected true or false", name, value))
+	}
+	return &flag, nil
+}
+
+// parseActivityQuery reads query from request parameters, types may be
+// repeated or comma separated
+func parseActivityQuery(query url.Values) (*ActivityQuery, error) {
+	q := &ActivityQuery{GearId: query.Get("gear"), Order: ORDER_DESC}
+	for _, value := range query["type"] {
+		for _, activityType := range strings.Split(value, ",") {
+			if activityType = strings.TrimSpace(activityType); activityType != "" {
+				q.Types = append(q.Types, strava.ActivityType(activityType))
+			}
+		}
+	}
+	var err error
+	if value := query.Get("after"); value != "" {
+		if q.After, err = parseTime(value); err != nil {
+			return nil, badRequest(fmt.Sprintf("Invalid after value %q, expected date or RFC 3339 time", value))
+		}
+	}
+	if value := query.Get("before"); value != "" {
+		if q.Before, err = parseTime(value); err != nil {
+			return nil, badRequest(fmt.Sprintf("Invalid before value %q, expected date or RFC 3339 time", value))
+		}
+	}
+	if q.Trainer, err = parseFlag(query, "trainer"); err != nil {
+		return nil, err
+	}
+	if q.Manual, err = parseFlag(query, "manual"); err != nil {
+		return nil, err
+	}
+	if q.Commute, err = parseFlag(query, "commute"); err != nil {
+		return nil, err
+	}
+	if q.Private, err = parseFlag(query, "private"); err != nil {
+		return nil, err
+	}
+	if value := query.Get("order"); value != "" {
+		if value != ORDER_ASC && value != ORDER_DESC {
+			return nil, badRequest(fmt.Sprintf("Invalid order value %q, expected asc or desc", value))
+		}
+		q.Order = value
+	}
+	if value := query.Get("limit"); value != "" {
+		if q.Limit, err = strconv.Atoi(value); err != nil || q.Limit <= 0 {
+			return nil, badRequest(fmt.Sprintf("Invalid limit value %q, expected positive number", value))
+		}
+	}
+	if value := query.Get("cursor"); value != "" {
+		if q.Cursor, err = parseCursor(value); err != nil {
+			return nil, badRequest("Invalid cursor")
+		}
+	}
+	return q, nil
+}
+
+func flagMatches(filter *bool, value bool) bool {
+	return filter == nil || *filter == value
+}
+
+// Matches tells whether activity passes query filters.
+func (q *ActivityQuery) Matches(activity *strava.ActivitySummary) bool {
+	if len(q.Types) > 0 {
+		found := false
+		for _, activityType := range q.Types {
+			if activity.Type == activityType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !q.After.IsZero() && activity.StartDate.Before(q.After) {
+		return false
+	}
+	if !q.Before.IsZero() && !activity.StartDate.Before(q.Before) {
+		return false
+	}
+	if q.GearId != "" && activity.GearId != q.GearId {
+		return false
+	}
+	return flagMatches(q.Trainer, activity.Trainer) &&
+		flagMatches(q.Manual, activity.Manual) &&
+		flagMatches(q.Commute, activity.Commute) &&
+		flagMatches(q.Private, activity.Private)
+}
+
+// Paged tells whether query asks for page, rather than all activities.
+func (q *ActivityQuery) Paged() bool {
+	return q.Limit > 0 || q.Cursor != nil
+}
+
+// Apply returns page of matching activities in query order.
+func (q *ActivityQuery) Apply(activities cache.ActivityList) ActivitiesResponse {
+	matching := make(cache.ActivityList, 0)
+	for _, activity := range activities {
+		if activity != nil && q.Matches(activity) {
+			matching = append(matching, activity)
+		}
+	}
+	ascending := q.Order == ORDER_ASC
+	sort.SliceStable(matching, func(i, j int) bool {
+		if ascending {
+			return cursorOf(matching[i]).before(cursorOf(matching[j]))
+		}
+		return cursorOf(matching[j]).before(cursorOf(matching[i]))
+	})
+	if q.Cursor != nil {
+		start := sort.Search(len(matching), func(i int) bool {
+			if ascending {
+				return q.Cursor.before(cursorOf(matching[i]))
+			}
+			return cursorOf(matching[i]).before(q.Cursor)
+		})
+		matching = matching[start:]
+	}
+	response := ActivitiesResponse{Activities: matching}
+	if q.Limit > 0 && len(matching) > q.Limit {
+		response.Activities = matching[:q.Limit]
+		response.NextCursor = cursorOf(matching[q.Limit-1]).String()
+	}
+	return response
+}
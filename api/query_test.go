@@ -0,0 +1,145 @@
+package api
+
+import (
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func activityIds(activities cache.ActivityList) []int64 {
+	ids := make([]int64, 0, len(activities))
+	for _, activity := range activities {
+		ids = append(ids, activity.Id)
+	}
+	return ids
+}
+
+func queryActivities() cache.ActivityList {
+	ride := activityAt(1, "ride", 1)
+	ride.Type = "Ride"
+	ride.GearId = "b1"
+	trainer := activityAt(2, "trainer", 2)
+	trainer.Type = "Ride"
+	trainer.Trainer = true
+	run := activityAt(3, "run", 3)
+	run.Type = "Run"
+	commute := activityAt(4, "commute", 4)
+	commute.Type = "Ride"
+	commute.Commute = true
+	commute.GearId = "b1"
+	manual := activityAt(5, "manual", 5)
+	manual.Type = "Ride"
+	manual.Manual = true
+	manual.Private = true
+	return cache.ActivityList{manual, commute, run, trainer, ride}
+}
+
+func applyQuery(t *testing.T, rawQuery string) ActivitiesResponse {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := parseActivityQuery(values)
+	if err != nil {
+		t.Fatalf("%v: %v", rawQuery, err)
+	}
+	return query.Apply(queryActivities())
+}
+
+func TestActivityQueryFilters(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected []int64
+	}{
+		{"", []int64{5, 4, 3, 2, 1}},
+		{"type=Ride&trainer=false&manual=false", []int64{4, 1}},
+		{"type=Run,Ride&commute=true", []int64{4}},
+		{"type=Run&type=Walk", []int64{3}},
+		{"gear=b1", []int64{4, 1}},
+		{"private=true", []int64{5}},
+		{"after=2017-01-02&before=2017-01-04", []int64{3, 2}},
+		{"after=2017-01-03T10:00:00Z", []int64{5, 4, 3}},
+		{"after=2017-01-03T12:00:00%2B02:00", []int64{5, 4, 3}},
+		// unescaped offset sign
+		{"after=2017-01-03T12:00:00+02:00", []int64{5, 4, 3}},
+		{"order=asc&type=Ride", []int64{1, 2, 4, 5}},
+	}
+	for _, c := range cases {
+		response := applyQuery(t, c.query)
+		if actual := activityIds(response.Activities); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%q: expected %v, got %v", c.query, c.expected, actual)
+		}
+		if response.NextCursor != "" {
+			t.Errorf("%q: unexpected cursor without limit", c.query)
+		}
+	}
+}
+
+func TestActivityQueryPagination(t *testing.T) {
+	for _, order := range []string{"desc", "asc"} {
+		var seen []int64
+		cursor := ""
+		for page := 0; page < 5; page++ {
+			response := applyQuery(t, "limit=2&order="+order+"&cursor="+cursor)
+			seen = append(seen, activityIds(response.Activities)...)
+			cursor = response.NextCursor
+			if cursor == "" {
+				break
+			}
+		}
+		expected := []int64{5, 4, 3, 2, 1}
+		if order == "asc" {
+			expected = []int64{1, 2, 3, 4, 5}
+		}
+		if !reflect.DeepEqual(seen, expected) {
+			t.Errorf("%v: expected pages to cover %v, got %v", order, expected, seen)
+		}
+	}
+}
+
+func TestActivityQueryPaged(t *testing.T) {
+	cases := map[string]bool{
+		"type=Ride": false,
+		"limit=2":   true,
+		"cursor=" + cursorOf(activityAt(1, "first", 1)).String(): true,
+	}
+	for rawQuery, paged := range cases {
+		values, _ := url.ParseQuery(rawQuery)
+		query, err := parseActivityQuery(values)
+		if err != nil {
+			t.Fatalf("%q: %v", rawQuery, err)
+		}
+		if query.Paged() != paged {
+			t.Errorf("%q: expected paged %v", rawQuery, paged)
+		}
+	}
+}
+
+func TestActivityCursorSurvivesNewActivities(t *testing.T) {
+	query := &ActivityQuery{Order: ORDER_DESC, Limit: 2}
+	first := query.Apply(queryActivities())
+	cursor, err := parseCursor(first.NextCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cursor.StartDate.Equal(time.Date(2017, 1, 4, 10, 0, 0, 0, time.UTC)) || cursor.Id != 4 {
+		t.Errorf("Unexpected cursor %+v", cursor)
+	}
+	query.Cursor = cursor
+	activities := append(cache.ActivityList{activityAt(6, "new", 6)}, queryActivities()...)
+	if actual := activityIds(query.Apply(activities).Activities); !reflect.DeepEqual(actual, []int64{3, 2}) {
+		t.Errorf("New activity should not shift next page, got %v", actual)
+	}
+}
+
+func TestActivityQueryRejectsInvalidParameters(t *testing.T) {
+	for _, rawQuery := range []string{"trainer=maybe", "after=yesterday", "order=random", "limit=0", "limit=x", "cursor=%21%21"} {
+		values, _ := url.ParseQuery(rawQuery)
+		_, err := parseActivityQuery(values)
+		if apiErr, ok := err.(*apiError); !ok || apiErr.code != ERROR_BAD_REQUEST {
+			t.Errorf("%q: expected bad request, got %v", rawQuery, err)
+		}
+	}
+}
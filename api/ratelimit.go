@@ -0,0 +1,330 @@
+package api
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Strava counts requests in windows aligned to quarter of hour, and in days
+// starting at midnight UTC
+var rateLimitWindow = 15 * time.Minute
+
+// pacing starts when less than this fraction of short window budget is left
+var rateLimitPaceFraction = 0.2
+
+func untilNextWindow(now time.Time) time.Duration {
+	return now.Truncate(rateLimitWindow).Add(rateLimitWindow).Sub(now)
+}
+
+func untilNextDay(now time.Time) time.Duration {
+	now = now.UTC()
+	return now.Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now)
+}
+
+// RateLimitError is returned by transport instead of request which would
+// exceed Strava rate limit.
+type RateLimitError struct {
+	RetryAfter time.Duration
+	Daily      bool
+}
+
+func (e *RateLimitError) Error() string {
+	window := "15 minute"
+	if e.Daily {
+		window = "daily"
+	}
+	return fmt.Sprintf("Strava %v rate limit exhausted, retry after %v", window, e.RetryAfter)
+}
+
+// RateLimitBudget is Strava request budget known from recent responses.
+type RateLimitBudget struct {
+	// false until first response with rate limit headers
+	Known          bool      `json:"known"`
+	ShortLimit     int       `json:"short_limit"`
+	ShortRemaining int       `json:"short_remaining"`
+	ShortResetAt   time.Time `json:"short_reset_at"`
+	LongLimit      int       `json:"long_limit"`
+	LongRemaining  int       `json:"long_remaining"`
+	LongResetAt    time.Time `json:"long_reset_at"`
+}
+
+// RateLimits tracks Strava rate limit usage of the whole process, it is
+// shared by transports of all requests.
+type RateLimits struct {
+	mutex      sync.Mutex
+	known      bool
+	shortLimit int
+	shortUsage int
+	longLimit  int
+	longUsage  int
+	observedAt time.Time
+	// earliest time next request can be sent when pacing
+	nextSlot time.Time
+	now      func() time.Time
+}
+
+func NewRateLimits() *RateLimits {
+	return &RateLimits{now: time.Now}
+}
+
+// expire forgets usage of windows which are over, must be called with mutex held
+func (l *RateLimits) expire(now time.Time) {
+	if now.Truncate(rateLimitWindow) != l.observedAt.Truncate(rateLimitWindow) {
+		l.shortUsage = 0
+	}
+	if now.UTC().Truncate(24*time.Hour) != l.observedAt.UTC().Truncate(24*time.Hour) {
+		l.longUsage = 0
+	}
+	l.observedAt = now
+}
+
+// Budget returns remaining request budget.
+func (l *RateLimits) Budget() RateLimitBudget {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.expire(now)
+	return RateLimitBudget{
+		Known:          l.known,
+		ShortLimit:     l.shortLimit,
+		ShortRemaining: maxInt(l.shortLimit-l.shortUsage, 0),
+		ShortResetAt:   now.Add(untilNextWindow(now)),
+		LongLimit:      l.longLimit,
+		LongRemaining:  maxInt(l.longLimit-l.longUsage, 0),
+		LongResetAt:    now.Add(untilNextDay(now)),
+	}
+}
+
+// reserve accounts request about to be sent and returns how long it should
+// wait before sending, or error if it can not be sent in current window
+func (l *RateLimits) reserve() (time.Duration, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.expire(now)
+	if !l.known {
+		return 0, nil
+	}
+	if l.longUsage >= l.longLimit {
+		return 0, &RateLimitError{RetryAfter: untilNextDay(now), Daily: true}
+	}
+	remaining := l.shortLimit - l.shortUsage
+	untilReset := untilNextWindow(now)
+	var wait time.Duration
+	if remaining <= 0 {
+		wait = untilReset
+	} else if float64(remaining) < float64(l.shortLimit)*rateLimitPaceFraction {
+		// spread remaining budget over the rest of window
+		start := now
+		if l.nextSlot.After(start) {
+			start = l.nextSlot
+		}
+		l.nextSlot = start.Add(untilReset / time.Duration(remaining))
+		wait = start.Sub(now)
+	}
+	if wait < untilReset {
+		l.shortUsage++
+		l.longUsage++
+	}
+	return wait, nil
+}
+
+// release gives back budget of reserved request which was not sent
+func (l *RateLimits) release(wait time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	if wait >= untilNextWindow(now) || now.Truncate(rateLimitWindow) != l.observedAt.Truncate(rateLimitWindow) {
+		return
+	}
+	l.shortUsage = maxInt(l.shortUsage-1, 0)
+	l.longUsage = maxInt(l.longUsage-1, 0)
+}
+
+// observe updates usage from Strava response headers
+func (l *RateLimits) observe(header http.Header) {
+	shortLimit, longLimit, ok := parseRateLimitPair(header.Get("X-RateLimit-Limit"))
+	if !ok {
+		return
+	}
+	shortUsage, longUsage, ok := parseRateLimitPair(header.Get("X-RateLimit-Usage"))
+	if !ok {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.expire(l.now())
+	l.known = true
+	l.shortLimit = shortLimit
+	l.longLimit = longLimit
+	// responses of concurrent requests may come out of order
+	l.shortUsage = maxInt(l.shortUsage, shortUsage)
+	l.longUsage = maxInt(l.longUsage, longUsage)
+}
+
+// dailyExhausted tells whether observed usage reached daily limit
+func (l *RateLimits) dailyExhausted() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.expire(l.now())
+	return l.known && l.longUsage >= l.longLimit
+}
+
+// parseRateLimitPair parses "15 minute,daily" header value
+func parseRateLimitPair(value string) (int, int, bool) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	short, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, false
+	}
+	long, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, false
+	}
+	return short, long, true
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// RateLimitTransport throttles requests to stay within Strava rate limits,
+// and retries requests failed with 429 or 5xx.
+type RateLimitTransport struct {
+	Base   http.RoundTripper
+	Limits *RateLimits
+	// retries after first attempt
+	MaxRetries int
+	// requests which would wait longer fail with RateLimitError
+	MaxWait time.Duration
+	// first retry delay, doubled for every next one
+	Backoff time.Duration
+}
+
+func NewRateLimitedClient(limits *RateLimits, base http.RoundTripper) *http.Client {
+	return &http.Client{Transport: &RateLimitTransport{
+		Base:       base,
+		Limits:     limits,
+		MaxRetries: 3,
+		MaxWait:    30 * time.Second,
+		Backoff:    500 * time.Millisecond,
+	}}
+}
+
+func (t *RateLimitTransport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+// sleep waits unless request is cancelled first
+func sleep(req *http.Request, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// allowedWait tells whether request may wait d before being sent
+func (t *RateLimitTransport) allowedWait(req *http.Request, d time.Duration) bool {
+	if d > t.MaxWait {
+		return false
+	}
+	deadline, ok := req.Context().Deadline()
+	return !ok || time.Now().Add(d).Before(deadline)
+}
+
+// backoff returns jittered delay before retry number attempt
+func (t *RateLimitTransport) backoff(attempt int) time.Duration {
+	delay := t.Backoff << uint(attempt)
+	if delay <= 0 || delay > t.MaxWait {
+		delay = t.MaxWait
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryAfter returns delay requested by Retry-After header given in seconds
+// or as HTTP date, zero if header is missing
+func retryAfter(header http.Header, now time.Time) time.Duration {
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+func retryable(req *http.Request) bool {
+	return req.Method == "GET" || req.Method == "HEAD"
+}
+
+func (t *RateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		wait, err := t.Limits.reserve()
+		if err != nil {
+			return nil, err
+		}
+		if !t.allowedWait(req, wait) {
+			t.Limits.release(wait)
+			return nil, &RateLimitError{RetryAfter: wait}
+		}
+		if err := sleep(req, wait); err != nil {
+			t.Limits.release(wait)
+			return nil, err
+		}
+
+		resp, err := t.base().RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		t.Limits.observe(resp.Header)
+
+		var delay time.Duration
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			// nothing gets through before midnight UTC, error tells so
+			if t.Limits.dailyExhausted() {
+				resp.Body.Close()
+				return nil, &RateLimitError{RetryAfter: untilNextDay(time.Now()), Daily: true}
+			}
+			if delay = retryAfter(resp.Header, time.Now()); delay <= 0 {
+				delay = t.backoff(attempt)
+			}
+		case resp.StatusCode >= 500:
+			delay = t.backoff(attempt)
+		default:
+			return resp, nil
+		}
+		if attempt >= t.MaxRetries || !retryable(req) || !t.allowedWait(req, delay) {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if err := sleep(req, delay); err != nil {
+			return nil, err
+		}
+	}
+}
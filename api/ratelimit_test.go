@@ -0,0 +1,200 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func limitsAt(now time.Time, limit, usage string) *RateLimits {
+	limits := NewRateLimits()
+	limits.now = func() time.Time { return now }
+	header := http.Header{}
+	header.Set("X-RateLimit-Limit", limit)
+	header.Set("X-RateLimit-Usage", usage)
+	limits.observe(header)
+	return limits
+}
+
+func TestParseRateLimitPair(t *testing.T) {
+	if short, long, ok := parseRateLimitPair("600, 30000"); !ok || short != 600 || long != 30000 {
+		t.Errorf("Unexpected %v %v %v", short, long, ok)
+	}
+	for _, value := range []string{"", "600", "a,b", "1,2,3"} {
+		if _, _, ok := parseRateLimitPair(value); ok {
+			t.Errorf("%q should not be parsed", value)
+		}
+	}
+}
+
+func TestRateLimitBudget(t *testing.T) {
+	now := time.Date(2017, 1, 1, 10, 7, 0, 0, time.UTC)
+	limits := limitsAt(now, "600,30000", "100,2000")
+	budget := limits.Budget()
+	if !budget.Known || budget.ShortRemaining != 500 || budget.LongRemaining != 28000 {
+		t.Errorf("Unexpected budget %+v", budget)
+	}
+	if !budget.ShortResetAt.Equal(time.Date(2017, 1, 1, 10, 15, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected short reset %v", budget.ShortResetAt)
+	}
+
+	// next window starts with full short budget
+	limits.now = func() time.Time { return now.Add(10 * time.Minute) }
+	if budget := limits.Budget(); budget.ShortRemaining != 600 || budget.LongRemaining != 28000 {
+		t.Errorf("Unexpected budget in next window %+v", budget)
+	}
+	if NewRateLimits().Budget().Known {
+		t.Error("Budget should be unknown before first response")
+	}
+}
+
+func TestRateLimitReserve(t *testing.T) {
+	now := time.Date(2017, 1, 1, 10, 5, 0, 0, time.UTC)
+
+	plenty := limitsAt(now, "600,30000", "100,2000")
+	if wait, err := plenty.reserve(); wait != 0 || err != nil {
+		t.Errorf("Request within budget should not wait, got %v %v", wait, err)
+	}
+	if plenty.Budget().ShortRemaining != 499 {
+		t.Errorf("Reserved request should be accounted, got %+v", plenty.Budget())
+	}
+
+	// 10 requests left for 10 minutes are paced a minute apart
+	low := limitsAt(now, "600,30000", "590,2000")
+	first, _ := low.reserve()
+	second, _ := low.reserve()
+	if first != 0 || second != time.Minute {
+		t.Errorf("Expected paced requests, got %v %v", first, second)
+	}
+
+	exhausted := limitsAt(now, "600,30000", "600,2000")
+	if wait, err := exhausted.reserve(); wait != 10*time.Minute || err != nil {
+		t.Errorf("Expected wait for next window, got %v %v", wait, err)
+	}
+
+	daily := limitsAt(now, "600,30000", "10,30000")
+	_, err := daily.reserve()
+	if limitErr, ok := err.(*RateLimitError); !ok || !limitErr.Daily {
+		t.Errorf("Expected daily limit error, got %v", err)
+	}
+}
+
+func newTestTransport(limits *RateLimits) *http.Client {
+	client := NewRateLimitedClient(limits, nil)
+	transport := client.Transport.(*RateLimitTransport)
+	transport.Backoff = time.Millisecond
+	transport.MaxWait = 100 * time.Millisecond
+	return client
+}
+
+func TestRateLimitTransportRetriesServerErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "600,30000")
+		w.Header().Set("X-RateLimit-Usage", "10,100")
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	limits := NewRateLimits()
+	resp, err := newTestTransport(limits).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || calls != 3 {
+		t.Errorf("Expected success after 3 calls, got %v after %v", resp.StatusCode, calls)
+	}
+	if budget := limits.Budget(); !budget.Known || budget.ShortLimit != 600 {
+		t.Errorf("Budget should be updated from headers, got %+v", budget)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	resp, err = newTestTransport(limits).PostForm(server.URL, url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || calls != 1 {
+		t.Errorf("POST should not be retried, got %v after %v calls", resp.StatusCode, calls)
+	}
+}
+
+func TestRateLimitTransportRetriesRateLimit(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "600,30000")
+		w.Header().Set("X-RateLimit-Usage", "10,100")
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	resp, err := newTestTransport(NewRateLimits()).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || calls != 2 {
+		t.Errorf("Expected success after 429, got %v after %v calls", resp.StatusCode, calls)
+	}
+}
+
+func TestRateLimitTransportGivesUpOnDailyLimit(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("X-RateLimit-Limit", "600,30000")
+		w.Header().Set("X-RateLimit-Usage", "100,30000")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := newTestTransport(NewRateLimits())
+	_, err := client.Get(server.URL)
+	apiErr := classifyError(err)
+	if apiErr.status != http.StatusTooManyRequests || apiErr.retryAfter < untilNextDay(time.Now())-time.Minute {
+		t.Errorf("Expected rate limit error lasting until next day, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("429 should not be retried when daily limit is exhausted, got %v calls", calls)
+	}
+
+	// budget is known to be exhausted, so next request is not sent
+	_, err = client.Get(server.URL)
+	if apiErr := classifyError(err); apiErr.status != http.StatusTooManyRequests || apiErr.retryAfter <= 0 {
+		t.Errorf("Expected rate limit error, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Request over budget should not be sent, got %v calls", calls)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2017, 1, 1, 10, 0, 0, 0, time.UTC)
+	cases := map[string]time.Duration{
+		"":                              0,
+		"7":                             7 * time.Second,
+		"Sun, 01 Jan 2017 10:00:30 GMT": 30 * time.Second,
+		"soon":                          0,
+	}
+	for value, expected := range cases {
+		header := http.Header{}
+		if value != "" {
+			header.Set("Retry-After", value)
+		}
+		if actual := retryAfter(header, now); actual != expected {
+			t.Errorf("%q: expected %v, got %v", value, expected, actual)
+		}
+	}
+}
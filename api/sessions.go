@@ -0,0 +1,383 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const KIND_SESSION = "Session"
+
+var cookieSession = "session"
+
+// how long user stays logged in
+var sessionTTL = 30 * 24 * time.Hour
+
+// how often stores look for expired sessions of users who did not return
+var sessionSweepInterval = time.Hour
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is server-side record of logged in user, browser only keeps
+// signed session id.
+type Session struct {
+	AthleteId   int64
+	AthleteName string `datastore:",noindex"`
+	Token       OAuthToken
+	ExpiresAt   time.Time
+}
+
+func (s *Session) Expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt)
+}
+
+// SessionStore keeps session records by session id.
+type SessionStore interface {
+	// returns ErrSessionNotFound if session is missing or expired
+	GetSession(ctx context.Context, id string) (*Session, error)
+	StoreSession(ctx context.Context, id string, session *Session) error
+	DeleteSession(ctx context.Context, id string) error
+}
+
+func newSessionId() (string, error) {
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(id), nil
+}
+
+// validSessionId tells whether id could be generated by newSessionId, so it
+// is safe to use as file name or key
+func validSessionId(id string) bool {
+	decoded, err := base64.RawURLEncoding.DecodeString(id)
+	return err == nil && len(decoded) == 32
+}
+
+func sessionSignature(secret []byte, id string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signSessionId returns cookie value for session id
+func signSessionId(secret []byte, id string) string {
+	return id + "." + sessionSignature(secret, id)
+}
+
+// verifySessionId returns session id if cookie value was signed with secret
+func verifySessionId(secret []byte, value string) (string, bool) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 || !validSessionId(parts[0]) {
+		return "", false
+	}
+	expected := sessionSignature(secret, parts[0])
+	if !hmac.Equal([]byte(parts[1]), []byte(expected)) {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// rootUrlScheme returns scheme app is served with, http unless root url
+// says otherwise
+func rootUrlScheme(rootUrl string) string {
+	if parsed, err := url.Parse(rootUrl); err == nil && parsed.Scheme == "https" {
+		return "https"
+	}
+	return "http"
+}
+
+// sessionCookie is sent only over https, unless insecure cookies are allowed
+// for local development
+func sessionCookie(params Params, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     cookieSession,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   !params.InsecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// startSession stores new session and sets its cookie
+func startSession(ctx context.Context, params Params, w http.ResponseWriter, session *Session) error {
+	id, err := newSessionId()
+	if err != nil {
+		return err
+	}
+	session.ExpiresAt = time.Now().Add(sessionTTL)
+	if err := params.SessionStoreAccessor(ctx).StoreSession(ctx, id, session); err != nil {
+		return err
+	}
+	http.SetCookie(w, sessionCookie(params, signSessionId(params.SessionSecret, id), int(sessionTTL/time.Second)))
+	return nil
+}
+
+// loadSession returns session of request, or ErrSessionNotFound if request
+// has no valid session cookie
+func loadSession(ctx context.Context, params Params, r *http.Request) (string, *Session, error) {
+	cookie, err := r.Cookie(cookieSession)
+	if err != nil {
+		return "", nil, ErrSessionNotFound
+	}
+	id, ok := verifySessionId(params.SessionSecret, cookie.Value)
+	if !ok {
+		return "", nil, ErrSessionNotFound
+	}
+	session, err := params.SessionStoreAccessor(ctx).GetSession(ctx, id)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, session, nil
+}
+
+// endSession deletes session of request, if any, and its cookie
+func endSession(ctx context.Context, params Params, w http.ResponseWriter, r *http.Request) error {
+	http.SetCookie(w, sessionCookie(params, "", -1))
+	cookie, err := r.Cookie(cookieSession)
+	if err != nil {
+		return nil
+	}
+	id, ok := verifySessionId(params.SessionSecret, cookie.Value)
+	if !ok {
+		return nil
+	}
+	return params.SessionStoreAccessor(ctx).DeleteSession(ctx, id)
+}
+
+// in-memory session store, sessions are lost on restart
+
+type MemorySessionStore struct {
+	mutex     sync.Mutex
+	sessions  map[string]Session
+	lastSweep time.Time
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]Session)}
+}
+
+func (s *MemorySessionStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	if session.Expired(time.Now()) {
+		delete(s.sessions, id)
+		return nil, ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+func (s *MemorySessionStore) StoreSession(ctx context.Context, id string, session *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) >= sessionSweepInterval {
+		for storedId, stored := range s.sessions {
+			if stored.Expired(now) {
+				delete(s.sessions, storedId)
+			}
+		}
+		s.lastSweep = now
+	}
+	s.sessions[id] = *session
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteSession(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+// file-based session store, one json file per session
+
+type FileSessionStore struct {
+	root      string
+	mutex     sync.Mutex
+	lastSweep time.Time
+}
+
+func NewFileSessionStore(root string) *FileSessionStore {
+	return &FileSessionStore{root: root}
+}
+
+func (s *FileSessionStore) sessionFilename(id string) string {
+	return path.Join(s.root, id+".json")
+}
+
+func (s *FileSessionStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	if !validSessionId(id) {
+		return nil, ErrSessionNotFound
+	}
+	data, err := ioutil.ReadFile(s.sessionFilename(id))
+	if os.IsNotExist(err) {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	if session.Expired(time.Now()) {
+		s.DeleteSession(ctx, id)
+		return nil, ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+func (s *FileSessionStore) StoreSession(ctx context.Context, id string, session *Session) error {
+	if !validSessionId(id) {
+		return errors.New("invalid session id")
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.root, 0700); err != nil {
+		return err
+	}
+	// written aside and renamed, so concurrent readers never see partial file
+	tmp, err := ioutil.TempFile(s.root, "."+id+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.sessionFilename(id))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	s.sweep(ctx)
+	return nil
+}
+
+// sweep deletes expired sessions, at most once per sessionSweepInterval
+func (s *FileSessionStore) sweep(ctx context.Context) {
+	s.mutex.Lock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) < sessionSweepInterval {
+		s.mutex.Unlock()
+		return
+	}
+	s.lastSweep = now
+	s.mutex.Unlock()
+	files, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if id := strings.TrimSuffix(file.Name(), ".json"); id != file.Name() {
+			// expired session is deleted when read
+			s.GetSession(ctx, id)
+		}
+	}
+}
+
+func (s *FileSessionStore) DeleteSession(ctx context.Context, id string) error {
+	if !validSessionId(id) {
+		return nil
+	}
+	err := os.Remove(s.sessionFilename(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// datastore-based session store
+
+type DatastoreSessionStore struct {
+	mutex     sync.Mutex
+	lastSweep time.Time
+}
+
+func NewDatastoreSessionStore() *DatastoreSessionStore {
+	return &DatastoreSessionStore{}
+}
+
+func sessionKey(ctx context.Context, id string) *datastore.Key {
+	return datastore.NewKey(ctx, KIND_SESSION, id, 0, nil)
+}
+
+func (s *DatastoreSessionStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	var session Session
+	if err := datastore.Get(ctx, sessionKey(ctx, id), &session); err == datastore.ErrNoSuchEntity {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if session.Expired(time.Now()) {
+		s.DeleteSession(ctx, id)
+		return nil, ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+func (s *DatastoreSessionStore) StoreSession(ctx context.Context, id string, session *Session) error {
+	if _, err := datastore.Put(ctx, sessionKey(ctx, id), session); err != nil {
+		return err
+	}
+	s.sweep(ctx)
+	return nil
+}
+
+// sweep deletes expired sessions, at most once per sessionSweepInterval
+func (s *DatastoreSessionStore) sweep(ctx context.Context) {
+	s.mutex.Lock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) < sessionSweepInterval {
+		s.mutex.Unlock()
+		return
+	}
+	s.lastSweep = now
+	s.mutex.Unlock()
+	keys, err := datastore.NewQuery(KIND_SESSION).Filter("ExpiresAt <", now).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		warningf(ctx, "Failed to look up expired sessions: %v", err)
+		return
+	}
+	for start := 0; start < len(keys); start += cache.DATASTORE_MAX_BATCH {
+		end := start + cache.DATASTORE_MAX_BATCH
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := datastore.DeleteMulti(ctx, keys[start:end]); err != nil {
+			warningf(ctx, "Failed to delete %v expired sessions: %v", end-start, err)
+		}
+	}
+}
+
+func (s *DatastoreSessionStore) DeleteSession(ctx context.Context, id string) error {
+	err := datastore.Delete(ctx, sessionKey(ctx, id))
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
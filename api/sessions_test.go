@@ -0,0 +1,158 @@
+package api
+
+import (
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSessionIdSignature(t *testing.T) {
+	id, err := newSessionId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := signSessionId(testSessionSecret, id)
+	if verified, ok := verifySessionId(testSessionSecret, value); !ok || verified != id {
+		t.Errorf("Signed id should be verified, got %v %v", verified, ok)
+	}
+	for _, forged := range []string{
+		id,
+		id + ".",
+		signSessionId([]byte("other secret"), id),
+		value + "x",
+		"../../etc/passwd." + sessionSignature(testSessionSecret, "../../etc/passwd"),
+	} {
+		if _, ok := verifySessionId(testSessionSecret, forged); ok {
+			t.Errorf("Forged value %v should be rejected", forged)
+		}
+	}
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	store := NewMemorySessionStore()
+	cookie := loggedIn(t, store, 42, OAuthToken{AccessToken: "a1"})
+	if cookie.Name != cookieSession || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("Unexpected cookie %+v", cookie)
+	}
+	if cookie.MaxAge <= 0 || cookie.Path != "/" {
+		t.Errorf("Cookie should be persistent for whole site, got %+v", cookie)
+	}
+	if !cookie.Secure {
+		t.Errorf("Cookie should be secure by default, got %+v", cookie)
+	}
+	if cookie := sessionCookie(Params{RootUrl: "http://localhost:8080", InsecureCookies: true}, "value", 1); cookie.Secure {
+		t.Errorf("Cookie should be sent over http when insecure cookies are allowed, got %+v", cookie)
+	}
+}
+
+func TestEndSession(t *testing.T) {
+	store := NewMemorySessionStore()
+	cookie := loggedIn(t, store, 42, OAuthToken{AccessToken: "a1"})
+	params := Params{
+		SessionStoreAccessor: func(ctx context.Context) SessionStore { return store },
+		SessionSecret:        testSessionSecret,
+	}
+	request := httptest.NewRequest("GET", "/logout", nil)
+	request.AddCookie(cookie)
+	recorder := httptest.NewRecorder()
+	if err := endSession(context.Background(), params, recorder, request); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadSession(context.Background(), params, request); err != ErrSessionNotFound {
+		t.Errorf("Session should be deleted, got %v", err)
+	}
+	if cleared := recorder.Result().Cookies(); len(cleared) != 1 || cleared[0].MaxAge >= 0 {
+		t.Errorf("Session cookie should be cleared, got %+v", cleared)
+	}
+}
+
+func testSessionStore(t *testing.T, store SessionStore) {
+	ctx := context.Background()
+	id, _ := newSessionId()
+	if _, err := store.GetSession(ctx, id); err != ErrSessionNotFound {
+		t.Errorf("Expected missing session, got %v", err)
+	}
+	session := &Session{
+		AthleteId:   42,
+		AthleteName: "Eddy",
+		Token:       OAuthToken{AccessToken: "a1", RefreshToken: "r1", ExpiresAt: time.Unix(1500000000, 0).UTC()},
+		ExpiresAt:   time.Now().Add(time.Hour).UTC(),
+	}
+	if err := store.StoreSession(ctx, id, session); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.GetSession(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.AthleteId != 42 || loaded.AthleteName != "Eddy" || loaded.Token != session.Token || !loaded.ExpiresAt.Equal(session.ExpiresAt) {
+		t.Errorf("Unexpected session %+v", loaded)
+	}
+
+	session.ExpiresAt = time.Now().Add(-time.Second)
+	if err := store.StoreSession(ctx, id, session); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetSession(ctx, id); err != ErrSessionNotFound {
+		t.Errorf("Expired session should not be returned, got %v", err)
+	}
+
+	session.ExpiresAt = time.Now().Add(time.Hour)
+	store.StoreSession(ctx, id, session)
+	if err := store.DeleteSession(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetSession(ctx, id); err != ErrSessionNotFound {
+		t.Errorf("Deleted session should not be returned, got %v", err)
+	}
+	if err := store.DeleteSession(ctx, id); err != nil {
+		t.Errorf("Deleting missing session should succeed, got %v", err)
+	}
+}
+
+// testSessionSweep checks that storing session deletes sessions which expired
+// and were never read again
+func testSessionSweep(t *testing.T, store SessionStore, resetSweep func()) {
+	ctx := context.Background()
+	expiredId, _ := newSessionId()
+	store.StoreSession(ctx, expiredId, &Session{AthleteId: 1, ExpiresAt: time.Now().Add(-time.Second)})
+	resetSweep()
+	id, _ := newSessionId()
+	if err := store.StoreSession(ctx, id, &Session{AthleteId: 2, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetSession(ctx, id); err != nil {
+		t.Errorf("Valid session should be kept, got %v", err)
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	testSessionStore(t, NewMemorySessionStore())
+
+	store := NewMemorySessionStore()
+	testSessionSweep(t, store, func() { store.lastSweep = time.Time{} })
+	if len(store.sessions) != 1 {
+		t.Errorf("Expired session should be swept, got %v sessions", len(store.sessions))
+	}
+}
+
+func TestFileSessionStore(t *testing.T) {
+	root, _ := ioutil.TempDir("", "sessions")
+	defer os.RemoveAll(root)
+	testSessionStore(t, NewFileSessionStore(root))
+	if _, err := NewFileSessionStore(root).GetSession(context.Background(), "../secret"); err != ErrSessionNotFound {
+		t.Errorf("Invalid session id should not be read, got %v", err)
+	}
+
+	sweepRoot, _ := ioutil.TempDir("", "sessions")
+	defer os.RemoveAll(sweepRoot)
+	store := NewFileSessionStore(sweepRoot)
+	testSessionSweep(t, store, func() { store.lastSweep = time.Time{} })
+	if files, _ := ioutil.ReadDir(sweepRoot); len(files) != 1 {
+		t.Errorf("Expired session should be swept, got %v files", len(files))
+	}
+}
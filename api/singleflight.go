@@ -0,0 +1,118 @@
+package api
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"sync"
+)
+
+// flightGroup coalesces concurrent calls with the same key into single
+// execution. Callers wait for result independently: caller whose context is
+// done stops waiting, and execution is cancelled only when all its callers
+// stopped waiting.
+type flightGroup struct {
+	// context executions are derived from, context.Background() if nil;
+	// executions outlive requests, so they never use caller context
+	background func() context.Context
+	mutex      sync.Mutex
+	flights    map[string]*flight
+}
+
+type flight struct {
+	done    chan struct{}
+	result  interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+	// started by Go, runs to completion even without callers
+	detached bool
+}
+
+// Do runs fn once for all concurrent calls with the same key and returns its
+// result, or ctx error if ctx is done first.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	return g.do(ctx, key, fn, false)
+}
+
+// DoSettled is like Do, but caller whose ctx is done and who cancels
+// execution returns only after it stopped, so callers bounding their
+// concurrency bound executions as well. Execution kept by other callers
+// belongs to them, so caller leaving it returns immediately.
+func (g *flightGroup) DoSettled(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	return g.do(ctx, key, fn, true)
+}
+
+func (g *flightGroup) do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error), settle bool) (interface{}, error) {
+	g.mutex.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	f, ok := g.flights[key]
+	if !ok {
+		f = g.start(key, fn)
+	}
+	f.waiters++
+	g.mutex.Unlock()
+
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		g.mutex.Lock()
+		f.waiters--
+		abandoned := f.waiters == 0 && !f.detached
+		if abandoned {
+			f.cancel()
+			// callers coming later start new execution
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+		}
+		g.mutex.Unlock()
+		if settle && abandoned {
+			<-f.done
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Go starts fn in background unless execution with the same key is running
+// already. Nobody waits for it, so it is not cancelled when callers joining
+// it with Do stop waiting.
+func (g *flightGroup) Go(key string, fn func(ctx context.Context) (interface{}, error)) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	if _, ok := g.flights[key]; !ok {
+		g.start(key, fn).detached = true
+	}
+}
+
+// start runs fn in background, must be called with mutex held
+func (g *flightGroup) start(key string, fn func(ctx context.Context) (interface{}, error)) *flight {
+	background := context.Background()
+	if g.background != nil {
+		background = g.background()
+	}
+	flightCtx, cancel := context.WithCancel(background)
+	f := &flight{done: make(chan struct{}), cancel: cancel}
+	g.flights[key] = f
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				f.result, f.err = nil, fmt.Errorf("%v", r)
+			}
+			g.mutex.Lock()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+			g.mutex.Unlock()
+			cancel()
+			close(f.done)
+		}()
+		f.result, f.err = fn(flightCtx)
+	}()
+	return f
+}
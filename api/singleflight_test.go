@@ -0,0 +1,233 @@
+package api
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupCoalescesConcurrentCalls(t *testing.T) {
+	var group flightGroup
+	var calls int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan interface{}, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := group.Do(context.Background(), "athlete:1", fn)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- result
+		}()
+	}
+	// let all callers join the flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if calls != 1 {
+		t.Errorf("Expected single execution, got %v", calls)
+	}
+	for result := range results {
+		if result != 42 {
+			t.Errorf("Expected shared result, got %v", result)
+		}
+	}
+}
+
+func TestFlightGroupCallersCancelIndependently(t *testing.T) {
+	var group flightGroup
+	release := make(chan struct{})
+	workCancelled := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		select {
+		case <-release:
+			return "done", nil
+		case <-ctx.Done():
+			close(workCancelled)
+			return nil, ctx.Err()
+		}
+	}
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	firstResult := make(chan error, 1)
+	go func() {
+		_, err := group.Do(first, "athlete:1", fn)
+		firstResult <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	secondResult := make(chan interface{}, 1)
+	go func() {
+		result, _ := group.Do(context.Background(), "athlete:1", fn)
+		secondResult <- result
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	cancelFirst()
+	if err := <-firstResult; err != context.Canceled {
+		t.Errorf("Cancelled caller should get context error, got %v", err)
+	}
+	close(release)
+	if result := <-secondResult; result != "done" {
+		t.Errorf("Other caller should get result, got %v", result)
+	}
+	select {
+	case <-workCancelled:
+		t.Error("Execution should not be cancelled while someone waits for it")
+	default:
+	}
+}
+
+func TestFlightGroupCancelsAbandonedExecution(t *testing.T) {
+	var group flightGroup
+	workCancelled := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		close(workCancelled)
+		return nil, ctx.Err()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := group.Do(ctx, "athlete:1", fn); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline error, got %v", err)
+	}
+	select {
+	case <-workCancelled:
+	case <-time.After(time.Second):
+		t.Error("Execution without callers should be cancelled")
+	}
+}
+
+func TestFlightGroupSettledCallerWaitsOnlyForAbandonedExecution(t *testing.T) {
+	var group flightGroup
+	work := func(release, stopped chan struct{}) func(ctx context.Context) (interface{}, error) {
+		return func(ctx context.Context) (interface{}, error) {
+			defer close(stopped)
+			select {
+			case <-release:
+				return "done", nil
+			case <-ctx.Done():
+				// stopping takes a while
+				time.Sleep(20 * time.Millisecond)
+				return nil, ctx.Err()
+			}
+		}
+	}
+	release, stopped := make(chan struct{}), make(chan struct{})
+	fn := work(release, stopped)
+	kept := make(chan error, 1)
+	go func() {
+		_, err := group.Do(context.Background(), "athlete:1", fn)
+		kept <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := group.DoSettled(ctx, "athlete:1", fn); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline error, got %v", err)
+	}
+	select {
+	case <-stopped:
+		t.Error("Execution kept by other caller should not stop")
+	default:
+	}
+	close(release)
+	if err := <-kept; err != nil {
+		t.Errorf("Remaining caller should get result, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	stopped = make(chan struct{})
+	if _, err := group.DoSettled(ctx, "athlete:2", work(make(chan struct{}), stopped)); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline error, got %v", err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Error("Caller abandoning execution should wait until it stops")
+	}
+}
+
+func TestFlightGroupReportsPanicAsError(t *testing.T) {
+	var group flightGroup
+	_, err := group.Do(context.Background(), "athlete:1", func(ctx context.Context) (interface{}, error) {
+		panic("broken")
+	})
+	if err == nil || err.Error() != "broken" {
+		t.Errorf("Panic should be reported as error, got %v", err)
+	}
+	result, err := group.Do(context.Background(), "athlete:1", func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("second call")
+	})
+	if result != nil || err == nil || err.Error() != "second call" {
+		t.Errorf("Finished flight should not be reused, got %v, %v", result, err)
+	}
+}
+
+func TestFlightGroupRunsOnOwnContext(t *testing.T) {
+	type key int
+	group := flightGroup{background: func() context.Context {
+		return context.WithValue(context.Background(), key(1), "background")
+	}}
+	caller, cancel := context.WithCancel(context.WithValue(context.Background(), key(2), "request"))
+	defer cancel()
+	result, err := group.Do(caller, "athlete:1", func(ctx context.Context) (interface{}, error) {
+		return []interface{}{ctx.Value(key(1)), ctx.Value(key(2))}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := result.([]interface{})
+	if values[0] != "background" || values[1] != nil {
+		t.Errorf("Execution should use group context only, got %v", values)
+	}
+}
+
+func TestFlightGroupGoRunsOnceWithoutCallers(t *testing.T) {
+	var group flightGroup
+	var calls int32
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		select {
+		case <-release:
+			close(finished)
+			return "done", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	group.Go("sync:1", fn)
+	group.Go("sync:1", fn)
+	// caller joining background execution may give up without cancelling it
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := group.Do(ctx, "sync:1", fn); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline error, got %v", err)
+	}
+	close(release)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Error("Background execution should finish")
+	}
+	if calls != 1 {
+		t.Errorf("Expected single execution, got %v", calls)
+	}
+}
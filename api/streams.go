@@ -0,0 +1,108 @@
+package api
+
+import (
+	"fmt"
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
+	"net/http"
+	"strconv"
+)
+
+// streams cached for every activity, other streams can be derived from them
+var streamTypes = []strava.StreamType{
+	strava.StreamTypes.Time,
+	strava.StreamTypes.Distance,
+	strava.StreamTypes.Elevation,
+	strava.StreamTypes.Location,
+	strava.StreamTypes.HeartRate,
+	strava.StreamTypes.Cadence,
+	strava.StreamTypes.Power,
+}
+
+func downloadStreams(ctx context.Context, client *strava.Client, activityId int64) (*cache.ActivityStreams, error) {
+	streamsService := strava.NewActivityStreamsService(client)
+	streamSet, err := streamsService.Get(activityId, streamTypes).SeriesType("time").Do()
+	if err != nil {
+		return nil, stravaCallError(err)
+	}
+	return convertStreams(streamSet), nil
+}
+
+// convertStreams keeps data of streams recorded during activity
+func convertStreams(streamSet *strava.StreamSet) *cache.ActivityStreams {
+	streams := &cache.ActivityStreams{}
+	if streamSet.Time != nil {
+		streams.Time = streamSet.Time.Data
+	}
+	if streamSet.Distance != nil {
+		streams.Distance = streamSet.Distance.Data
+	}
+	if streamSet.Elevation != nil {
+		streams.Altitude = streamSet.Elevation.Data
+	}
+	if streamSet.Location != nil {
+		streams.LatLng = streamSet.Location.Data
+	}
+	if streamSet.HeartRate != nil {
+		streams.Heartrate = streamSet.HeartRate.Data
+	}
+	if streamSet.Cadence != nil {
+		streams.Cadence = streamSet.Cadence.Data
+	}
+	if streamSet.Power != nil {
+		streams.Watts = streamSet.Power.Data
+	}
+	return streams
+}
+
+func (api *AnalysisApi) retrieveStreams(ctx context.Context, token string, athleteId int64, activityId int64) (*cache.ActivityStreams, error) {
+	key := fmt.Sprintf("streams/%v/%v", athleteId, activityId)
+	result, err := api.flights.Do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return api.loadStreams(ctx, api.stravaClient(ctx, token), athleteId, activityId)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*cache.ActivityStreams), nil
+}
+
+func (api *AnalysisApi) loadStreams(ctx context.Context, client *strava.Client, athleteId int64, activityId int64) (*cache.ActivityStreams, error) {
+	cacheClient := api.Params.ActivityCacheAccessor(ctx)
+	cached, freshness, err := cache.LookupStreams(ctx, cacheClient, api.Params.ActivityTTLPolicy, athleteId, activityId)
+	if err != nil {
+		warningf(ctx, "failed to load streams of activity %v from cache, downloading: %v", activityId, err)
+	}
+	if freshness == cache.FRESH {
+		debugf(ctx, "using streams of activity %v from cache", activityId)
+		return cached, nil
+	}
+
+	streams, err := downloadStreams(ctx, client, activityId)
+	if err != nil {
+		if cached != nil {
+			warningf(ctx, "failed to refresh streams of activity %v, using stale copy: %v", activityId, err)
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	if err := cacheClient.StoreStreams(ctx, athleteId, activityId, streams); err != nil {
+		warningf(ctx, "failed to store streams of activity %v in cache: %v", activityId, err)
+	}
+	return streams, nil
+}
+
+func (api *AnalysisApi) getStreams(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	activityId, err := strconv.ParseInt(r.URL.Query().Get("activity"), 10, 64)
+	if err != nil {
+		return badRequest("activity parameter should be activity id")
+	}
+	auth := authFromContext(ctx)
+	streams, err := api.retrieveStreams(ctx, auth.Token, auth.AthleteId, activityId)
+	if err != nil {
+		return err
+	}
+	writeJson(w, http.StatusOK, streams)
+	return nil
+}
@@ -0,0 +1,23 @@
+package api
+
+import (
+	"github.com/strava/go.strava"
+	"testing"
+)
+
+func TestConvertStreamsKeepsRecordedStreams(t *testing.T) {
+	streamSet := &strava.StreamSet{
+		Time:      &strava.IntegerStream{Data: []int{0, 1, 2}},
+		Location:  &strava.LocationStream{Data: [][2]float64{{52.5, 13.4}, {52.6, 13.4}, {52.7, 13.4}}},
+		HeartRate: &strava.IntegerStream{Data: []int{120, 121, 122}},
+		// not requested, but returned
+		Speed: &strava.DecimalStream{Data: []float64{1, 2, 3}},
+	}
+	streams := convertStreams(streamSet)
+	if len(streams.Time) != 3 || len(streams.LatLng) != 3 || len(streams.Heartrate) != 3 {
+		t.Errorf("Recorded streams should be kept, got %+v", streams)
+	}
+	if streams.Watts != nil || streams.Cadence != nil || streams.Altitude != nil {
+		t.Errorf("Streams which were not recorded should be nil, got %+v", streams)
+	}
+}
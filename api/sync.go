@@ -0,0 +1,110 @@
+package api
+
+import (
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
+	"sort"
+	"time"
+)
+
+// how often activity list is downloaded from scratch to pick up
+// edited and deleted activities
+var fullSyncInterval = 7 * 24 * time.Hour
+
+// downloadActivities loads all athlete activities started after given time,
+// or all activities if after is zero
+func downloadActivities(ctx context.Context, client *strava.Client, athleteId int64, after time.Time) (cache.ActivityList, error) {
+	athletes := strava.NewAthletesService(client)
+	fullActivities := make(cache.ActivityList, 0)
+	for page := 1; ; page++ {
+		call := athletes.ListActivities(athleteId)
+		call.PerPage(pageSize)
+		call.Page(page)
+		if !after.IsZero() {
+			call.After(int(after.Unix()))
+		}
+		debugf(ctx, "Loading athlete %v page %v after %v", athleteId, page, after)
+		activities, err := call.Do()
+		if err != nil {
+			criticalf(ctx, err.Error())
+			return nil, stravaCallError(err)
+		}
+		if len(activities) == 0 {
+			break
+		}
+		fullActivities = append(fullActivities, activities...)
+	}
+	return fullActivities, nil
+}
+
+type byStartDateDesc cache.ActivityList
+
+func (a byStartDateDesc) Len() int           { return len(a) }
+func (a byStartDateDesc) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byStartDateDesc) Less(i, j int) bool { return a[i].StartDate.After(a[j].StartDate) }
+
+// mergeActivities combines stored list with newly downloaded activities,
+// newer copy wins for duplicate ids, result is sorted newest first
+func mergeActivities(stored, downloaded cache.ActivityList) cache.ActivityList {
+	seen := make(map[int64]bool)
+	merged := make(cache.ActivityList, 0, len(stored)+len(downloaded))
+	for _, list := range []cache.ActivityList{downloaded, stored} {
+		for _, activity := range list {
+			if seen[activity.Id] {
+				continue
+			}
+			seen[activity.Id] = true
+			merged = append(merged, activity)
+		}
+	}
+	sort.Stable(byStartDateDesc(merged))
+	return merged
+}
+
+// watermark returns start date of the latest activity in the list
+func watermark(activities cache.ActivityList) (latest time.Time) {
+	for _, activity := range activities {
+		if activity.StartDate.After(latest) {
+			latest = activity.StartDate
+		}
+	}
+	return latest
+}
+
+// syncActivities brings stored activity list up to date, downloading only
+// activities newer than stored watermark unless full sync is due
+func (api *AnalysisApi) syncActivities(ctx context.Context, client *strava.Client, athleteId int64, stored cache.ActivityList, state *cache.SyncState) (cache.ActivityList, error) {
+	cacheClient := api.Params.ActivityCacheAccessor(ctx)
+	now := time.Now()
+	newState := cache.SyncState{}
+
+	var activities cache.ActivityList
+	if stored == nil || state == nil || now.Sub(state.LastFullSync) > fullSyncInterval {
+		debugf(ctx, "Running full sync of athlete %v activities", athleteId)
+		downloaded, err := downloadActivities(ctx, client, athleteId, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		activities = mergeActivities(nil, downloaded)
+		newState.LastFullSync = now
+	} else {
+		debugf(ctx, "Running incremental sync of athlete %v activities after %v", athleteId, state.Watermark)
+		downloaded, err := downloadActivities(ctx, client, athleteId, state.Watermark)
+		if err != nil {
+			return nil, err
+		}
+		activities = mergeActivities(stored, downloaded)
+		newState.LastFullSync = state.LastFullSync
+	}
+	newState.Watermark = watermark(activities)
+
+	if err := cacheClient.Store(ctx, athleteId, activities); err != nil {
+		warningf(ctx, "Failed to store activities of athlete %v in cache: %v", athleteId, err)
+		return activities, nil
+	}
+	if err := cacheClient.StoreSyncState(ctx, athleteId, &newState); err != nil {
+		warningf(ctx, "Failed to store sync state of athlete %v in cache: %v", athleteId, err)
+	}
+	return activities, nil
+}
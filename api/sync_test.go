@@ -0,0 +1,44 @@
+package api
+
+import (
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"github.com/strava/go.strava"
+	"testing"
+	"time"
+)
+
+func activityAt(id int64, name string, day int) *strava.ActivitySummary {
+	return &strava.ActivitySummary{
+		Id:        id,
+		Name:      name,
+		StartDate: time.Date(2017, 1, day, 10, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestMergeActivitiesDedupesById(t *testing.T) {
+	stored := cache.ActivityList{activityAt(2, "old", 2), activityAt(1, "first", 1)}
+	downloaded := cache.ActivityList{activityAt(2, "renamed", 2), activityAt(3, "new", 3)}
+	merged := mergeActivities(stored, downloaded)
+	if len(merged) != 3 {
+		t.Fatalf("Expected 3 activities, got %v", len(merged))
+	}
+	for i, expectedId := range []int64{3, 2, 1} {
+		if merged[i].Id != expectedId {
+			t.Errorf("Expected activity %v at position %v, got %v", expectedId, i, merged[i].Id)
+		}
+	}
+	if merged[1].Name != "renamed" {
+		t.Errorf("Downloaded activity should replace stored one, got %v", merged[1].Name)
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	activities := cache.ActivityList{activityAt(1, "a", 5), activityAt(2, "b", 7), activityAt(3, "c", 6)}
+	expected := time.Date(2017, 1, 7, 10, 0, 0, 0, time.UTC)
+	if actual := watermark(activities); !actual.Equal(expected) {
+		t.Errorf("%v != %v", expected, actual)
+	}
+	if actual := watermark(nil); !actual.IsZero() {
+		t.Errorf("Watermark of empty list should be zero, got %v", actual)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"google.golang.org/appengine/urlfetch"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -26,34 +27,73 @@ func getEnvOrPanic(name, defaultValue string) string {
 	return value
 }
 
-func resolveUrlFetchFunc(r *http.Request) *http.Client {
+// Strava rate limits are per application, so budget is shared by all requests
+var stravaRateLimits = api.NewRateLimits()
+
+func resolveContextUrlFetchFunc(ctx context.Context) *http.Client {
 	enabledVar := os.Getenv("APPENGINE_ENABLED")
 	if strings.ToLower(enabledVar) == "true" || enabledVar == "1" {
-		return urlfetch.Client(appengine.NewContext(r))
+		transport := urlfetch.Client(ctx).Transport
+		return api.NewRateLimitedClient(stravaRateLimits, transport)
 	} else {
-		return http.DefaultClient
+		return api.NewRateLimitedClient(stravaRateLimits, http.DefaultTransport)
 	}
 }
 
+func resolveUrlFetchFunc(r *http.Request) *http.Client {
+	return resolveContextUrlFetchFunc(appengine.NewContext(r))
+}
+
 func newCacheFactory() func(ctx context.Context) cache.ActivityCache {
 	log.Printf("Using cache impl: %s", cache.DEFAULT_CACHE_IMPL)
+	var instance cache.ActivityCache
 	if cache.DEFAULT_CACHE_IMPL == "memory" {
-		instance := cache.NewMapActivityCache()
-		return func(ctx context.Context) cache.ActivityCache { return instance }
+		instance = cache.NewMapActivityCache()
 	} else if cache.DEFAULT_CACHE_IMPL == "file" {
-		instance := cache.NewDefaultFileActivityCache()
-		return func(ctx context.Context) cache.ActivityCache { return instance }
+		instance = cache.NewDefaultFileActivityCache()
+	} else if cache.DEFAULT_CACHE_IMPL == "bolt" {
+		instance = cache.NewDefaultBoltActivityCache()
 	} else if cache.DEFAULT_CACHE_IMPL == "datastore" {
-		return func(ctx context.Context) cache.ActivityCache { return cache.NewDatastoreActivityCache(ctx) }
+		instance = cache.NewDatastoreActivityCache()
 	} else if cache.DEFAULT_CACHE_IMPL == "googlestorage" {
 		bucket := getEnvOrPanic("STRAVA_CACHE_BUCKET", "")
 		prefix := os.Getenv("STRAVA_CACHE_PREFIX")
-		return func(ctx context.Context) cache.ActivityCache {
-			return cache.NewGoogleStorageActivityCache(ctx, bucket, prefix)
-		}
+		instance = cache.NewGoogleStorageActivityCache(bucket, prefix)
 	} else {
 		panic("Unknown cache impl: " + cache.DEFAULT_CACHE_IMPL)
 	}
+	instance = cache.WithFrontCache(instance)
+	return func(ctx context.Context) cache.ActivityCache { return instance }
+}
+
+func newSessionStoreFactory() func(ctx context.Context) api.SessionStore {
+	impl := getEnvOrPanic("STRAVA_SESSION_STORE", "memory")
+	log.Printf("Using session store impl: %s", impl)
+	var instance api.SessionStore
+	if impl == "memory" {
+		instance = api.NewMemorySessionStore()
+	} else if impl == "file" {
+		instance = api.NewFileSessionStore(getEnvOrPanic("STRAVA_SESSION_ROOT", "sessions"))
+	} else if impl == "datastore" {
+		instance = api.NewDatastoreSessionStore()
+	} else {
+		panic("Unknown session store impl: " + impl)
+	}
+	return func(ctx context.Context) api.SessionStore { return instance }
+}
+
+// shorter secret makes session cookie signatures guessable
+const minSessionSecretLength = 32
+
+// isLocalUrl tells whether app is served on localhost, where https is rarely
+// available
+func isLocalUrl(rawUrl string) bool {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return false
+	}
+	host := parsed.Hostname()
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
 }
 
 func init() {
@@ -65,15 +105,27 @@ func init() {
 	rootUrl := getEnvOrPanic("ROOT_URL", "http://localhost:8080")
 	zonesEnabled := getEnvOrPanic("STRAVA_ZONES_ENABLED", "false") == "true"
 	staticServerType := getEnvOrPanic("STATIC_SERVER_TYPE", api.RESOURCE_STATIC)
+	sessionSecret := getEnvOrPanic("STRAVA_SESSION_SECRET", "")
+	if len(sessionSecret) < minSessionSecretLength {
+		panic(fmt.Sprintf("STRAVA_SESSION_SECRET should be at least %v bytes long", minSessionSecretLength))
+	}
 
 	params := api.Params{
-		rootUrl,
-		clientId,
-		clientSecret,
-		resolveUrlFetchFunc,
-		newCacheFactory(),
-		zonesEnabled,
-		staticServerType,
+		RootUrl:                rootUrl,
+		ClientId:               clientId,
+		ClientSecret:           clientSecret,
+		RequestClientGenerator: resolveUrlFetchFunc,
+		ContextClientGenerator: resolveContextUrlFetchFunc,
+		BackgroundContext:      appengine.BackgroundContext,
+		RateLimits:             stravaRateLimits,
+		ActivityCacheAccessor:  newCacheFactory(),
+		SessionStoreAccessor:   newSessionStoreFactory(),
+		SessionSecret:          []byte(sessionSecret),
+		InsecureCookies:        appengine.IsDevAppServer() || isLocalUrl(rootUrl),
+		ListTTLPolicy:          cache.DEFAULT_LIST_TTL_POLICY,
+		ActivityTTLPolicy:      cache.DEFAULT_ACTIVITY_TTL_POLICY,
+		ZonesEnabled:           zonesEnabled,
+		StaticServerType:       staticServerType,
 	}
 	apiService := api.NewApi(params)
 	appService := api.NewApp(params)
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// crash-safe file writes
+
+// writeFileAtomic writes data into temporary file next to filename and
+// renames it over filename, so readers never observe partially written file.
+// Directories on the way from root are created if needed and synced, so the
+// new entry survives a crash.
+func writeFileAtomic(root string, filename string, data []byte, mode os.FileMode) error {
+	dir := path.Dir(filename)
+	_, statErr := os.Stat(dir)
+	dirCreated := os.IsNotExist(statErr)
+	if err := os.MkdirAll(dir, DEFAULT_DIR_MODE); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+path.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, mode); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, filename); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	if !dirCreated {
+		return syncDir(dir)
+	}
+	// newly created directories need their parents synced as well
+	root = path.Clean(root)
+	for {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+		if dir == root || dir == "." || dir == "/" {
+			return nil
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
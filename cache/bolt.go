@@ -0,0 +1,238 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/net/context"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// bbolt-based activity cache, keeps all entries in a single database file,
+// every write is a separate transaction
+
+var (
+	boltActivityListBucket = []byte("activity_lists")
+	boltActivityBucket     = []byte("activities")
+	boltSyncStateBucket    = []byte("sync_states")
+	boltHydrationBucket    = []byte("hydration_states")
+	boltStreamsBucket      = []byte("streams")
+)
+
+const DEFAULT_BOLT_FILENAME = "activity_cache.db"
+
+type BoltActivityCache struct {
+	db *bolt.DB
+}
+
+func NewDefaultBoltActivityCache() ActivityCache {
+	filename := path.Join(DEFAULT_CACHE_ROOT, DEFAULT_BOLT_FILENAME)
+	log.Printf("Using bolt cache file: %v", filename)
+	cache, err := NewBoltActivityCache(filename)
+	if err != nil {
+		panic(err.Error())
+	}
+	return cache
+}
+
+func NewBoltActivityCache(filename string) (*BoltActivityCache, error) {
+	if err := os.MkdirAll(path.Dir(filename), DEFAULT_DIR_MODE); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltActivityListBucket, boltActivityBucket, boltSyncStateBucket, boltStreamsBucket, boltHydrationBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltActivityCache{db}, nil
+}
+
+func (c *BoltActivityCache) Close() error {
+	return c.db.Close()
+}
+
+// keys are big-endian, so entries are ordered by id
+func boltKey(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+// activities are keyed by athlete id followed by activity id
+func boltActivityKey(athleteId int64, activityId int64) []byte {
+	return append(boltKey(athleteId), boltKey(activityId)...)
+}
+
+func (c *BoltActivityCache) put(bucket []byte, key []byte, goObject interface{}) error {
+	data, err := encodeEntry(goObject, EntryInfo{StoredAt: now()})
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put(key, data)
+	})
+}
+
+func (c *BoltActivityCache) get(bucket []byte, key []byte, kind string, id int64, goObject interface{}) (EntryInfo, error) {
+	var data []byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		// value is only valid inside transaction
+		if value := tx.Bucket(bucket).Get(key); value != nil {
+			data = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	if data == nil {
+		return EntryInfo{}, &NotFoundError{kind, id}
+	}
+	return decodeEntry(data, kind, id, goObject)
+}
+
+func (c *BoltActivityCache) Store(ctx context.Context, athleteId int64, activities ActivityList) error {
+	return c.put(boltActivityListBucket, boltKey(athleteId), activities)
+}
+
+func (c *BoltActivityCache) Get(ctx context.Context, athleteId int64) (ActivityList, EntryInfo, error) {
+	var activities ActivityList
+	info, err := c.get(boltActivityListBucket, boltKey(athleteId), KIND_ACTIVITY_LIST, athleteId, &activities)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return activities, info, nil
+}
+
+func (c *BoltActivityCache) StoreActivity(ctx context.Context, athleteId int64, activityId int64, activity *ExtendedActivityInfo) error {
+	return c.put(boltActivityBucket, boltActivityKey(athleteId, activityId), activity)
+}
+
+func (c *BoltActivityCache) GetActivity(ctx context.Context, athleteId int64, activityId int64) (*ExtendedActivityInfo, EntryInfo, error) {
+	var activity ExtendedActivityInfo
+	info, err := c.get(boltActivityBucket, boltActivityKey(athleteId, activityId), KIND_ACTIVITY, activityId, &activity)
+	if IsNotFound(err) {
+		return c.migrateLegacyActivity(athleteId, activityId)
+	} else if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	if !activity.OwnedBy(athleteId) {
+		return nil, EntryInfo{}, &NotFoundError{KIND_ACTIVITY, activityId}
+	}
+	return &activity, info, nil
+}
+
+// migrateLegacyActivity re-keys activity stored by activity id only,
+// if it is owned by the athlete
+func (c *BoltActivityCache) migrateLegacyActivity(athleteId int64, activityId int64) (*ExtendedActivityInfo, EntryInfo, error) {
+	var activity ExtendedActivityInfo
+	info, err := c.get(boltActivityBucket, boltKey(activityId), KIND_ACTIVITY, activityId, &activity)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	if !activity.OwnedBy(athleteId) {
+		return nil, EntryInfo{}, &NotFoundError{KIND_ACTIVITY, activityId}
+	}
+	data, err := encodeEntry(&activity, info)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltActivityBucket)
+		if err := bucket.Put(boltActivityKey(athleteId, activityId), data); err != nil {
+			return err
+		}
+		return bucket.Delete(boltKey(activityId))
+	})
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return &activity, info, nil
+}
+
+func (c *BoltActivityCache) StoreSyncState(ctx context.Context, athleteId int64, state *SyncState) error {
+	return c.put(boltSyncStateBucket, boltKey(athleteId), state)
+}
+
+func (c *BoltActivityCache) GetSyncState(ctx context.Context, athleteId int64) (*SyncState, error) {
+	var state SyncState
+	if _, err := c.get(boltSyncStateBucket, boltKey(athleteId), KIND_SYNC_STATE, athleteId, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (c *BoltActivityCache) StoreHydrationState(ctx context.Context, athleteId int64, state *HydrationState) error {
+	return c.put(boltHydrationBucket, boltKey(athleteId), state)
+}
+
+func (c *BoltActivityCache) GetHydrationState(ctx context.Context, athleteId int64) (*HydrationState, error) {
+	var state HydrationState
+	if _, err := c.get(boltHydrationBucket, boltKey(athleteId), KIND_HYDRATION, athleteId, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (c *BoltActivityCache) StoreStreams(ctx context.Context, athleteId int64, activityId int64, streams *ActivityStreams) error {
+	return c.put(boltStreamsBucket, boltActivityKey(athleteId, activityId), streams)
+}
+
+func (c *BoltActivityCache) GetStreams(ctx context.Context, athleteId int64, activityId int64) (*ActivityStreams, EntryInfo, error) {
+	var streams ActivityStreams
+	info, err := c.get(boltStreamsBucket, boltActivityKey(athleteId, activityId), KIND_STREAMS, activityId, &streams)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return &streams, info, nil
+}
+
+func (c *BoltActivityCache) ListAthletes(ctx context.Context) ([]int64, error) {
+	athleteIds := make([]int64, 0)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltActivityListBucket).ForEach(func(key, value []byte) error {
+			athleteIds = append(athleteIds, int64(binary.BigEndian.Uint64(key)))
+			return nil
+		})
+	})
+	return athleteIds, err
+}
+
+func (c *BoltActivityCache) ListActivities(ctx context.Context, athleteId int64) ([]int64, error) {
+	activityIds := make([]int64, 0)
+	seen := make(map[int64]bool)
+	prefix := boltKey(athleteId)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltActivityBucket, boltStreamsBucket} {
+			cursor := tx.Bucket(bucket).Cursor()
+			for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+				// legacy keys consist of activity id only
+				if len(key) != 2*len(prefix) {
+					continue
+				}
+				activityId := int64(binary.BigEndian.Uint64(key[len(prefix):]))
+				if !seen[activityId] {
+					seen[activityId] = true
+					activityIds = append(activityIds, activityId)
+				}
+			}
+		}
+		return nil
+	})
+	sortIds(activityIds)
+	return activityIds, err
+}
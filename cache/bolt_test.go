@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func newTestBoltCache(t *testing.T) (*BoltActivityCache, func()) {
+	cacheRoot, _ := ioutil.TempDir("", "activityCache")
+	cache, err := NewBoltActivityCache(path.Join(cacheRoot, DEFAULT_BOLT_FILENAME))
+	if err != nil {
+		os.RemoveAll(cacheRoot)
+		t.Fatal(err)
+	}
+	return cache, func() {
+		cache.Close()
+		os.RemoveAll(cacheRoot)
+	}
+}
+
+func TestBoltCacheEmptyReads(t *testing.T) {
+	cache, cleanup := newTestBoltCache(t)
+	defer cleanup()
+
+	if _, _, err := cache.Get(context.Background(), 1); !IsNotFound(err) {
+		t.Errorf("Get on empty cache should return NotFoundError, got %v", err)
+	}
+	if _, _, err := cache.GetActivity(context.Background(), 1, 1); !IsNotFound(err) {
+		t.Errorf("GetActivity on empty cache should return NotFoundError, got %v", err)
+	}
+	if _, err := cache.GetSyncState(context.Background(), 1); !IsNotFound(err) {
+		t.Errorf("GetSyncState on empty cache should return NotFoundError, got %v", err)
+	}
+}
+
+func TestBoltCacheRoundTrip(t *testing.T) {
+	cache, cleanup := newTestBoltCache(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	athleteId := int64(1234)
+	activityId := int64(12345)
+	activities := ActivityList{&strava.ActivitySummary{Id: activityId, Name: "My Activity"}}
+	if err := cache.Store(ctx, athleteId, activities); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _, err := cache.Get(ctx, athleteId)
+	if err != nil || len(loaded) != 1 || loaded[0].Name != "My Activity" {
+		t.Errorf("Expected stored list, got %v, %v", loaded, err)
+	}
+
+	activity := ownedActivity(athleteId, activityId)
+	activity.Activity.Name = "Test Name"
+	if err := cache.StoreActivity(ctx, athleteId, activityId, activity); err != nil {
+		t.Fatal(err)
+	}
+	loadedActivity, _, err := cache.GetActivity(ctx, athleteId, activityId)
+	if err != nil || loadedActivity.Activity.Name != "Test Name" {
+		t.Errorf("Expected stored activity, got %v, %v", loadedActivity, err)
+	}
+	if _, _, err := cache.GetActivity(ctx, athleteId+1, activityId); !IsNotFound(err) {
+		t.Errorf("Activity should not be visible to another athlete, got %v", err)
+	}
+}
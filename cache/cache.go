@@ -1,15 +1,28 @@
 package cache
 
 import (
+	"fmt"
 	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"time"
 )
 
 var DEFAULT_CACHE_IMPL string
 var DEFAULT_CACHE_ROOT string
+var DEFAULT_CACHE_FRONT string
+var DEFAULT_CACHE_FRONT_TTL time.Duration
+var DEFAULT_CACHE_COMPRESSION string
+var DEFAULT_GCS_ENDPOINT string
 var DEFAULT_FILE_MODE os.FileMode = 0655
 var DEFAULT_DIR_MODE os.FileMode = 0755
+var DEFAULT_LIST_TTL_POLICY TTLPolicy
+var DEFAULT_ACTIVITY_TTL_POLICY TTLPolicy
+var DEFAULT_MEMORY_MAX_ENTRIES int
+var DEFAULT_MEMORY_MAX_BYTES int64
 
 func init() {
 	DEFAULT_CACHE_ROOT = os.Getenv("STRAVA_CACHE_ROOT")
@@ -20,35 +33,262 @@ func init() {
 	if len(DEFAULT_CACHE_IMPL) == 0 {
 		DEFAULT_CACHE_IMPL = "memory"
 	}
+	DEFAULT_CACHE_COMPRESSION = os.Getenv("STRAVA_CACHE_COMPRESSION")
+	if len(DEFAULT_CACHE_COMPRESSION) == 0 {
+		DEFAULT_CACHE_COMPRESSION = ENCODING_GZIP
+	}
+	if _, err := compress(DEFAULT_CACHE_COMPRESSION, nil); err != nil {
+		panic("Unknown cache compression: " + DEFAULT_CACHE_COMPRESSION)
+	}
+	DEFAULT_GCS_ENDPOINT = os.Getenv("STRAVA_CACHE_GCS_ENDPOINT")
+	DEFAULT_CACHE_FRONT = os.Getenv("STRAVA_CACHE_FRONT")
+	DEFAULT_CACHE_FRONT_TTL = durationFromEnv("STRAVA_CACHE_FRONT_TTL", 5*time.Minute)
+	DEFAULT_LIST_TTL_POLICY = TTLPolicy{
+		TTL:      durationFromEnv("STRAVA_CACHE_LIST_TTL", time.Hour),
+		MaxStale: durationFromEnv("STRAVA_CACHE_LIST_MAX_STALE", 0),
+	}
+	DEFAULT_ACTIVITY_TTL_POLICY = TTLPolicy{
+		TTL:      durationFromEnv("STRAVA_CACHE_ACTIVITY_TTL", 0),
+		MaxStale: durationFromEnv("STRAVA_CACHE_ACTIVITY_MAX_STALE", 0),
+	}
+	DEFAULT_MEMORY_MAX_ENTRIES = int(intFromEnv("STRAVA_CACHE_MEMORY_MAX_ENTRIES", 10000))
+	DEFAULT_MEMORY_MAX_BYTES = intFromEnv("STRAVA_CACHE_MEMORY_MAX_BYTES", 0)
 }
 
+func intFromEnv(name string, defaultValue int64) int64 {
+	value := os.Getenv(name)
+	if len(value) == 0 {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		panic(fmt.Sprintf("Can not parse %s: %s", name, err.Error()))
+	}
+	return parsed
+}
+
+func durationFromEnv(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if len(value) == 0 {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		panic(fmt.Sprintf("Can not parse %s: %s", name, err.Error()))
+	}
+	return duration
+}
+
+// entry kinds, used in errors
+const (
+	KIND_ACTIVITY_LIST = "ActivityList"
+	KIND_ACTIVITY      = "Activity"
+	KIND_SYNC_STATE    = "SyncState"
+	KIND_STREAMS       = "Streams"
+	KIND_HYDRATION     = "Hydration"
+)
+
 type ActivityCache interface {
 	// store activity list for user
-	Store(int64, ActivityList)
+	Store(context.Context, int64, ActivityList) error
+
+	// get activity list for user and time it was stored,
+	// returns *NotFoundError if not present
+	Get(context.Context, int64) (ActivityList, EntryInfo, error)
+
+	// put activity of athlete into cache by athlete and activity id
+	StoreActivity(context.Context, int64, int64, *ExtendedActivityInfo) error
+
+	// get activity of athlete by athlete and activity id and time it was stored,
+	// returns *NotFoundError if not present or owned by another athlete
+	GetActivity(context.Context, int64, int64) (*ExtendedActivityInfo, EntryInfo, error)
 
-	// get activity list for user, returns (nil, false) if not present
-	Get(int64) (ActivityList, bool)
+	// store activity list sync state for user
+	StoreSyncState(context.Context, int64, *SyncState) error
 
-	// put activity into cache by id
-	StoreActivity(int64, *ExtendedActivityInfo)
+	// get activity list sync state for user, returns *NotFoundError if not present
+	GetSyncState(context.Context, int64) (*SyncState, error)
 
-	// get activity by id, returns (nil, false) if not present
-	GetActivity(int64) (*ExtendedActivityInfo, bool)
+	// put time series of activity of athlete into cache by athlete and activity id
+	StoreStreams(context.Context, int64, int64, *ActivityStreams) error
+
+	// get time series of activity of athlete and time they were stored,
+	// returns *NotFoundError if not present
+	GetStreams(context.Context, int64, int64) (*ActivityStreams, EntryInfo, error)
+
+	// store checkpoint of background retrieval of athlete activity details
+	StoreHydrationState(context.Context, int64, *HydrationState) error
+
+	// get checkpoint of activity details retrieval for user,
+	// returns *NotFoundError if not present
+	GetHydrationState(context.Context, int64) (*HydrationState, error)
+
+	// list ids of athletes having stored activity list
+	ListAthletes(context.Context) ([]int64, error)
+
+	// list ids of activities of athlete having details or streams stored
+	ListActivities(context.Context, int64) ([]int64, error)
 }
 
+// zone types reported by Strava
+const (
+	ZONES_HEARTRATE = "heartrate"
+	ZONES_POWER     = "power"
+)
+
 type ExtendedActivityInfo struct {
-	Activity     *strava.ActivityDetailed
+	Activity *strava.ActivityDetailed
+	// heart rate zones, the only ones kept by entries stored before Zones
 	ZonesSummary *strava.ZonesSummary
+	// all zone distributions of activity, nil if entry predates it
+	Zones []*strava.ZonesSummary
+}
+
+// HasAllZones tells whether entry keeps every zone type, older entries only
+// have heart rate zones.
+func (info *ExtendedActivityInfo) HasAllZones() bool {
+	return info.Zones != nil
+}
+
+// KnowsZones tells whether missing zones of given type mean activity has none,
+// rather than entry predating the type.
+func (info *ExtendedActivityInfo) KnowsZones(zoneType string) bool {
+	return info.HasAllZones() || zoneType == ZONES_HEARTRATE
+}
+
+// ZonesOfType returns zone distribution of given type, or nil if activity
+// has none.
+func (info *ExtendedActivityInfo) ZonesOfType(zoneType string) *strava.ZonesSummary {
+	for _, zones := range info.Zones {
+		if zones != nil && zones.Type == zoneType {
+			return zones
+		}
+	}
+	if zoneType == ZONES_HEARTRATE {
+		return info.ZonesSummary
+	}
+	return nil
+}
+
+// OwnedBy returns true if activity belongs to athlete.
+func (info *ExtendedActivityInfo) OwnedBy(athleteId int64) bool {
+	return info != nil && info.Activity != nil && info.Activity.Athlete.Id == athleteId
 }
 
 type ActivityList []*strava.ActivitySummary
 
+// SyncState describes how up to date is stored activity list.
+type SyncState struct {
+	// start date of the latest activity in the list
+	Watermark time.Time
+	// time when the list was downloaded from scratch
+	LastFullSync time.Time
+}
+
+// HydrationState is checkpoint of background retrieval of details of
+// athlete activities, so interrupted retrieval can be resumed.
+type HydrationState struct {
+	State string
+	// number of activities to retrieve
+	Total int
+	// ids of activities retrieved successfully
+	Processed []int64
+	// activities which could not be retrieved
+	Skipped   []HydrationSkip
+	StartedAt time.Time
+	UpdatedAt time.Time
+	Error     string
+}
+
+type HydrationSkip struct {
+	ActivityId int64
+	Code       string
+	Reason     string
+}
+
+// NotFoundError is returned when requested entry is not present in cache.
+type NotFoundError struct {
+	Kind string
+	Id   int64
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %v not found in cache", e.Kind, e.Id)
+}
+
+// DecodeError is returned when entry is present in cache, but can not be decoded.
+type DecodeError struct {
+	Kind string
+	Id   int64
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode cached %s %v: %s", e.Kind, e.Id, e.Err.Error())
+}
+
+// IsNotFound returns true if err means that entry is not present in cache.
+func IsNotFound(err error) bool {
+	_, ok := err.(*NotFoundError)
+	return ok
+}
+
+// IsDecodeError returns true if err means that cached entry is corrupt.
+func IsDecodeError(err error) bool {
+	_, ok := err.(*DecodeError)
+	return ok
+}
+
+// ConflictError is returned when entry was not written because it has been
+// modified concurrently since it was last read.
+type ConflictError struct {
+	Kind string
+	Id   int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s %v was modified concurrently", e.Kind, e.Id)
+}
+
+// IsConflict returns true if err means that concurrent write won.
+func IsConflict(err error) bool {
+	_, ok := err.(*ConflictError)
+	return ok
+}
+
+type int64Slice []int64
+
+func (a int64Slice) Len() int           { return len(a) }
+func (a int64Slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a int64Slice) Less(i, j int) bool { return a[i] < a[j] }
+
+func sortIds(ids []int64) {
+	sort.Sort(int64Slice(ids))
+}
+
+// parseIds converts names which are valid ids into sorted list of unique
+// ids, other names are skipped
+func parseIds(names []string) []int64 {
+	ids := make([]int64, 0, len(names))
+	seen := make(map[int64]bool)
+	for _, name := range names {
+		if id, err := strconv.ParseInt(name, 10, 64); err == nil && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sortIds(ids)
+	return ids
+}
+
 func NewActivityCache() ActivityCache {
-	log.Println("Using cache impl: %v", DEFAULT_CACHE_IMPL)
+	log.Printf("Using cache impl: %v", DEFAULT_CACHE_IMPL)
 	if DEFAULT_CACHE_IMPL == "memory" {
 		return NewMapActivityCache()
 	} else if DEFAULT_CACHE_IMPL == "file" {
-		return NewDefaultFileActivityCache()
+		return WithFrontCache(NewDefaultFileActivityCache())
+	} else if DEFAULT_CACHE_IMPL == "bolt" {
+		return WithFrontCache(NewDefaultBoltActivityCache())
 	} else {
 		panic("Unknown cache impl: " + DEFAULT_CACHE_IMPL)
 	}
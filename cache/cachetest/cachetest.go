@@ -0,0 +1,479 @@
+// Package cachetest contains conformance tests which every
+// cache.ActivityCache implementation is expected to pass.
+//
+// Backend tests call Run with a function creating new empty cache:
+//
+//	func TestConformance(t *testing.T) {
+//		cachetest.Run(t, func(t *testing.T) cache.ActivityCache {
+//			return newEmptyCache(t)
+//		})
+//	}
+package cachetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Factory returns new empty cache, called once per test case.
+type Factory func(t *testing.T) cache.ActivityCache
+
+// list sizes around DATASTORE_PAGE_SIZE, which is the largest page size used
+// by backends
+var pagingSizes = []int{
+	0,
+	1,
+	cache.DATASTORE_PAGE_SIZE - 1,
+	cache.DATASTORE_PAGE_SIZE,
+	cache.DATASTORE_PAGE_SIZE + 1,
+	2 * cache.DATASTORE_PAGE_SIZE,
+	2*cache.DATASTORE_PAGE_SIZE + 1,
+}
+
+// Run runs all conformance tests against caches created by newCache.
+func Run(t *testing.T, newCache Factory) {
+	t.Run("MissingKeys", func(t *testing.T) { testMissingKeys(t, newCache(t)) })
+	t.Run("ActivityListRoundTrip", func(t *testing.T) { testActivityListRoundTrip(t, newCache(t)) })
+	t.Run("EmptyActivityList", func(t *testing.T) { testEmptyActivityList(t, newCache(t)) })
+	t.Run("ActivityListOverwrite", func(t *testing.T) { testActivityListOverwrite(t, newCache(t)) })
+	t.Run("ActivityListPaging", func(t *testing.T) { testActivityListPaging(t, newCache) })
+	t.Run("ActivityListShrinks", func(t *testing.T) { testActivityListShrinks(t, newCache(t)) })
+	t.Run("ActivityRoundTrip", func(t *testing.T) { testActivityRoundTrip(t, newCache(t)) })
+	t.Run("ActivityOverwrite", func(t *testing.T) { testActivityOverwrite(t, newCache(t)) })
+	t.Run("ActivityOwnership", func(t *testing.T) { testActivityOwnership(t, newCache(t)) })
+	t.Run("StreamsRoundTrip", func(t *testing.T) { testStreamsRoundTrip(t, newCache(t)) })
+	t.Run("SyncStateRoundTrip", func(t *testing.T) { testSyncStateRoundTrip(t, newCache(t)) })
+	t.Run("HydrationStateRoundTrip", func(t *testing.T) { testHydrationStateRoundTrip(t, newCache(t)) })
+	t.Run("StoredAt", func(t *testing.T) { testStoredAt(t, newCache(t)) })
+	t.Run("Enumeration", func(t *testing.T) { testEnumeration(t, newCache(t)) })
+	t.Run("ConcurrentAccess", func(t *testing.T) { testConcurrentAccess(t, newCache(t)) })
+}
+
+// Activities returns list of n distinct activities of athlete, newest first.
+func Activities(athleteId int64, n int) cache.ActivityList {
+	start := time.Date(2017, 1, 1, 8, 0, 0, 0, time.UTC)
+	activities := make(cache.ActivityList, 0, n)
+	for i := n - 1; i >= 0; i-- {
+		startDate := start.Add(time.Duration(i) * 24 * time.Hour)
+		activities = append(activities, &strava.ActivitySummary{
+			Id:                 athleteId*1000000 + int64(i),
+			Athlete:            strava.AthleteSummary{AthleteMeta: strava.AthleteMeta{Id: athleteId}},
+			Name:               fmt.Sprintf("Activity %v", i),
+			Distance:           1000.5 * float64(i),
+			MovingTime:         60 * i,
+			ElapsedTime:        70 * i,
+			TotalElevationGain: 10.25 * float64(i),
+			Type:               "Ride",
+			StartDate:          startDate,
+			StartDateLocal:     startDate.Add(time.Hour),
+			TimeZone:           "(GMT+01:00) Europe/Berlin",
+			Trainer:            i%3 == 0,
+			Commute:            i%5 == 0,
+			Private:            i%7 == 0,
+			GearId:             "b12345",
+		})
+	}
+	return activities
+}
+
+// Activity returns detailed activity with heart rate and power zones owned
+// by athlete.
+func Activity(athleteId int64, activityId int64) *cache.ExtendedActivityInfo {
+	startDate := time.Date(2017, 1, 1, 8, 0, 0, 0, time.UTC)
+	heartrate := &strava.ZonesSummary{
+		Score: 42,
+		Type:  "heartrate",
+		Buckets: []*strava.ZoneBucket{
+			{Min: 0, Max: 120, Time: 600},
+			{Min: 120, Max: 150, Time: 2400},
+			{Min: 150, Max: -1, Time: 600},
+		},
+		SensorBased: true,
+		CustonZones: true,
+	}
+	power := &strava.ZonesSummary{
+		Type: "power",
+		Buckets: []*strava.ZoneBucket{
+			{Min: 0, Max: 150, Time: 1200},
+			{Min: 150, Max: 250, Time: 1800},
+			{Min: 250, Max: -1, Time: 600},
+		},
+		SensorBased: true,
+	}
+	return &cache.ExtendedActivityInfo{
+		Activity: &strava.ActivityDetailed{
+			ActivitySummary: strava.ActivitySummary{
+				Id:             activityId,
+				Athlete:        strava.AthleteSummary{AthleteMeta: strava.AthleteMeta{Id: athleteId}},
+				Name:           "Morning Ride",
+				Distance:       42195.5,
+				MovingTime:     3600,
+				Type:           "Ride",
+				StartDate:      startDate,
+				StartDateLocal: startDate.Add(time.Hour),
+			},
+			Description: "Detailed description",
+		},
+		ZonesSummary: heartrate,
+		Zones:        []*strava.ZonesSummary{heartrate, power},
+	}
+}
+
+// assertJsonEqual compares json representations, which is what cache
+// backends promise to preserve
+func assertJsonEqual(t *testing.T, what string, expected interface{}, actual interface{}) {
+	expectedJson, err := json.Marshal(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actualJson, err := json.Marshal(actual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expectedJson, actualJson) {
+		t.Errorf("%s differs after round trip:\nexpected %s\nactual   %s", what, expectedJson, actualJson)
+	}
+}
+
+func testMissingKeys(t *testing.T, c cache.ActivityCache) {
+	ctx := context.Background()
+	if _, _, err := c.Get(ctx, 1); !cache.IsNotFound(err) {
+		t.Errorf("Get of missing list should return NotFoundError, got %v", err)
+	}
+	if _, _, err := c.GetActivity(ctx, 1, 10); !cache.IsNotFound(err) {
+		t.Errorf("GetActivity of missing activity should return NotFoundError, got %v", err)
+	}
+	if _, err := c.GetSyncState(ctx, 1); !cache.IsNotFound(err) {
+		t.Errorf("GetSyncState of missing state should return NotFoundError, got %v", err)
+	}
+	if _, _, err := c.GetStreams(ctx, 1, 10); !cache.IsNotFound(err) {
+		t.Errorf("GetStreams of missing streams should return NotFoundError, got %v", err)
+	}
+	if _, err := c.GetHydrationState(ctx, 1); !cache.IsNotFound(err) {
+		t.Errorf("GetHydrationState of missing state should return NotFoundError, got %v", err)
+	}
+	if athletes, err := c.ListAthletes(ctx); err != nil || len(athletes) != 0 {
+		t.Errorf("Empty cache should have no athletes, got %v, %v", athletes, err)
+	}
+	if activities, err := c.ListActivities(ctx, 1); err != nil || len(activities) != 0 {
+		t.Errorf("Empty cache should have no activities, got %v, %v", activities, err)
+	}
+}
+
+func testActivityListRoundTrip(t *testing.T, c cache.ActivityCache) {
+	ctx := context.Background()
+	expected := Activities(1, 3)
+	if err := c.Store(ctx, 1, expected); err != nil {
+		t.Fatal(err)
+	}
+	actual, _, err := c.Get(ctx, 1)
+	if err != nil {
+		t.Fatalf("Get after Store should succeed, got %v", err)
+	}
+	assertJsonEqual(t, "activity list", expected, actual)
+	if _, _, err := c.Get(ctx, 2); !cache.IsNotFound(err) {
+		t.Errorf("List of another athlete should not be found, got %v", err)
+	}
+}
+
+func testEmptyActivityList(t *testing.T, c cache.ActivityCache) {
+	ctx := context.Background()
+	if err := c.Store(ctx, 1, cache.ActivityList{}); err != nil {
+		t.Fatal(err)
+	}
+	actual, _, err := c.Get(ctx, 1)
+	if err != nil {
+		t.Fatalf("Empty list should be found, got %v", err)
+	}
+	if len(actual) != 0 {
+		t.Errorf("Expected empty list, got %v", actual)
+	}
+}
+
+func testActivityListOverwrite(t *testing.T, c cache.ActivityCache) {
+	ctx := context.Background()
+	c.Store(ctx, 1, Activities(1, 2))
+	expected := Activities(1, 5)
+	expected[0].Name = "Renamed"
+	if err := c.Store(ctx, 1, expected); err != nil {
+		t.Fatal(err)
+	}
+	actual, _, err := c.Get(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJsonEqual(t, "overwritten activity list", expected, actual)
+}
+
+func testActivityListPaging(t *testing.T, newCache Factory) {
+	for _, size := range pagingSizes {
+		t.Run(fmt.Sprintf("%v", size), func(t *testing.T) {
+			c := newCache(t)
+			ctx := context.Background()
+			expected := Activities(1, size)
+			if err := c.Store(ctx, 1, expected); err != nil {
+				t.Fatal(err)
+			}
+			actual, _, err := c.Get(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(actual) != size {
+				t.Fatalf("Expected %v activities, got %v", size, len(actual))
+			}
+			assertJsonEqual(t, "activity list", expected, actual)
+		})
+	}
+}
+
+func testActivityListShrinks(t *testing.T, c cache.ActivityCache) {
+	ctx := context.Background()
+	c.Store(ctx, 1, Activities(1, 2*cache.DATASTORE_PAGE_SIZE+1))
+	for _, size := range []int{cache.DATASTORE_PAGE_SIZE + 1, cache.DATASTORE_PAGE_SIZE, 1, 0} {
+		expected := Activities(1, size)
+		if err := c.Store(ctx, 1, expected); err != nil {
+			t.Fatal(err)
+		}
+		actual, _, err := c.Get(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(actual) != size {
+			t.Fatalf("Expected %v activities after shrinking, got %v", size, len(actual))
+		}
+		assertJsonEqual(t, "shrunk activity list", expected, actual)
+	}
+}
+
+func testActivityRoundTrip(t *testing.T, c cache.ActivityCache) {
+	ctx := context.Background()
+	expected := Activity(1, 10)
+	if err := c.StoreActivity(ctx, 1, 10, expected); err != nil {
+		t.Fatal(err)
+	}
+	actual, _, err := c.GetActivity(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("GetActivity after StoreActivity should succeed, got %v", err)
+	}
+	assertJsonEqual(t, "activity", expected, actual)
+	if _, _, err := c.GetActivity(ctx, 1, 11); !cache.IsNotFound(err) {
+		t.Errorf("Another activity should not be found, got %v", err)
+	}
+}
+
+func testActivityOverwrite(t *testing.T, c cache.ActivityCache) {
+	ctx := context.Background()
+	c.StoreActivity(ctx, 1, 10, Activity(1, 10))
+	expected := Activity(1, 10)
+	expected.Activity.Name = "Renamed"
+	expected.ZonesSummary = nil
+	expected.Zones = []*strava.ZonesSummary{}
+	if err := c.StoreActivity(ctx, 1, 10, expected); err != nil {
+		t.Fatal(err)
+	}
+	actual, _, err := c.GetActivity(ctx, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJsonEqual(t, "overwritten activity", expected, actual)
+	if !actual.HasAllZones() {
+		t.Errorf("Activity without zones should not look like entry predating zone types")
+	}
+}
+
+func testActivityOwnership(t *testing.T, c cache.ActivityCache) {
+	ctx := context.Background()
+	c.StoreActivity(ctx, 1, 10, Activity(1, 10))
+	if _, _, err := c.GetActivity(ctx, 2, 10); !cache.IsNotFound(err) {
+		t.Errorf("Activity should not be visible to another athlete, got %v", err)
+	}
+	// activity of athlete 1 stored under athlete 2
+	c.StoreActivity(ctx, 2, 20, Activity(1, 20))
+	if _, _, err := c.GetActivity(ctx, 2, 20); !cache.IsNotFound(err) {
+		t.Errorf("Activity owned by another athlete should not be returned, got %v", err)
+	}
+}
+
+// Streams returns n samples of every stream, values are representable
+// in cached precision.
+func Streams(n int) *cache.ActivityStreams {
+	streams := &cache.ActivityStreams{
+		Time:      make([]int, n),
+		Distance:  make([]float64, n),
+		Altitude:  make([]float64, n),
+		LatLng:    make([][2]float64, n),
+		Heartrate: make([]int, n),
+		Cadence:   make([]int, n),
+		Watts:     make([]int, n),
+	}
+	for i := 0; i < n; i++ {
+		streams.Time[i] = i
+		streams.Distance[i] = 7.25 * float64(i)
+		streams.Altitude[i] = 100.5 - 0.25*float64(i%40)
+		streams.LatLng[i] = [2]float64{float64(5251630+i) / 1e5, float64(1337770-2*i) / 1e5}
+		streams.Heartrate[i] = 120 + i%60
+		streams.Cadence[i] = 85 + i%10
+		streams.Watts[i] = 180 + (i*37)%150
+	}
+	return streams
+}
+
+func testStreamsRoundTrip(t *testing.T, c cache.ActivityCache) {
+	ctx := context.Background()
+	expected := Streams(3600)
+	// streams without power meter
+	expected.Watts = nil
+	if err := c.StoreStreams(ctx, 1, 10, expected); err != nil {
+		t.Fatal(err)
+	}
+	actual, info, err := c.GetStreams(ctx, 1, 10)
+	if err != nil {
+		t.Fatalf("GetStreams after StoreStreams should succeed, got %v", err)
+	}
+	assertJsonEqual(t, "streams", expected, actual)
+	if info.StoredAt.IsZero() {
+		t.Error("Streams should have write time set")
+	}
+	if _, _, err := c.GetStreams(ctx, 2, 10); !cache.IsNotFound(err) {
+		t.Errorf("Streams should not be visible to another athlete, got %v", err)
+	}
+}
+
+func testSyncStateRoundTrip(t *testing.T, c cache.ActivityCache) {
+	ctx := context.Background()
+	expected := &cache.SyncState{
+		Watermark:    time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC),
+		LastFullSync: time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if err := c.StoreSyncState(ctx, 1, expected); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := c.GetSyncState(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !actual.Watermark.Equal(expected.Watermark) || !actual.LastFullSync.Equal(expected.LastFullSync) {
+		t.Errorf("Expected %+v, got %+v", expected, actual)
+	}
+}
+
+func testHydrationStateRoundTrip(t *testing.T, c cache.ActivityCache) {
+	ctx := context.Background()
+	expected := &cache.HydrationState{
+		State:     "running",
+		Total:     5,
+		Processed: []int64{10, 20},
+		Skipped:   []cache.HydrationSkip{{ActivityId: 30, Code: "timeout", Reason: "Activity was not loaded in time"}},
+		StartedAt: time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC),
+		UpdatedAt: time.Date(2017, 3, 4, 5, 7, 0, 0, time.UTC),
+	}
+	if err := c.StoreHydrationState(ctx, 1, expected); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := c.GetHydrationState(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJsonEqual(t, "hydration state", expected, actual)
+	if _, err := c.GetHydrationState(ctx, 2); !cache.IsNotFound(err) {
+		t.Errorf("Hydration state should not be visible to another athlete, got %v", err)
+	}
+	// checkpoint alone does not make athlete enumerable
+	if athletes, err := c.ListAthletes(ctx); err != nil || len(athletes) != 0 {
+		t.Errorf("Expected no athletes, got %v, %v", athletes, err)
+	}
+}
+
+func testStoredAt(t *testing.T, c cache.ActivityCache) {
+	ctx := context.Background()
+	before := time.Now().Add(-time.Minute)
+	c.Store(ctx, 1, Activities(1, 1))
+	c.StoreActivity(ctx, 1, 10, Activity(1, 10))
+	if _, info, err := c.Get(ctx, 1); err != nil || info.StoredAt.Before(before) {
+		t.Errorf("List should have write time set, got %v, %v", info.StoredAt, err)
+	}
+	if _, info, err := c.GetActivity(ctx, 1, 10); err != nil || info.StoredAt.Before(before) {
+		t.Errorf("Activity should have write time set, got %v, %v", info.StoredAt, err)
+	}
+}
+
+func testEnumeration(t *testing.T, c cache.ActivityCache) {
+	ctx := context.Background()
+	c.Store(ctx, 2, Activities(2, 1))
+	c.Store(ctx, 1, Activities(1, 1))
+	c.StoreActivity(ctx, 1, 20, Activity(1, 20))
+	c.StoreActivity(ctx, 1, 10, Activity(1, 10))
+	c.StoreActivity(ctx, 2, 30, Activity(2, 30))
+	// streams can be stored without details
+	c.StoreStreams(ctx, 1, 5, Streams(1))
+	c.StoreStreams(ctx, 1, 10, Streams(1))
+	// athlete without activity list is not listed
+	c.StoreActivity(ctx, 3, 40, Activity(3, 40))
+	c.StoreStreams(ctx, 3, 40, Streams(3))
+
+	athletes, err := c.ListAthletes(ctx)
+	if err != nil || fmt.Sprint(athletes) != "[1 2]" {
+		t.Errorf("Expected athletes [1 2], got %v, %v", athletes, err)
+	}
+	activities, err := c.ListActivities(ctx, 1)
+	if err != nil || fmt.Sprint(activities) != "[5 10 20]" {
+		t.Errorf("Expected activities [5 10 20], got %v, %v", activities, err)
+	}
+	if activities, err := c.ListActivities(ctx, 4); err != nil || len(activities) != 0 {
+		t.Errorf("Expected no activities, got %v, %v", activities, err)
+	}
+}
+
+func testConcurrentAccess(t *testing.T, c cache.ActivityCache) {
+	ctx := context.Background()
+	const workers = 8
+	const iterations = 10
+	var wg sync.WaitGroup
+	errors := make(chan error, workers*iterations*4)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// every worker writes its own keys and shares athlete 1 with others
+			athleteId := int64(w + 1)
+			for i := 0; i < iterations; i++ {
+				activityId := int64(i + 1)
+				if err := c.Store(ctx, athleteId, Activities(athleteId, i+1)); err != nil {
+					errors <- err
+				}
+				if err := c.StoreActivity(ctx, athleteId, activityId, Activity(athleteId, activityId)); err != nil {
+					errors <- err
+				}
+				if list, _, err := c.Get(ctx, 1); err != nil && !cache.IsNotFound(err) {
+					errors <- err
+				} else if err == nil && len(list) == 0 {
+					errors <- fmt.Errorf("list of athlete 1 should never be empty")
+				}
+				if activity, _, err := c.GetActivity(ctx, athleteId, activityId); err != nil {
+					errors <- err
+				} else if activity.Activity.Id != activityId {
+					errors <- fmt.Errorf("expected activity %v, got %v", activityId, activity.Activity.Id)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errors)
+	for err := range errors {
+		t.Error(err)
+	}
+	for w := 0; w < workers; w++ {
+		athleteId := int64(w + 1)
+		list, _, err := c.Get(ctx, athleteId)
+		if err != nil || len(list) != iterations {
+			t.Errorf("Expected %v activities of athlete %v, got %v, %v", iterations, athleteId, len(list), err)
+		}
+	}
+}
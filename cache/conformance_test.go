@@ -0,0 +1,87 @@
+package cache_test
+
+import (
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"github.com/chemikadze/strava-analysis-ui/cache/cachetest"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "activityCache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestMapCacheConformance(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.ActivityCache {
+		return cache.NewMapActivityCache()
+	})
+}
+
+func TestBoundedMapCacheConformance(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.ActivityCache {
+		return cache.NewBoundedMapActivityCache(1000, 64*1024*1024)
+	})
+}
+
+func TestFileCacheConformance(t *testing.T) {
+	var dirs []string
+	defer func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}()
+	cachetest.Run(t, func(t *testing.T) cache.ActivityCache {
+		dir := tempDir(t)
+		dirs = append(dirs, dir)
+		return cache.NewFileActivityCache(dir)
+	})
+}
+
+func TestBoltCacheConformance(t *testing.T) {
+	var dirs []string
+	var caches []*cache.BoltActivityCache
+	defer func() {
+		for _, c := range caches {
+			c.Close()
+		}
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}()
+	cachetest.Run(t, func(t *testing.T) cache.ActivityCache {
+		dir := tempDir(t)
+		dirs = append(dirs, dir)
+		c, err := cache.NewBoltActivityCache(path.Join(dir, cache.DEFAULT_BOLT_FILENAME))
+		if err != nil {
+			t.Fatal(err)
+		}
+		caches = append(caches, c)
+		return c
+	})
+}
+
+func TestTieredCacheConformance(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.ActivityCache {
+		return cache.NewTieredActivityCache(
+			cache.NewBoundedMapActivityCache(0, 0), cache.NewFakeDatastoreActivityCache(), time.Minute)
+	})
+}
+
+func TestDatastoreCacheConformance(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.ActivityCache {
+		return cache.NewFakeDatastoreActivityCache()
+	})
+}
+
+func TestGoogleStorageCacheConformance(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) cache.ActivityCache {
+		return cache.NewFakeGoogleStorageActivityCache("cache")
+	})
+}
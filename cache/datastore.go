@@ -1,63 +1,204 @@
 package cache
 
 import (
-	"encoding/json"
 	"fmt"
 	"golang.org/x/net/context"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
+	"sync/atomic"
+	"time"
 )
 
 // datastore-based activity cache
 
 const DATASTORE_PAGE_SIZE = 50
 
+// datastore rejects batch operations with more entities
+const DATASTORE_MAX_BATCH = 500
+
 type DatastoreActivityCache struct {
-	ctx context.Context
+	client datastoreClient
+}
+
+func NewDatastoreActivityCache() ActivityCache {
+	return &DatastoreActivityCache{appengineDatastore{}}
+}
+
+// datastoreClient is the part of datastore API used by the cache,
+// replaced with in-memory fake in tests
+type datastoreClient interface {
+	// returns datastore.ErrNoSuchEntity if entity is not present
+	Get(ctx context.Context, k *datastore.Key, e *DatastoreJsonEntity) error
+
+	Put(ctx context.Context, k *datastore.Key, e *DatastoreJsonEntity) error
+
+	Delete(ctx context.Context, k *datastore.Key) error
+
+	// returns appengine.MultiError with datastore.ErrNoSuchEntity for entities
+	// which are not present
+	GetMulti(ctx context.Context, keys []*datastore.Key, entities []*DatastoreJsonEntity) error
+
+	PutMulti(ctx context.Context, keys []*datastore.Key, entities []*DatastoreJsonEntity) error
+
+	DeleteMulti(ctx context.Context, keys []*datastore.Key) error
+
+	// runs f in transaction, operations using transaction context are
+	// committed atomically
+	RunInTransaction(ctx context.Context, f func(tc context.Context) error) error
+
+	// keys of all entities of kind, only descendants of ancestor if it is not nil
+	Keys(ctx context.Context, kind string, ancestor *datastore.Key) ([]*datastore.Key, error)
 }
 
-func NewDatastoreActivityCache(ctx context.Context) ActivityCache {
-	return &DatastoreActivityCache{ctx}
+type appengineDatastore struct{}
+
+func (appengineDatastore) Get(ctx context.Context, k *datastore.Key, e *DatastoreJsonEntity) error {
+	return datastore.Get(ctx, k, e)
+}
+
+func (appengineDatastore) Put(ctx context.Context, k *datastore.Key, e *DatastoreJsonEntity) error {
+	_, err := datastore.Put(ctx, k, e)
+	return err
+}
+
+func (appengineDatastore) Delete(ctx context.Context, k *datastore.Key) error {
+	return datastore.Delete(ctx, k)
+}
+
+func (appengineDatastore) GetMulti(ctx context.Context, keys []*datastore.Key, entities []*DatastoreJsonEntity) error {
+	return datastore.GetMulti(ctx, keys, entities)
+}
+
+func (appengineDatastore) PutMulti(ctx context.Context, keys []*datastore.Key, entities []*DatastoreJsonEntity) error {
+	_, err := datastore.PutMulti(ctx, keys, entities)
+	return err
+}
+
+func (appengineDatastore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	return datastore.DeleteMulti(ctx, keys)
+}
+
+func (appengineDatastore) RunInTransaction(ctx context.Context, f func(tc context.Context) error) error {
+	return datastore.RunInTransaction(ctx, f, nil)
+}
+
+func (appengineDatastore) Keys(ctx context.Context, kind string, ancestor *datastore.Key) ([]*datastore.Key, error) {
+	q := datastore.NewQuery(kind).KeysOnly()
+	if ancestor != nil {
+		q = q.Ancestor(ancestor)
+	}
+	return q.GetAll(ctx, nil)
 }
 
 type DatastoreJsonEntity struct {
+	// plain json written before envelopes were introduced
 	JsonPayload string `datastore:",noindex"`
+	// envelope written by encodeEntry
+	Payload  []byte `datastore:",noindex"`
+	StoredAt time.Time
 }
 
+const kindPagedMetadata = "PagedEntityMetadata"
+
+// PagedEntityMetadata points to complete generation of pages of paged
+// entity. Pages of new generation are written before metadata is switched
+// to it, so readers never see mix of old and new pages.
 type PagedEntityMetadata struct {
 	PageCount int
+	// zero for pages written before generations were introduced
+	Generation int64
 }
 
-func (c *DatastoreActivityCache) storeEntity(entityName string, id interface{}, entity interface{}) {
-	k := datastore.NewKey(c.ctx, entityName, fmt.Sprintf("%v", id), 0, nil)
+// number of attempts to read paged entity, pages read by one attempt may be
+// garbage-collected by concurrent write
+const DATASTORE_PAGED_GET_ATTEMPTS = 3
+
+func entityKey(ctx context.Context, entityName string, id interface{}, parent *datastore.Key) *datastore.Key {
+	return datastore.NewKey(ctx, entityName, fmt.Sprintf("%v", id), 0, parent)
+}
 
-	data, err := json.Marshal(entity)
+// activities are stored as children of their athlete
+func athleteKey(ctx context.Context, athleteId int64) *datastore.Key {
+	return entityKey(ctx, "Athlete", athleteId, nil)
+}
+
+func (c *DatastoreActivityCache) storeEntity(ctx context.Context, entityName string, id interface{}, entity interface{}) error {
+	return c.storeEntityAtKey(ctx, entityKey(ctx, entityName, id, nil), entity)
+}
+
+func newJsonEntity(entity interface{}) (*DatastoreJsonEntity, error) {
+	e := new(DatastoreJsonEntity)
+	e.StoredAt = now()
+	data, err := encodeEntry(entity, EntryInfo{StoredAt: e.StoredAt})
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
-	e := new(DatastoreJsonEntity)
-	e.JsonPayload = string(data)
-	if _, err := datastore.Put(c.ctx, k, e); err != nil {
-		panic(err.Error())
+	e.Payload = data
+	return e, nil
+}
+
+func (c *DatastoreActivityCache) storeEntityAtKey(ctx context.Context, k *datastore.Key, entity interface{}) error {
+	e, err := newJsonEntity(entity)
+	if err != nil {
+		return err
 	}
+	return c.client.Put(ctx, k, e)
+}
+
+func (c *DatastoreActivityCache) retrieveEntity(ctx context.Context, kind string, entityId int64, entityName string, id interface{}, entity interface{}) (EntryInfo, error) {
+	return c.retrieveEntityAtKey(ctx, kind, entityId, entityKey(ctx, entityName, id, nil), entity)
 }
 
-func (c *DatastoreActivityCache) retrieveEntity(entityName string, id interface{}, entity interface{}) (found bool) {
-	k := datastore.NewKey(c.ctx, entityName, fmt.Sprintf("%v", id), 0, nil)
+func (c *DatastoreActivityCache) retrieveEntityAtKey(ctx context.Context, kind string, entityId int64, k *datastore.Key, entity interface{}) (EntryInfo, error) {
 	e := new(DatastoreJsonEntity)
-	if err := datastore.Get(c.ctx, k, e); err != nil {
-		return false
-	} else {
-		err = json.Unmarshal([]byte(e.JsonPayload), &entity)
-		if err != nil {
-			panic(err.Error())
+	if err := c.client.Get(ctx, k, e); err == datastore.ErrNoSuchEntity {
+		return EntryInfo{}, &NotFoundError{kind, entityId}
+	} else if err != nil {
+		return EntryInfo{}, err
+	}
+	return decodeJsonEntity(e, kind, entityId, entity)
+}
+
+func decodeJsonEntity(e *DatastoreJsonEntity, kind string, entityId int64, entity interface{}) (EntryInfo, error) {
+	if len(e.Payload) == 0 {
+		// legacy entity, metadata is kept in properties
+		if _, err := decodeEntry([]byte(e.JsonPayload), kind, entityId, entity); err != nil {
+			return EntryInfo{}, err
+		}
+		return EntryInfo{StoredAt: e.StoredAt}, nil
+	}
+	return decodeEntry(e.Payload, kind, entityId, entity)
+}
+
+var lastGeneration int64
+
+// nextGeneration returns write time based generation, unique within process
+func nextGeneration() int64 {
+	for {
+		last := atomic.LoadInt64(&lastGeneration)
+		generation := now().UnixNano()
+		if generation <= last {
+			generation = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastGeneration, last, generation) {
+			return generation
 		}
-		return true
 	}
 }
 
-func pageId(entityId interface{}, pageId int) string {
-	return fmt.Sprintf("%v_page%v", entityId, pageId)
+func pageId(entityId interface{}, generation int64, pageId int) string {
+	if generation == 0 {
+		return fmt.Sprintf("%v_page%v", entityId, pageId)
+	}
+	return fmt.Sprintf("%v_gen%v_page%v", entityId, generation, pageId)
+}
+
+func pageKeys(ctx context.Context, entityName string, entityId interface{}, metadata PagedEntityMetadata) []*datastore.Key {
+	keys := make([]*datastore.Key, 0, metadata.PageCount)
+	for pageNum := 1; pageNum <= metadata.PageCount; pageNum++ {
+		keys = append(keys, entityKey(ctx, entityName, pageId(entityId, metadata.Generation, pageNum), nil))
+	}
+	return keys
 }
 
 func min(a, b int) int {
@@ -68,46 +209,223 @@ func min(a, b int) int {
 	}
 }
 
-func (c *DatastoreActivityCache) Store(athleteId int64, activities ActivityList) {
-	pageCount := len(activities)/DATASTORE_PAGE_SIZE + 1
-	for pageNum := 1; pageNum <= pageCount; pageNum++ {
+// deletePages removes pages which are not referenced by metadata, failure
+// only leaves garbage behind
+func (c *DatastoreActivityCache) deletePages(ctx context.Context, keys []*datastore.Key) {
+	for start := 0; start < len(keys); start += DATASTORE_MAX_BATCH {
+		batch := keys[start:min(start+DATASTORE_MAX_BATCH, len(keys))]
+		if err := c.client.DeleteMulti(ctx, batch); err != nil {
+			warningf(ctx, "Failed to delete %v unreferenced pages starting with %v: %v", len(batch), batch[0].StringID(), err)
+		}
+	}
+}
+
+func (c *DatastoreActivityCache) Store(ctx context.Context, athleteId int64, activities ActivityList) error {
+	metadata := PagedEntityMetadata{
+		PageCount:  (len(activities) + DATASTORE_PAGE_SIZE - 1) / DATASTORE_PAGE_SIZE,
+		Generation: nextGeneration(),
+	}
+	keys := pageKeys(ctx, "ActivityList", athleteId, metadata)
+	pages := make([]*DatastoreJsonEntity, 0, len(keys))
+	for pageNum := 1; pageNum <= metadata.PageCount; pageNum++ {
 		start := DATASTORE_PAGE_SIZE * (pageNum - 1)
 		end := min(DATASTORE_PAGE_SIZE*pageNum, len(activities))
-		log.Debugf(c.ctx, "Storing ActivityList page %s", pageId(athleteId, pageNum))
-		c.storeEntity("ActivityList", pageId(athleteId, pageNum), activities[start:end])
-	}
-	c.storeEntity("ActivityList", athleteId, PagedEntityMetadata{PageCount: pageCount})
-}
-
-func (c *DatastoreActivityCache) Get(athleteId int64) (ActivityList, bool) {
-	var metadata PagedEntityMetadata
-	if c.retrieveEntity("ActivityList", athleteId, &metadata) {
-		var activities ActivityList
-		for pageNum := 1; pageNum <= metadata.PageCount; pageNum++ {
-			log.Debugf(c.ctx, "Loading ActivityList page %s", pageId(athleteId, pageNum))
-			var pageActivities ActivityList
-			if c.retrieveEntity("ActivityList", pageId(athleteId, pageNum), &pageActivities) {
-				activities = append(activities, pageActivities...)
-			} else {
-				log.Warningf(c.ctx, "Found broken paged ActivityList: %s did not have page %s", athleteId, pageNum)
-				return nil, false
+		page, err := newJsonEntity(activities[start:end])
+		if err != nil {
+			return err
+		}
+		pages = append(pages, page)
+	}
+	debugf(ctx, "Storing %v ActivityList pages of generation %v", len(pages), metadata.Generation)
+	for start := 0; start < len(pages); start += DATASTORE_MAX_BATCH {
+		end := min(start+DATASTORE_MAX_BATCH, len(pages))
+		if err := c.client.PutMulti(ctx, keys[start:end], pages[start:end]); err != nil {
+			c.deletePages(ctx, keys)
+			return err
+		}
+	}
+
+	// switch metadata to new generation, remembering which one it replaced
+	var superseded *PagedEntityMetadata
+	err := c.client.RunInTransaction(ctx, func(tc context.Context) error {
+		superseded = nil
+		var current PagedEntityMetadata
+		_, err := c.retrieveEntity(tc, kindPagedMetadata, athleteId, "ActivityList", athleteId, &current)
+		if err == nil {
+			superseded = &current
+		} else if !IsNotFound(err) && !IsDecodeError(err) {
+			return err
+		}
+		return c.storeEntity(tc, "ActivityList", athleteId, metadata)
+	})
+	if err != nil {
+		c.deletePages(ctx, keys)
+		return err
+	}
+	if superseded != nil && superseded.Generation != metadata.Generation {
+		debugf(ctx, "Deleting ActivityList pages of generation %v", superseded.Generation)
+		c.deletePages(ctx, pageKeys(ctx, "ActivityList", athleteId, *superseded))
+	}
+	return nil
+}
+
+func (c *DatastoreActivityCache) Get(ctx context.Context, athleteId int64) (ActivityList, EntryInfo, error) {
+	for attempt := 1; ; attempt++ {
+		var metadata PagedEntityMetadata
+		info, err := c.retrieveEntity(ctx, kindPagedMetadata, athleteId, "ActivityList", athleteId, &metadata)
+		if IsNotFound(err) {
+			return nil, EntryInfo{}, &NotFoundError{KIND_ACTIVITY_LIST, athleteId}
+		} else if err != nil {
+			return nil, EntryInfo{}, err
+		}
+		activities, err := c.getPages(ctx, athleteId, metadata)
+		if IsNotFound(err) && attempt < DATASTORE_PAGED_GET_ATTEMPTS {
+			debugf(ctx, "ActivityList %v was replaced while reading, retrying", athleteId)
+			continue
+		} else if err != nil {
+			return nil, EntryInfo{}, err
+		}
+		return activities, info, nil
+	}
+}
+
+func (c *DatastoreActivityCache) getPages(ctx context.Context, athleteId int64, metadata PagedEntityMetadata) (ActivityList, error) {
+	activities := make(ActivityList, 0)
+	if metadata.PageCount == 0 {
+		return activities, nil
+	}
+	keys := pageKeys(ctx, "ActivityList", athleteId, metadata)
+	pages := make([]*DatastoreJsonEntity, len(keys))
+	for i := range pages {
+		pages[i] = new(DatastoreJsonEntity)
+	}
+	debugf(ctx, "Loading %v ActivityList pages of generation %v", len(keys), metadata.Generation)
+	if err := c.client.GetMulti(ctx, keys, pages); err != nil {
+		multiErr, ok := err.(appengine.MultiError)
+		if !ok {
+			return nil, err
+		}
+		for i, err := range multiErr {
+			if err == datastore.ErrNoSuchEntity {
+				warningf(ctx, "Found broken paged ActivityList: %v did not have page %v", athleteId, keys[i].StringID())
+				return nil, &NotFoundError{KIND_ACTIVITY_LIST, athleteId}
+			} else if err != nil {
+				return nil, err
 			}
 		}
-		return activities, true
-	} else {
-		return nil, false
 	}
+	for _, page := range pages {
+		var pageActivities ActivityList
+		if _, err := decodeJsonEntity(page, KIND_ACTIVITY_LIST, athleteId, &pageActivities); err != nil {
+			return nil, err
+		}
+		activities = append(activities, pageActivities...)
+	}
+	return activities, nil
 }
 
-func (c *DatastoreActivityCache) GetActivity(activityId int64) (*ExtendedActivityInfo, bool) {
-	var info ExtendedActivityInfo
-	if c.retrieveEntity("Activity", activityId, &info) {
-		return &info, true
-	} else {
-		return nil, false
+func (c *DatastoreActivityCache) GetActivity(ctx context.Context, athleteId int64, activityId int64) (*ExtendedActivityInfo, EntryInfo, error) {
+	var activity ExtendedActivityInfo
+	k := entityKey(ctx, "Activity", activityId, athleteKey(ctx, athleteId))
+	info, err := c.retrieveEntityAtKey(ctx, KIND_ACTIVITY, activityId, k, &activity)
+	if IsNotFound(err) {
+		return c.migrateLegacyActivity(ctx, athleteId, activityId)
+	} else if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	if !activity.OwnedBy(athleteId) {
+		return nil, EntryInfo{}, &NotFoundError{KIND_ACTIVITY, activityId}
+	}
+	return &activity, info, nil
+}
+
+// migrateLegacyActivity moves root Activity entity under its athlete,
+// if it is owned by the athlete
+func (c *DatastoreActivityCache) migrateLegacyActivity(ctx context.Context, athleteId int64, activityId int64) (*ExtendedActivityInfo, EntryInfo, error) {
+	legacyKey := entityKey(ctx, "Activity", activityId, nil)
+	var activity ExtendedActivityInfo
+	info, err := c.retrieveEntityAtKey(ctx, KIND_ACTIVITY, activityId, legacyKey, &activity)
+	if err != nil {
+		return nil, EntryInfo{}, err
 	}
+	if !activity.OwnedBy(athleteId) {
+		return nil, EntryInfo{}, &NotFoundError{KIND_ACTIVITY, activityId}
+	}
+	infof(ctx, "Migrating Activity %v under athlete %v", activityId, athleteId)
+	if err := c.StoreActivity(ctx, athleteId, activityId, &activity); err != nil {
+		return nil, EntryInfo{}, err
+	}
+	if err := c.client.Delete(ctx, legacyKey); err != nil {
+		warningf(ctx, "Failed to remove migrated Activity %v: %v", activityId, err)
+	}
+	return &activity, info, nil
+}
+
+func (c *DatastoreActivityCache) StoreActivity(ctx context.Context, athleteId int64, activityId int64, activity *ExtendedActivityInfo) error {
+	return c.storeEntityAtKey(ctx, entityKey(ctx, "Activity", activityId, athleteKey(ctx, athleteId)), activity)
+}
+
+func (c *DatastoreActivityCache) StoreSyncState(ctx context.Context, athleteId int64, state *SyncState) error {
+	return c.storeEntity(ctx, "SyncState", athleteId, state)
+}
+
+func (c *DatastoreActivityCache) GetSyncState(ctx context.Context, athleteId int64) (*SyncState, error) {
+	var state SyncState
+	if _, err := c.retrieveEntity(ctx, KIND_SYNC_STATE, athleteId, "SyncState", athleteId, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (c *DatastoreActivityCache) StoreHydrationState(ctx context.Context, athleteId int64, state *HydrationState) error {
+	return c.storeEntity(ctx, "Hydration", athleteId, state)
+}
+
+func (c *DatastoreActivityCache) GetHydrationState(ctx context.Context, athleteId int64) (*HydrationState, error) {
+	var state HydrationState
+	if _, err := c.retrieveEntity(ctx, KIND_HYDRATION, athleteId, "Hydration", athleteId, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
 }
 
-func (c *DatastoreActivityCache) StoreActivity(activityId int64, activity *ExtendedActivityInfo) {
-	c.storeEntity("Activity", activityId, activity)
+func (c *DatastoreActivityCache) StoreStreams(ctx context.Context, athleteId int64, activityId int64, streams *ActivityStreams) error {
+	return c.storeEntityAtKey(ctx, entityKey(ctx, "Streams", activityId, athleteKey(ctx, athleteId)), streams)
+}
+
+func (c *DatastoreActivityCache) GetStreams(ctx context.Context, athleteId int64, activityId int64) (*ActivityStreams, EntryInfo, error) {
+	var streams ActivityStreams
+	k := entityKey(ctx, "Streams", activityId, athleteKey(ctx, athleteId))
+	info, err := c.retrieveEntityAtKey(ctx, KIND_STREAMS, activityId, k, &streams)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return &streams, info, nil
+}
+
+func (c *DatastoreActivityCache) ListAthletes(ctx context.Context) ([]int64, error) {
+	keys, err := c.client.Keys(ctx, "ActivityList", nil)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		// page entities have _pageN suffix and are skipped by parseIds
+		names = append(names, key.StringID())
+	}
+	return parseIds(names), nil
+}
+
+func (c *DatastoreActivityCache) ListActivities(ctx context.Context, athleteId int64) ([]int64, error) {
+	names := make([]string, 0)
+	for _, kind := range []string{"Activity", "Streams"} {
+		keys, err := c.client.Keys(ctx, kind, athleteKey(ctx, athleteId))
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			names = append(names, key.StringID())
+		}
+	}
+	return parseIds(names), nil
 }
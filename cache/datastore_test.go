@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+func activityListOfSize(n int) ActivityList {
+	activities := make(ActivityList, 0, n)
+	for i := 0; i < n; i++ {
+		activities = append(activities, &strava.ActivitySummary{Id: int64(i)})
+	}
+	return activities
+}
+
+func storedListKeys(d *fakeDatastore) []string {
+	keys, _ := d.Keys(context.Background(), "ActivityList", nil)
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		names = append(names, k.StringID())
+	}
+	return names
+}
+
+func TestDatastoreCacheDeletesSupersededPages(t *testing.T) {
+	ctx := context.Background()
+	d := newFakeDatastore()
+	cache := &DatastoreActivityCache{d}
+	cache.Store(ctx, 1, activityListOfSize(2*DATASTORE_PAGE_SIZE+1))
+	if err := cache.Store(ctx, 1, activityListOfSize(1)); err != nil {
+		t.Fatal(err)
+	}
+	// metadata and single page
+	if keys := storedListKeys(d); len(keys) != 2 {
+		t.Errorf("Superseded pages should be deleted, got %v", keys)
+	}
+}
+
+func TestDatastoreCacheKeepsListWhenPageWriteFails(t *testing.T) {
+	ctx := context.Background()
+	d := newFakeDatastore()
+	cache := &DatastoreActivityCache{d}
+	cache.Store(ctx, 1, activityListOfSize(DATASTORE_PAGE_SIZE+1))
+	d.putMultiErr = errors.New("write failed")
+	if err := cache.Store(ctx, 1, activityListOfSize(3)); err == nil {
+		t.Error("Store should fail when pages can not be written")
+	}
+	activities, _, err := cache.Get(ctx, 1)
+	if err != nil || len(activities) != DATASTORE_PAGE_SIZE+1 {
+		t.Errorf("Previous list should stay readable, got %v activities, %v", len(activities), err)
+	}
+	if keys := storedListKeys(d); len(keys) != 3 {
+		t.Errorf("Expected metadata and two pages, got %v", keys)
+	}
+}
+
+func TestDatastoreCacheRetriesReadOfReplacedList(t *testing.T) {
+	ctx := context.Background()
+	d := newFakeDatastore()
+	cache := &DatastoreActivityCache{d}
+	cache.Store(ctx, 1, activityListOfSize(DATASTORE_PAGE_SIZE))
+	replaced := false
+	d.beforeGetMulti = func() {
+		// concurrent writer replaces list after metadata was read
+		if !replaced {
+			replaced = true
+			cache.Store(ctx, 1, activityListOfSize(3))
+		}
+	}
+	activities, _, err := cache.Get(ctx, 1)
+	if err != nil || len(activities) != 3 {
+		t.Errorf("Expected replaced list, got %v activities, %v", len(activities), err)
+	}
+}
+
+func TestDatastoreCacheReadsAndReplacesLegacyPages(t *testing.T) {
+	ctx := context.Background()
+	d := newFakeDatastore()
+	cache := &DatastoreActivityCache{d}
+	// list written before generations were introduced
+	d.Put(ctx, entityKey(ctx, "ActivityList", 1, nil), &DatastoreJsonEntity{JsonPayload: `{"PageCount":2}`})
+	for pageNum := 1; pageNum <= 2; pageNum++ {
+		payload := fmt.Sprintf(`[{"id":%v}]`, pageNum)
+		d.Put(ctx, entityKey(ctx, "ActivityList", pageId(1, 0, pageNum), nil), &DatastoreJsonEntity{JsonPayload: payload})
+	}
+
+	activities, _, err := cache.Get(ctx, 1)
+	if err != nil || len(activities) != 2 || activities[1].Id != 2 {
+		t.Fatalf("Legacy pages should be readable, got %v, %v", activities, err)
+	}
+	cache.Store(ctx, 1, activityListOfSize(1))
+	for _, name := range storedListKeys(d) {
+		if name == pageId(1, 0, 1) || name == pageId(1, 0, 2) {
+			t.Errorf("Legacy page %v should be deleted", name)
+		}
+	}
+}
+
+func TestDatastoreCacheStoresListsLongerThanBatch(t *testing.T) {
+	ctx := context.Background()
+	d := newFakeDatastore()
+	cache := &DatastoreActivityCache{d}
+	size := DATASTORE_MAX_BATCH*DATASTORE_PAGE_SIZE + 1
+	if err := cache.Store(ctx, 1, activityListOfSize(size)); err != nil {
+		t.Fatal(err)
+	}
+	activities, _, err := cache.Get(ctx, 1)
+	if err != nil || len(activities) != size {
+		t.Errorf("Expected %v activities, got %v, %v", size, len(activities), err)
+	}
+	// superseded pages are deleted in batches as well
+	if err := cache.Store(ctx, 1, activityListOfSize(1)); err != nil {
+		t.Fatal(err)
+	}
+	if keys := storedListKeys(d); len(keys) != 2 {
+		t.Errorf("Superseded pages should be deleted, got %v keys", len(keys))
+	}
+}
+
+func TestDatastoreCacheKeepsListWhenLaterBatchFails(t *testing.T) {
+	ctx := context.Background()
+	d := newFakeDatastore()
+	cache := &DatastoreActivityCache{d}
+	cache.Store(ctx, 1, activityListOfSize(3))
+	d.putMultiErr = errors.New("write failed")
+	d.putMultiFailingCall = d.putMultiCalls + 2
+	if err := cache.Store(ctx, 1, activityListOfSize(DATASTORE_MAX_BATCH*DATASTORE_PAGE_SIZE+1)); err == nil {
+		t.Error("Store should fail when second batch can not be written")
+	}
+	activities, _, err := cache.Get(ctx, 1)
+	if err != nil || len(activities) != 3 {
+		t.Errorf("Previous list should stay readable, got %v activities, %v", len(activities), err)
+	}
+	// pages of the first batch are cleaned up
+	if keys := storedListKeys(d); len(keys) != 2 {
+		t.Errorf("Expected metadata and one page, got %v keys", len(keys))
+	}
+}
@@ -0,0 +1,229 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// versioned envelope format of cached entries
+//
+// Entries are stored as envelopeMagic, json envelopeHeader terminated by
+// newline and payload, which is json of cached object or its own binary
+// encoding if object implements encoding.BinaryMarshaler, optionally
+// compressed. Entries written before envelopes were introduced are treated
+// as schema version 0.
+
+// version of payload schema written by this code, bump it and register
+// migration from previous version when cached types change incompatibly
+const CURRENT_SCHEMA_VERSION = 1
+
+// payload encodings
+const (
+	ENCODING_NONE = "none"
+	ENCODING_GZIP = "gzip"
+	ENCODING_ZSTD = "zstd"
+)
+
+// payload formats
+const (
+	FORMAT_JSON   = ""
+	FORMAT_BINARY = "binary"
+)
+
+var envelopeMagic = []byte("SAE\x01")
+
+// EntryInfo describes when cached entry was written.
+type EntryInfo struct {
+	StoredAt time.Time
+}
+
+// now is replaced in tests
+var now = time.Now
+
+type envelopeHeader struct {
+	Version  int
+	Encoding string
+	Format   string `json:",omitempty"`
+	StoredAt time.Time
+}
+
+// legacyEntry is wrapper used before envelopes were introduced
+type legacyEntry struct {
+	StoredAt time.Time
+	Payload  json.RawMessage
+}
+
+// Migration upgrades json payload from one schema version to the next one.
+type Migration func(payload []byte) ([]byte, error)
+
+var migrationsMutex sync.RWMutex
+var migrations = make(map[string]map[int]Migration)
+
+// RegisterMigration registers function upgrading payloads of entries of given
+// kind from fromVersion to fromVersion+1. Versions without registered
+// migration are considered compatible with the next one.
+func RegisterMigration(kind string, fromVersion int, migration Migration) {
+	migrationsMutex.Lock()
+	defer migrationsMutex.Unlock()
+	if migrations[kind] == nil {
+		migrations[kind] = make(map[int]Migration)
+	}
+	migrations[kind][fromVersion] = migration
+}
+
+func migrate(kind string, version int, payload []byte) ([]byte, error) {
+	migrationsMutex.RLock()
+	defer migrationsMutex.RUnlock()
+	for ; version < CURRENT_SCHEMA_VERSION; version++ {
+		if migration, ok := migrations[kind][version]; ok {
+			var err error
+			if payload, err = migration(payload); err != nil {
+				return nil, fmt.Errorf("migration from version %v failed: %s", version, err.Error())
+			}
+		}
+	}
+	return payload, nil
+}
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+func compress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case ENCODING_NONE:
+		return data, nil
+	case ENCODING_GZIP:
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case ENCODING_ZSTD:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown encoding: %s", encoding)
+	}
+}
+
+func decompress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case ENCODING_NONE:
+		return data, nil
+	case ENCODING_GZIP:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	case ENCODING_ZSTD:
+		return zstdDecoder.DecodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("unknown encoding: %s", encoding)
+	}
+}
+
+// encodeEntry serializes goObject into envelope compressed with
+// DEFAULT_CACHE_COMPRESSION
+func encodeEntry(goObject interface{}, info EntryInfo) ([]byte, error) {
+	format := FORMAT_JSON
+	var payload []byte
+	var err error
+	if marshaler, ok := goObject.(encoding.BinaryMarshaler); ok {
+		format = FORMAT_BINARY
+		payload, err = marshaler.MarshalBinary()
+	} else {
+		payload, err = json.Marshal(goObject)
+	}
+	if err != nil {
+		return nil, err
+	}
+	payload, err = compress(DEFAULT_CACHE_COMPRESSION, payload)
+	if err != nil {
+		return nil, err
+	}
+	header, err := json.Marshal(envelopeHeader{
+		Version:  CURRENT_SCHEMA_VERSION,
+		Encoding: DEFAULT_CACHE_COMPRESSION,
+		Format:   format,
+		StoredAt: info.StoredAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(envelopeMagic)
+	buf.Write(header)
+	buf.WriteByte('\n')
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
+
+// unpackEntry returns header and uncompressed json payload of entry
+func unpackEntry(data []byte) (envelopeHeader, []byte, error) {
+	if !bytes.HasPrefix(data, envelopeMagic) {
+		var entry legacyEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.Payload == nil {
+			// plain json payload
+			return envelopeHeader{Version: 0}, data, nil
+		}
+		return envelopeHeader{Version: 0, StoredAt: entry.StoredAt}, entry.Payload, nil
+	}
+	data = data[len(envelopeMagic):]
+	newline := bytes.IndexByte(data, '\n')
+	if newline < 0 {
+		return envelopeHeader{}, nil, fmt.Errorf("envelope header is not terminated")
+	}
+	var header envelopeHeader
+	if err := json.Unmarshal(data[:newline], &header); err != nil {
+		return envelopeHeader{}, nil, err
+	}
+	if header.Version > CURRENT_SCHEMA_VERSION {
+		return envelopeHeader{}, nil, fmt.Errorf("schema version %v is newer than supported %v", header.Version, CURRENT_SCHEMA_VERSION)
+	}
+	payload, err := decompress(header.Encoding, data[newline+1:])
+	if err != nil {
+		return envelopeHeader{}, nil, err
+	}
+	return header, payload, nil
+}
+
+// decodeEntry unpacks data written by encodeEntry or by older versions of
+// it into goObject, upgrading payload to current schema version
+func decodeEntry(data []byte, kind string, id int64, goObject interface{}) (EntryInfo, error) {
+	header, payload, err := unpackEntry(data)
+	if err != nil {
+		return EntryInfo{}, &DecodeError{kind, id, err}
+	}
+	payload, err = migrate(kind, header.Version, payload)
+	if err != nil {
+		return EntryInfo{}, &DecodeError{kind, id, err}
+	}
+	switch header.Format {
+	case FORMAT_JSON:
+		err = json.Unmarshal(payload, goObject)
+	case FORMAT_BINARY:
+		if unmarshaler, ok := goObject.(encoding.BinaryUnmarshaler); ok {
+			err = unmarshaler.UnmarshalBinary(payload)
+		} else {
+			err = fmt.Errorf("%T can not be decoded from binary payload", goObject)
+		}
+	default:
+		err = fmt.Errorf("unknown payload format: %s", header.Format)
+	}
+	if err != nil {
+		return EntryInfo{}, &DecodeError{kind, id, err}
+	}
+	return EntryInfo{StoredAt: header.StoredAt}, nil
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/strava/go.strava"
+	"testing"
+	"time"
+)
+
+func withCompression(encoding string) func() {
+	saved := DEFAULT_CACHE_COMPRESSION
+	DEFAULT_CACHE_COMPRESSION = encoding
+	return func() { DEFAULT_CACHE_COMPRESSION = saved }
+}
+
+func TestEntryRoundTripWithEveryEncoding(t *testing.T) {
+	storedAt := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, encoding := range []string{ENCODING_NONE, ENCODING_GZIP, ENCODING_ZSTD} {
+		restore := withCompression(encoding)
+		data, err := encodeEntry(ActivityList{&strava.ActivitySummary{Id: 1, Name: "Ride"}}, EntryInfo{StoredAt: storedAt})
+		restore()
+		if err != nil {
+			t.Fatalf("%v: %v", encoding, err)
+		}
+		if !bytes.HasPrefix(data, envelopeMagic) {
+			t.Errorf("%v: entry should start with envelope magic", encoding)
+		}
+		var activities ActivityList
+		info, err := decodeEntry(data, KIND_ACTIVITY_LIST, 1, &activities)
+		if err != nil || len(activities) != 1 || activities[0].Name != "Ride" || !info.StoredAt.Equal(storedAt) {
+			t.Errorf("%v: unexpected decode result %v, %v, %v", encoding, activities, info, err)
+		}
+	}
+}
+
+func TestDecodeLegacyWrappedEntry(t *testing.T) {
+	storedAt := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	data, _ := json.Marshal(legacyEntry{StoredAt: storedAt, Payload: []byte(`{"Watermark": "2017-01-01T00:00:00Z"}`)})
+	var state SyncState
+	info, err := decodeEntry(data, KIND_SYNC_STATE, 1, &state)
+	if err != nil || !info.StoredAt.Equal(storedAt) || !state.Watermark.Equal(storedAt) {
+		t.Errorf("Unexpected decode result %v, %v, %v", state, info, err)
+	}
+}
+
+func TestDecodeRejectsNewerSchema(t *testing.T) {
+	data := append(append([]byte{}, envelopeMagic...), []byte(`{"Version": 1000, "Encoding": "none"}`+"\n{}")...)
+	var state SyncState
+	if _, err := decodeEntry(data, KIND_SYNC_STATE, 1, &state); !IsDecodeError(err) {
+		t.Errorf("Entry with unknown schema version should not be decoded, got %v", err)
+	}
+}
+
+func TestDecodeAppliesMigrations(t *testing.T) {
+	kind := "TestMigrationKind"
+	RegisterMigration(kind, 0, func(payload []byte) ([]byte, error) {
+		var legacy struct{ OldName string }
+		if err := json.Unmarshal(payload, &legacy); err != nil {
+			return nil, err
+		}
+		return json.Marshal(map[string]string{"NewName": legacy.OldName})
+	})
+	var upgraded struct{ NewName string }
+	if _, err := decodeEntry([]byte(`{"OldName": "value"}`), kind, 1, &upgraded); err != nil {
+		t.Fatal(err)
+	}
+	if upgraded.NewName != "value" {
+		t.Errorf("Legacy payload should be migrated, got %+v", upgraded)
+	}
+
+	// current entries are not migrated again
+	data, _ := encodeEntry(map[string]string{"NewName": "current"}, EntryInfo{})
+	if _, err := decodeEntry(data, kind, 1, &upgraded); err != nil || upgraded.NewName != "current" {
+		t.Errorf("Current payload should be decoded as is, got %+v, %v", upgraded, err)
+	}
+}
+
+func TestLegacyActivityHasHeartRateZonesOnly(t *testing.T) {
+	var legacy ExtendedActivityInfo
+	if err := json.Unmarshal([]byte(`{"Activity":null,"ZonesSummary":{"type":"heartrate","score":3}}`), &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if legacy.HasAllZones() {
+		t.Errorf("Entry without zone list should be legacy")
+	}
+	if zones := legacy.ZonesOfType(ZONES_HEARTRATE); zones == nil || zones.Score != 3 {
+		t.Errorf("Expected heart rate zones of legacy entry, got %+v", zones)
+	}
+	if zones := legacy.ZonesOfType(ZONES_POWER); zones != nil {
+		t.Errorf("Legacy entry has no power zones, got %+v", zones)
+	}
+	if !legacy.KnowsZones(ZONES_HEARTRATE) || legacy.KnowsZones(ZONES_POWER) {
+		t.Errorf("Legacy entry should know heart rate zones only")
+	}
+
+	var current ExtendedActivityInfo
+	if err := json.Unmarshal([]byte(`{"Activity":null,"ZonesSummary":null,"Zones":[]}`), &current); err != nil {
+		t.Fatal(err)
+	}
+	if !current.HasAllZones() || !current.KnowsZones(ZONES_POWER) {
+		t.Errorf("Entry with empty zone list should not be legacy")
+	}
+}
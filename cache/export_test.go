@@ -0,0 +1,26 @@
+package cache
+
+import (
+	"golang.org/x/net/context"
+	"log"
+)
+
+// exports for tests in cache_test package
+
+func init() {
+	// App Engine logging requires App Engine context
+	stdLogf := func(ctx context.Context, format string, args ...interface{}) {
+		log.Printf(format, args...)
+	}
+	debugf = func(ctx context.Context, format string, args ...interface{}) {}
+	infof = stdLogf
+	warningf = stdLogf
+}
+
+func NewFakeDatastoreActivityCache() ActivityCache {
+	return &DatastoreActivityCache{newFakeDatastore()}
+}
+
+func NewFakeGoogleStorageActivityCache(prefix string) ActivityCache {
+	return &GoogleStorageActivityCache{store: newFakeObjectStore(), cacheRoot: prefix}
+}
@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"cloud.google.com/go/storage"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// in-process fakes of datastore and cloud storage
+
+type fakeDatastoreEntity struct {
+	key    *datastore.Key
+	entity DatastoreJsonEntity
+}
+
+type fakeDatastore struct {
+	mutex    sync.Mutex
+	entities map[string]fakeDatastoreEntity
+	// transactions are serialized
+	transactionMutex sync.Mutex
+	// error returned by PutMulti, if set
+	putMultiErr error
+	// number of PutMulti call failing with putMultiErr, every call fails if zero
+	putMultiFailingCall int
+	putMultiCalls       int
+	// called before GetMulti reads entities, if set
+	beforeGetMulti func()
+}
+
+func newFakeDatastore() *fakeDatastore {
+	return &fakeDatastore{entities: make(map[string]fakeDatastoreEntity)}
+}
+
+// keyPath encodes key with all its ancestors, so ancestor paths are prefixes
+// of their descendants
+func keyPath(k *datastore.Key) string {
+	if k == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s,%q,%v", keyPath(k.Parent()), k.Kind(), k.StringID(), k.IntID())
+}
+
+func (d *fakeDatastore) Get(ctx context.Context, k *datastore.Key, e *DatastoreJsonEntity) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	stored, ok := d.entities[keyPath(k)]
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	*e = stored.entity
+	e.Payload = append([]byte(nil), stored.entity.Payload...)
+	return nil
+}
+
+func (d *fakeDatastore) Put(ctx context.Context, k *datastore.Key, e *DatastoreJsonEntity) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	entity := *e
+	entity.Payload = append([]byte(nil), e.Payload...)
+	d.entities[keyPath(k)] = fakeDatastoreEntity{k, entity}
+	return nil
+}
+
+func (d *fakeDatastore) Delete(ctx context.Context, k *datastore.Key) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.entities, keyPath(k))
+	return nil
+}
+
+func (d *fakeDatastore) GetMulti(ctx context.Context, keys []*datastore.Key, entities []*DatastoreJsonEntity) error {
+	if d.beforeGetMulti != nil {
+		d.beforeGetMulti()
+	}
+	errors := make(appengine.MultiError, len(keys))
+	failed := false
+	for i, k := range keys {
+		if err := d.Get(ctx, k, entities[i]); err != nil {
+			errors[i] = err
+			failed = true
+		}
+	}
+	if failed {
+		return errors
+	}
+	return nil
+}
+
+func (d *fakeDatastore) PutMulti(ctx context.Context, keys []*datastore.Key, entities []*DatastoreJsonEntity) error {
+	d.mutex.Lock()
+	d.putMultiCalls++
+	failing := d.putMultiErr != nil && (d.putMultiFailingCall == 0 || d.putMultiFailingCall == d.putMultiCalls)
+	d.mutex.Unlock()
+	if failing {
+		return d.putMultiErr
+	}
+	if len(keys) > DATASTORE_MAX_BATCH {
+		return fmt.Errorf("too many entities in batch: %v", len(keys))
+	}
+	for i, k := range keys {
+		d.Put(ctx, k, entities[i])
+	}
+	return nil
+}
+
+func (d *fakeDatastore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	if len(keys) > DATASTORE_MAX_BATCH {
+		return fmt.Errorf("too many entities in batch: %v", len(keys))
+	}
+	for _, k := range keys {
+		d.Delete(ctx, k)
+	}
+	return nil
+}
+
+func (d *fakeDatastore) RunInTransaction(ctx context.Context, f func(tc context.Context) error) error {
+	d.transactionMutex.Lock()
+	defer d.transactionMutex.Unlock()
+	return f(ctx)
+}
+
+func (d *fakeDatastore) Keys(ctx context.Context, kind string, ancestor *datastore.Key) ([]*datastore.Key, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	ancestorPath := keyPath(ancestor)
+	keys := make([]*datastore.Key, 0)
+	for path, stored := range d.entities {
+		if stored.key.Kind() == kind && strings.HasPrefix(path, ancestorPath) {
+			keys = append(keys, stored.key)
+		}
+	}
+	return keys, nil
+}
+
+type fakeObject struct {
+	data       []byte
+	generation int64
+}
+
+type fakeObjectStore struct {
+	mutex          sync.Mutex
+	objects        map[string]fakeObject
+	lastGeneration int64
+}
+
+func newFakeObjectStore() *fakeObjectStore {
+	return &fakeObjectStore{objects: make(map[string]fakeObject)}
+}
+
+func (s *fakeObjectStore) Read(ctx context.Context, name string) ([]byte, int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	object, ok := s.objects[name]
+	if !ok {
+		return nil, 0, storage.ErrObjectNotExist
+	}
+	return append([]byte(nil), object.data...), object.generation, nil
+}
+
+// matches returns false if object does not satisfy precondition
+func (s *fakeObjectStore) matches(name string, ifGeneration int64) bool {
+	object, ok := s.objects[name]
+	switch ifGeneration {
+	case anyGeneration:
+		return true
+	case noGeneration:
+		return !ok
+	default:
+		return ok && object.generation == ifGeneration
+	}
+}
+
+func (s *fakeObjectStore) Write(ctx context.Context, name string, data []byte, ifGeneration int64) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.matches(name, ifGeneration) {
+		return 0, errPreconditionFailed
+	}
+	s.lastGeneration++
+	s.objects[name] = fakeObject{append([]byte(nil), data...), s.lastGeneration}
+	return s.lastGeneration, nil
+}
+
+func (s *fakeObjectStore) Delete(ctx context.Context, name string, ifGeneration int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.objects[name]; !ok {
+		return storage.ErrObjectNotExist
+	}
+	if !s.matches(name, ifGeneration) {
+		return errPreconditionFailed
+	}
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *fakeObjectStore) Exists(ctx context.Context, name string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.objects[name]
+	return ok, nil
+}
+
+func (s *fakeObjectStore) ListPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for name := range s.objects {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := name[len(prefix):]
+		if slash := strings.Index(rest, "/"); slash >= 0 && !seen[rest[:slash]] {
+			seen[rest[:slash]] = true
+			names = append(names, rest[:slash])
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
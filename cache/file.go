@@ -1,8 +1,8 @@
 package cache
 
 import (
-	"encoding/json"
 	"fmt"
+	"golang.org/x/net/context"
 	"io/ioutil"
 	"log"
 	"os"
@@ -16,7 +16,7 @@ type FileActivityCache struct {
 }
 
 func NewDefaultFileActivityCache() ActivityCache {
-	log.Println("Using default cache root: %v", DEFAULT_CACHE_ROOT)
+	log.Printf("Using default cache root: %v", DEFAULT_CACHE_ROOT)
 	return NewFileActivityCache(DEFAULT_CACHE_ROOT)
 }
 
@@ -28,64 +28,196 @@ func (c *FileActivityCache) activityListFilename(athleteId int64) string {
 	return path.Join(c.cacheRoot, fmt.Sprintf("users/%v/activity_list.json", athleteId))
 }
 
-func (c *FileActivityCache) activityFilename(activityId int64) string {
+func (c *FileActivityCache) syncStateFilename(athleteId int64) string {
+	return path.Join(c.cacheRoot, fmt.Sprintf("users/%v/sync_state.json", athleteId))
+}
+
+func (c *FileActivityCache) hydrationStateFilename(athleteId int64) string {
+	return path.Join(c.cacheRoot, fmt.Sprintf("users/%v/hydration_state.json", athleteId))
+}
+
+func (c *FileActivityCache) activityFilename(athleteId int64, activityId int64) string {
+	return path.Join(
+		c.cacheRoot,
+		fmt.Sprintf("users/%v/activities/%v/activity.json", athleteId, activityId))
+}
+
+func (c *FileActivityCache) streamsFilename(athleteId int64, activityId int64) string {
+	return path.Join(
+		c.cacheRoot,
+		fmt.Sprintf("users/%v/activities/%v/streams.dat", athleteId, activityId))
+}
+
+// activities used to be stored without athlete scope
+func (c *FileActivityCache) legacyActivityFilename(activityId int64) string {
 	return path.Join(
 		c.cacheRoot,
 		fmt.Sprintf("activities/%v/activity.json", activityId))
 }
 
-func (c *FileActivityCache) Store(athleteId int64, activities ActivityList) {
+func (c *FileActivityCache) storeFile(filename string, goObject interface{}) error {
+	data, err := encodeEntry(goObject, EntryInfo{StoredAt: now()})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.cacheRoot, filename, data, DEFAULT_FILE_MODE)
+}
+
+// quarantine moves unreadable file aside, so it is re-fetched on next access
+// and still can be inspected later
+func (c *FileActivityCache) quarantine(filename string) {
+	quarantined := fmt.Sprintf("%s.corrupt-%v", filename, now().Unix())
+	if err := os.Rename(filename, quarantined); err != nil {
+		log.Printf("Failed to quarantine corrupt cache file %v: %v", filename, err)
+	} else {
+		log.Printf("Quarantined corrupt cache file %v as %v", filename, quarantined)
+	}
+}
+
+func (c *FileActivityCache) loadFile(filename string, kind string, id int64, goObject interface{}) (EntryInfo, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return EntryInfo{}, &NotFoundError{kind, id}
+	} else if err != nil {
+		return EntryInfo{}, err
+	}
+	info, err := decodeEntry(data, kind, id, goObject)
+	if IsDecodeError(err) {
+		log.Printf("Can not decode %v: %v", filename, err)
+		c.quarantine(filename)
+		return EntryInfo{}, &NotFoundError{kind, id}
+	}
+	return info, err
+}
+
+func (c *FileActivityCache) Store(ctx context.Context, athleteId int64, activities ActivityList) error {
 	filename := c.activityListFilename(athleteId)
 	log.Printf("Storing activity list: %v", filename)
-	data, err := json.Marshal(activities)
+	return c.storeFile(filename, activities)
+}
+
+func (c *FileActivityCache) Get(ctx context.Context, athleteId int64) (ActivityList, EntryInfo, error) {
+	var activities ActivityList
+	info, err := c.loadFile(c.activityListFilename(athleteId), KIND_ACTIVITY_LIST, athleteId, &activities)
 	if err != nil {
-		panic(err.Error())
+		return nil, EntryInfo{}, err
 	}
-	if err := os.MkdirAll(path.Dir(filename), DEFAULT_DIR_MODE); err != nil {
-		panic(err.Error())
+	return activities, info, nil
+}
+
+func (c *FileActivityCache) GetActivity(ctx context.Context, athleteId int64, activityId int64) (*ExtendedActivityInfo, EntryInfo, error) {
+	var activity ExtendedActivityInfo
+	info, err := c.loadFile(c.activityFilename(athleteId, activityId), KIND_ACTIVITY, activityId, &activity)
+	if IsNotFound(err) {
+		return c.migrateLegacyActivity(athleteId, activityId)
+	} else if err != nil {
+		return nil, EntryInfo{}, err
 	}
-	if err := ioutil.WriteFile(filename, data, DEFAULT_FILE_MODE); err != nil {
-		panic(err.Error())
+	if !activity.OwnedBy(athleteId) {
+		return nil, EntryInfo{}, &NotFoundError{KIND_ACTIVITY, activityId}
 	}
+	return &activity, info, nil
 }
 
-func (c *FileActivityCache) Get(athleteId int64) (ActivityList, bool) {
-	data, err := ioutil.ReadFile(c.activityListFilename(athleteId))
+// migrateLegacyActivity moves activity stored without athlete scope into
+// athlete directory, if it is owned by the athlete
+func (c *FileActivityCache) migrateLegacyActivity(athleteId int64, activityId int64) (*ExtendedActivityInfo, EntryInfo, error) {
+	legacyFilename := c.legacyActivityFilename(activityId)
+	var activity ExtendedActivityInfo
+	info, err := c.loadFile(legacyFilename, KIND_ACTIVITY, activityId, &activity)
 	if err != nil {
-		return nil, false
+		return nil, EntryInfo{}, err
+	}
+	if !activity.OwnedBy(athleteId) {
+		return nil, EntryInfo{}, &NotFoundError{KIND_ACTIVITY, activityId}
 	}
+	filename := c.activityFilename(athleteId, activityId)
+	log.Printf("Migrating %v to %v", legacyFilename, filename)
+	if err := c.storeFile(filename, &activity); err != nil {
+		return nil, EntryInfo{}, err
+	}
+	if err := os.Remove(legacyFilename); err != nil {
+		log.Printf("Failed to remove migrated %v: %v", legacyFilename, err)
+	}
+	return &activity, info, nil
+}
 
-	var activities ActivityList
-	err = json.Unmarshal(data, &activities)
-	if err != nil {
-		panic(err.Error())
+func (c *FileActivityCache) StoreActivity(ctx context.Context, athleteId int64, activityId int64, activity *ExtendedActivityInfo) error {
+	return c.storeFile(c.activityFilename(athleteId, activityId), activity)
+}
+
+func (c *FileActivityCache) StoreSyncState(ctx context.Context, athleteId int64, state *SyncState) error {
+	return c.storeFile(c.syncStateFilename(athleteId), state)
+}
+
+func (c *FileActivityCache) GetSyncState(ctx context.Context, athleteId int64) (*SyncState, error) {
+	var state SyncState
+	if _, err := c.loadFile(c.syncStateFilename(athleteId), KIND_SYNC_STATE, athleteId, &state); err != nil {
+		return nil, err
 	}
-	return activities, true
+	return &state, nil
 }
 
-func (c *FileActivityCache) GetActivity(activityId int64) (*ExtendedActivityInfo, bool) {
-	data, err := ioutil.ReadFile(c.activityFilename(activityId))
+func (c *FileActivityCache) StoreHydrationState(ctx context.Context, athleteId int64, state *HydrationState) error {
+	return c.storeFile(c.hydrationStateFilename(athleteId), state)
+}
+
+func (c *FileActivityCache) GetHydrationState(ctx context.Context, athleteId int64) (*HydrationState, error) {
+	var state HydrationState
+	if _, err := c.loadFile(c.hydrationStateFilename(athleteId), KIND_HYDRATION, athleteId, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (c *FileActivityCache) StoreStreams(ctx context.Context, athleteId int64, activityId int64, streams *ActivityStreams) error {
+	return c.storeFile(c.streamsFilename(athleteId, activityId), streams)
+}
+
+func (c *FileActivityCache) GetStreams(ctx context.Context, athleteId int64, activityId int64) (*ActivityStreams, EntryInfo, error) {
+	var streams ActivityStreams
+	info, err := c.loadFile(c.streamsFilename(athleteId, activityId), KIND_STREAMS, activityId, &streams)
 	if err != nil {
-		return nil, false
+		return nil, EntryInfo{}, err
 	}
+	return &streams, info, nil
+}
 
-	var activity ExtendedActivityInfo
-	if json.Unmarshal(data, &activity) != nil {
-		panic(err.Error())
+// listDir returns names of subdirectories, missing directory is empty
+func listDir(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() {
+			names = append(names, file.Name())
+		}
 	}
-	return &activity, true
+	return names, nil
 }
 
-func (c *FileActivityCache) StoreActivity(activityId int64, activity *ExtendedActivityInfo) {
-	filename := c.activityFilename(activityId)
-	data, err := json.Marshal(activity)
+func (c *FileActivityCache) ListAthletes(ctx context.Context) ([]int64, error) {
+	names, err := listDir(path.Join(c.cacheRoot, "users"))
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
-	if err := os.MkdirAll(path.Dir(filename), DEFAULT_DIR_MODE); err != nil {
-		panic(err.Error())
+	athleteIds := make([]int64, 0)
+	for _, athleteId := range parseIds(names) {
+		if _, err := os.Stat(c.activityListFilename(athleteId)); err == nil {
+			athleteIds = append(athleteIds, athleteId)
+		}
 	}
-	if err := ioutil.WriteFile(filename, data, DEFAULT_FILE_MODE); err != nil {
-		panic(err.Error())
+	return athleteIds, nil
+}
+
+func (c *FileActivityCache) ListActivities(ctx context.Context, athleteId int64) ([]int64, error) {
+	names, err := listDir(path.Join(c.cacheRoot, fmt.Sprintf("users/%v/activities", athleteId)))
+	if err != nil {
+		return nil, err
 	}
+	return parseIds(names), nil
 }
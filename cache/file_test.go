@@ -2,17 +2,30 @@ package cache
 
 import (
 	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
 	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
 	_ "reflect"
 	"testing"
 )
 
 func TestDiretoryFormat(t *testing.T) {
+	cache := FileActivityCache{""}
+	activityId := int64(1235)
+	expected := "users/42/activities/1235/activity.json"
+	actual := cache.activityFilename(42, activityId)
+	if expected != actual {
+		t.Errorf("%s != %s", expected, actual)
+	}
+}
+
+func TestLegacyDiretoryFormat(t *testing.T) {
 	cache := FileActivityCache{""}
 	activityId := int64(1235)
 	expected := "activities/1235/activity.json"
-	actual := cache.activityFilename(activityId)
+	actual := cache.legacyActivityFilename(activityId)
 	if expected != actual {
 		t.Errorf("%s != %s", expected, actual)
 	}
@@ -34,13 +47,13 @@ func TestFileCacheEmptyReads(t *testing.T) {
 
 	cache := NewFileActivityCache(cacheRoot)
 	athleteId := int64(12345)
-	if _, ok := cache.Get(athleteId); ok {
-		t.Error("Get on empty cache should return false!")
+	if _, _, err := cache.Get(context.Background(), athleteId); !IsNotFound(err) {
+		t.Errorf("Get on empty cache should return NotFoundError, got %v", err)
 	}
 
 	activityId := int64(12345)
-	if _, ok := cache.GetActivity(activityId); ok {
-		t.Error("Get on empty cache should return false!")
+	if _, _, err := cache.GetActivity(context.Background(), athleteId, activityId); !IsNotFound(err) {
+		t.Errorf("GetActivity on empty cache should return NotFoundError, got %v", err)
 	}
 }
 
@@ -53,8 +66,10 @@ func TestFileCacheCanGetActivityList(t *testing.T) {
 	activityId := int64(12345)
 	athleteId := int64(1234)
 	expectedActivities = append(expectedActivities, &strava.ActivitySummary{Id: activityId, Name: "My Activity"})
-	cache.Store(athleteId, expectedActivities)
-	if loadedActivities, ok := cache.Get(athleteId); ok {
+	if err := cache.Store(context.Background(), athleteId, expectedActivities); err != nil {
+		t.Fatal(err)
+	}
+	if loadedActivities, _, err := cache.Get(context.Background(), athleteId); err == nil {
 		equal := len(expectedActivities) == len(loadedActivities) &&
 			expectedActivities[0].Id == loadedActivities[0].Id &&
 			expectedActivities[0].Name == loadedActivities[0].Name
@@ -67,7 +82,7 @@ func TestFileCacheCanGetActivityList(t *testing.T) {
 		//  t.Error("Activities should be deep equal!")
 		// }
 	} else {
-		t.Error("cache.Get should return ok after storing activity!")
+		t.Errorf("cache.Get should return ok after storing activity, got %v", err)
 	}
 }
 
@@ -77,19 +92,23 @@ func TestFileCacheCanGetActivity(t *testing.T) {
 
 	cache := NewFileActivityCache(cacheRoot)
 	activityId := int64(12345)
+	athleteId := int64(1234)
 	expectedActivity := ExtendedActivityInfo{
 		Activity: &strava.ActivityDetailed{
 			ActivitySummary: strava.ActivitySummary{
-				Id:   activityId,
-				Name: "Test Name",
+				Id:      activityId,
+				Name:    "Test Name",
+				Athlete: strava.AthleteSummary{AthleteMeta: strava.AthleteMeta{Id: athleteId}},
 			},
 		},
 		ZonesSummary: &strava.ZonesSummary{
 			CustonZones: true,
 			Score:       1234,
 		}}
-	cache.StoreActivity(activityId, &expectedActivity)
-	if loadedActivity, ok := cache.GetActivity(activityId); ok {
+	if err := cache.StoreActivity(context.Background(), athleteId, activityId, &expectedActivity); err != nil {
+		t.Fatal(err)
+	}
+	if loadedActivity, _, err := cache.GetActivity(context.Background(), athleteId, activityId); err == nil {
 		equal := loadedActivity.Activity.Id == expectedActivity.Activity.Id &&
 			loadedActivity.Activity.Name == expectedActivity.Activity.Name &&
 			loadedActivity.ZonesSummary.CustonZones == expectedActivity.ZonesSummary.CustonZones &&
@@ -103,6 +122,124 @@ func TestFileCacheCanGetActivity(t *testing.T) {
 		//  t.Error("Activities should be deep equal!")
 		// }
 	} else {
-		t.Error("cache.GetActivity should return ok after storing activity!")
+		t.Errorf("cache.GetActivity should return ok after storing activity, got %v", err)
+	}
+}
+
+func TestFileCacheCorruptActivity(t *testing.T) {
+	cacheRoot, _ := ioutil.TempDir("", "activityCache")
+	defer os.RemoveAll(cacheRoot)
+
+	cache := FileActivityCache{cacheRoot}
+	activityId := int64(12345)
+	athleteId := int64(1234)
+	filename := cache.activityFilename(athleteId, activityId)
+	os.MkdirAll(path.Dir(filename), DEFAULT_DIR_MODE)
+	ioutil.WriteFile(filename, []byte("{\"Activity\": {"), DEFAULT_FILE_MODE)
+	if _, _, err := cache.GetActivity(context.Background(), athleteId, activityId); !IsNotFound(err) {
+		t.Errorf("GetActivity on corrupt file should return NotFoundError, got %v", err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Corrupt file should be moved away, got %v", err)
+	}
+	quarantined, _ := filepath.Glob(filename + ".corrupt-*")
+	if len(quarantined) != 1 {
+		t.Errorf("Corrupt file should be quarantined, found %v", quarantined)
+	}
+}
+
+func TestFileCacheOverwriteLeavesNoTemporaryFiles(t *testing.T) {
+	cacheRoot, _ := ioutil.TempDir("", "activityCache")
+	defer os.RemoveAll(cacheRoot)
+
+	cache := FileActivityCache{cacheRoot}
+	athleteId := int64(1234)
+	for i := 0; i < 3; i++ {
+		activities := ActivityList{&strava.ActivitySummary{Id: int64(i)}}
+		if err := cache.Store(context.Background(), athleteId, activities); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _ := ioutil.ReadDir(path.Dir(cache.activityListFilename(athleteId)))
+	if len(files) != 1 || files[0].Name() != "activity_list.json" {
+		t.Errorf("Expected only activity_list.json, got %v", files)
+	}
+	loaded, _, err := cache.Get(context.Background(), athleteId)
+	if err != nil || len(loaded) != 1 || loaded[0].Id != 2 {
+		t.Errorf("Expected last written list, got %v, %v", loaded, err)
+	}
+}
+
+func ownedActivity(athleteId int64, activityId int64) *ExtendedActivityInfo {
+	return &ExtendedActivityInfo{
+		Activity: &strava.ActivityDetailed{
+			ActivitySummary: strava.ActivitySummary{
+				Id:      activityId,
+				Athlete: strava.AthleteSummary{AthleteMeta: strava.AthleteMeta{Id: athleteId}},
+			},
+		},
+	}
+}
+
+func TestFileCacheHidesActivitiesOfOtherAthletes(t *testing.T) {
+	cacheRoot, _ := ioutil.TempDir("", "activityCache")
+	defer os.RemoveAll(cacheRoot)
+
+	cache := FileActivityCache{cacheRoot}
+	activityId := int64(12345)
+	// pretend activity of athlete 1 was stored in directory of athlete 2
+	cache.StoreActivity(context.Background(), 2, activityId, ownedActivity(1, activityId))
+	if _, _, err := cache.GetActivity(context.Background(), 2, activityId); !IsNotFound(err) {
+		t.Errorf("Activity of another athlete should not be returned, got %v", err)
+	}
+}
+
+func TestFileCacheMigratesLegacyActivity(t *testing.T) {
+	cacheRoot, _ := ioutil.TempDir("", "activityCache")
+	defer os.RemoveAll(cacheRoot)
+
+	cache := FileActivityCache{cacheRoot}
+	activityId := int64(12345)
+	legacyFilename := cache.legacyActivityFilename(activityId)
+	cache.storeFile(legacyFilename, ownedActivity(1, activityId))
+
+	if _, _, err := cache.GetActivity(context.Background(), 2, activityId); !IsNotFound(err) {
+		t.Errorf("Legacy activity should not be visible to another athlete, got %v", err)
+	}
+	activity, _, err := cache.GetActivity(context.Background(), 1, activityId)
+	if err != nil || activity.Activity.Id != activityId {
+		t.Fatalf("Legacy activity should be visible to its owner, got %v, %v", activity, err)
+	}
+	if _, err := os.Stat(legacyFilename); !os.IsNotExist(err) {
+		t.Errorf("Legacy file should be removed after migration, got %v", err)
+	}
+	if _, err := os.Stat(cache.activityFilename(1, activityId)); err != nil {
+		t.Errorf("Activity should be migrated into athlete directory, got %v", err)
+	}
+}
+
+func TestFileCacheEnumeration(t *testing.T) {
+	cacheRoot, _ := ioutil.TempDir("", "activityCache")
+	defer os.RemoveAll(cacheRoot)
+
+	cache := FileActivityCache{cacheRoot}
+	ctx := context.Background()
+	cache.Store(ctx, 2, ActivityList{})
+	cache.Store(ctx, 1, ActivityList{})
+	cache.StoreActivity(ctx, 1, 20, ownedActivity(1, 20))
+	cache.StoreActivity(ctx, 1, 10, ownedActivity(1, 10))
+	// athlete without activity list is not enumerated
+	cache.StoreActivity(ctx, 3, 30, ownedActivity(3, 30))
+
+	athletes, err := cache.ListAthletes(ctx)
+	if err != nil || len(athletes) != 2 || athletes[0] != 1 || athletes[1] != 2 {
+		t.Errorf("Expected athletes [1 2], got %v, %v", athletes, err)
+	}
+	activities, err := cache.ListActivities(ctx, 1)
+	if err != nil || len(activities) != 2 || activities[0] != 10 || activities[1] != 20 {
+		t.Errorf("Expected activities [10 20], got %v, %v", activities, err)
+	}
+	if activities, err := cache.ListActivities(ctx, 2); err != nil || len(activities) != 0 {
+		t.Errorf("Expected no activities, got %v, %v", activities, err)
 	}
 }
@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"golang.org/x/net/context"
+	"time"
+)
+
+// staleness classification of cached entries
+
+type Freshness int
+
+const (
+	// entry is not present in cache or is too old to be used
+	MISSING Freshness = iota
+	// entry is older than TTL, but still can be served while it is refreshed
+	STALE
+	// entry is younger than TTL
+	FRESH
+)
+
+func (f Freshness) String() string {
+	switch f {
+	case FRESH:
+		return "fresh"
+	case STALE:
+		return "stale"
+	default:
+		return "missing"
+	}
+}
+
+type TTLPolicy struct {
+	// entries younger than TTL are fresh, zero TTL means entries never get stale
+	TTL time.Duration
+	// stale entries older than TTL+MaxStale are treated as missing, zero means
+	// stale entries are usable forever
+	MaxStale time.Duration
+}
+
+func (p TTLPolicy) Freshness(info EntryInfo) Freshness {
+	if p.TTL == 0 {
+		return FRESH
+	}
+	age := now().Sub(info.StoredAt)
+	if age <= p.TTL {
+		return FRESH
+	} else if p.MaxStale == 0 || age <= p.TTL+p.MaxStale {
+		return STALE
+	} else {
+		return MISSING
+	}
+}
+
+// LookupActivityList loads activity list and classifies it according to policy.
+// Missing and expired lists are reported as MISSING without error.
+func LookupActivityList(ctx context.Context, c ActivityCache, policy TTLPolicy, athleteId int64) (ActivityList, Freshness, error) {
+	activities, info, err := c.Get(ctx, athleteId)
+	if IsNotFound(err) {
+		return nil, MISSING, nil
+	} else if err != nil {
+		return nil, MISSING, err
+	}
+	freshness := policy.Freshness(info)
+	if freshness == MISSING {
+		return nil, MISSING, nil
+	}
+	return activities, freshness, nil
+}
+
+// LookupStreams loads activity streams and classifies them according to policy.
+// Missing and expired streams are reported as MISSING without error.
+func LookupStreams(ctx context.Context, c ActivityCache, policy TTLPolicy, athleteId int64, activityId int64) (*ActivityStreams, Freshness, error) {
+	streams, info, err := c.GetStreams(ctx, athleteId, activityId)
+	if IsNotFound(err) {
+		return nil, MISSING, nil
+	} else if err != nil {
+		return nil, MISSING, err
+	}
+	freshness := policy.Freshness(info)
+	if freshness == MISSING {
+		return nil, MISSING, nil
+	}
+	return streams, freshness, nil
+}
+
+// LookupActivity loads activity details and classifies them according to policy.
+// Missing and expired activities are reported as MISSING without error.
+func LookupActivity(ctx context.Context, c ActivityCache, policy TTLPolicy, athleteId int64, activityId int64) (*ExtendedActivityInfo, Freshness, error) {
+	activity, info, err := c.GetActivity(ctx, athleteId, activityId)
+	if IsNotFound(err) {
+		return nil, MISSING, nil
+	} else if err != nil {
+		return nil, MISSING, err
+	}
+	freshness := policy.Freshness(info)
+	if freshness == MISSING {
+		return nil, MISSING, nil
+	}
+	return activity, freshness, nil
+}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+func withNow(t time.Time) func() {
+	saved := now
+	now = func() time.Time { return t }
+	return func() { now = saved }
+}
+
+func TestTTLPolicyFreshness(t *testing.T) {
+	storedAt := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	info := EntryInfo{StoredAt: storedAt}
+	policy := TTLPolicy{TTL: time.Hour, MaxStale: 24 * time.Hour}
+	cases := []struct {
+		age      time.Duration
+		expected Freshness
+	}{
+		{0, FRESH},
+		{time.Hour, FRESH},
+		{2 * time.Hour, STALE},
+		{25 * time.Hour, STALE},
+		{26 * time.Hour, MISSING},
+	}
+	for _, c := range cases {
+		restore := withNow(storedAt.Add(c.age))
+		if actual := policy.Freshness(info); actual != c.expected {
+			t.Errorf("age %v: %v != %v", c.age, c.expected, actual)
+		}
+		restore()
+	}
+}
+
+func TestZeroTTLNeverExpires(t *testing.T) {
+	defer withNow(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))()
+	if actual := (TTLPolicy{}).Freshness(EntryInfo{}); actual != FRESH {
+		t.Errorf("Entries should never expire with zero TTL, got %v", actual)
+	}
+}
+
+func TestLookupActivityListReportsFreshness(t *testing.T) {
+	storedAt := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	restore := withNow(storedAt)
+	cache := NewMapActivityCache()
+	cache.Store(context.Background(), 1, ActivityList{})
+	restore()
+
+	policy := TTLPolicy{TTL: time.Hour}
+	defer withNow(storedAt.Add(2 * time.Hour))()
+	if _, freshness, err := LookupActivityList(context.Background(), cache, policy, 1); err != nil || freshness != STALE {
+		t.Errorf("Expected stale list, got %v, %v", freshness, err)
+	}
+	if _, freshness, err := LookupActivityList(context.Background(), cache, policy, 2); err != nil || freshness != MISSING {
+		t.Errorf("Expected missing list, got %v, %v", freshness, err)
+	}
+}
+
+func TestDecodeLegacyEntry(t *testing.T) {
+	var activities ActivityList
+	info, err := decodeEntry([]byte(`[{"id": 1}]`), KIND_ACTIVITY_LIST, 1, &activities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.StoredAt.IsZero() || len(activities) != 1 || activities[0].Id != 1 {
+		t.Errorf("Legacy entry decoded incorrectly: %v, %v", info, activities)
+	}
+}
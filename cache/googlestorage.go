@@ -2,108 +2,450 @@ package cache
 
 import (
 	"cloud.google.com/go/storage"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"path"
+	"strings"
+	"sync"
 )
 
-// datastore-based activity cache
+// google cloud storage-based activity cache
 
 type GoogleStorageActivityCache struct {
-	ctx        context.Context
-	bucketName string
-	cacheRoot  string
+	store     objectStore
+	cacheRoot string
+	// highest generations of activity lists and sync states seen by this
+	// instance, their writes are conditional on them so updates made by
+	// other instances in between are not lost
+	generationsMutex sync.Mutex
+	generations      map[string]int64
 }
 
-func NewGoogleStorageActivityCache(ctx context.Context, bucketName string, prefix string) ActivityCache {
-	return &GoogleStorageActivityCache{ctx, bucketName, prefix}
+// NewGoogleStorageActivityCache creates cache in bucket, using endpoint
+// from STRAVA_CACHE_GCS_ENDPOINT if set.
+func NewGoogleStorageActivityCache(bucketName string, prefix string) ActivityCache {
+	return NewGoogleStorageActivityCacheWithEndpoint(bucketName, prefix, DEFAULT_GCS_ENDPOINT)
 }
 
-func (c *GoogleStorageActivityCache) activityListFilename(athleteId int64) string {
-	return path.Join(c.cacheRoot, fmt.Sprintf("users/%v/activity_list.json", athleteId))
+// NewGoogleStorageActivityCacheWithEndpoint creates cache accessing storage
+// at endpoint without authentication, which is useful with local storage
+// emulator. Empty endpoint means production storage.
+func NewGoogleStorageActivityCacheWithEndpoint(bucketName string, prefix string, endpoint string) *GoogleStorageActivityCache {
+	return &GoogleStorageActivityCache{
+		store:     &gcsObjectStore{bucketName: bucketName, endpoint: endpoint},
+		cacheRoot: prefix,
+	}
 }
 
-func (c *GoogleStorageActivityCache) activityFilename(activityId int64) string {
-	return path.Join(
-		c.cacheRoot,
-		fmt.Sprintf("activities/%v/activity.json", activityId))
+// Close releases storage client.
+func (c *GoogleStorageActivityCache) Close() error {
+	if closer, ok := c.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
 }
 
-func (c *GoogleStorageActivityCache) storeAtPath(path string, goObject interface{}) {
-	data, err := json.Marshal(goObject)
-	if err != nil {
-		panic(err.Error())
+// write preconditions
+const (
+	// object is written regardless of its generation
+	anyGeneration int64 = -1
+	// object is written only if it does not exist
+	noGeneration int64 = 0
+)
+
+var errPreconditionFailed = errors.New("object generation does not match precondition")
+
+// objectStore is the part of cloud storage API used by the cache,
+// replaced with in-memory fake in tests
+type objectStore interface {
+	// read object content and generation, returns storage.ErrObjectNotExist
+	// if not present
+	Read(ctx context.Context, name string) ([]byte, int64, error)
+
+	// replace object content if its generation matches ifGeneration, returns
+	// generation of written object or errPreconditionFailed
+	Write(ctx context.Context, name string, data []byte, ifGeneration int64) (int64, error)
+
+	// delete object if its generation matches ifGeneration
+	Delete(ctx context.Context, name string, ifGeneration int64) error
+
+	// list names of "directories" directly under prefix ending with /
+	ListPrefixes(ctx context.Context, prefix string) ([]string, error)
+
+	// tell whether object is present without reading it
+	Exists(ctx context.Context, name string) (bool, error)
+}
+
+type gcsObjectStore struct {
+	bucketName string
+	endpoint   string
+	// client is created on first use and shared by all requests
+	mutex  sync.Mutex
+	client *storage.Client
+}
+
+func (s *gcsObjectStore) bucket() (*storage.BucketHandle, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client == nil {
+		var opts []option.ClientOption
+		if s.endpoint != "" {
+			opts = append(opts, option.WithEndpoint(s.endpoint), option.WithoutAuthentication())
+		}
+		// client outlives requests, so it can not use request context
+		client, err := storage.NewClient(context.Background(), opts...)
+		if err != nil {
+			return nil, err
+		}
+		s.client = client
+	}
+	return s.client.Bucket(s.bucketName), nil
+}
+
+func (s *gcsObjectStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client == nil {
+		return nil
 	}
-	client, err := storage.NewClient(c.ctx)
-	defer client.Close()
+	err := s.client.Close()
+	s.client = nil
+	return err
+}
+
+func withGeneration(object *storage.ObjectHandle, generation int64) *storage.ObjectHandle {
+	switch generation {
+	case anyGeneration:
+		return object
+	case noGeneration:
+		return object.If(storage.Conditions{DoesNotExist: true})
+	default:
+		return object.If(storage.Conditions{GenerationMatch: generation})
+	}
+}
+
+func isPreconditionFailed(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusPreconditionFailed
+}
+
+func (s *gcsObjectStore) Write(ctx context.Context, name string, data []byte, ifGeneration int64) (int64, error) {
+	bucket, err := s.bucket()
 	if err != nil {
-		panic(err.Error())
+		return 0, err
 	}
-	bucket := client.Bucket(c.bucketName)
-	object := bucket.Object(path)
-	writer := object.NewWriter(c.ctx)
-	if _, err = writer.Write(data); err != nil {
-		writer.Close()
-		if err := object.Delete(c.ctx); err != nil {
-			panic(fmt.Sprintf("Failed to delete cache object after unsuccessful write: %s", err.Error()))
-		} else {
-			panic(fmt.Sprintf("Failed to save cache object, it have been erased from cache. Original error: %s", err.Error()))
-		}
-	} else {
+	// uploads are atomic, cancelled upload leaves previous content in place
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := withGeneration(bucket.Object(name), ifGeneration).NewWriter(ctx)
+	if _, err := writer.Write(data); err != nil {
+		cancel()
 		writer.Close()
+		return 0, fmt.Errorf("Failed to save cache object %s: %s", name, err.Error())
+	}
+	if err := writer.Close(); isPreconditionFailed(err) {
+		return 0, errPreconditionFailed
+	} else if err != nil {
+		return 0, err
 	}
+	return writer.Attrs().Generation, nil
+}
 
+func (s *gcsObjectStore) Delete(ctx context.Context, name string, ifGeneration int64) error {
+	bucket, err := s.bucket()
+	if err != nil {
+		return err
+	}
+	err = withGeneration(bucket.Object(name), ifGeneration).Delete(ctx)
+	if isPreconditionFailed(err) {
+		return errPreconditionFailed
+	}
+	return err
 }
 
-func (c *GoogleStorageActivityCache) getFromPath(path string, goObject interface{}) bool {
-	client, err := storage.NewClient(c.ctx)
-	defer client.Close()
+func (s *gcsObjectStore) Read(ctx context.Context, name string) ([]byte, int64, error) {
+	bucket, err := s.bucket()
 	if err != nil {
-		panic(err.Error())
+		return nil, 0, err
 	}
-	bucket := client.Bucket(c.bucketName)
-	object := bucket.Object(path)
-	reader, err := object.NewReader(c.ctx)
+	reader, err := bucket.Object(name).NewReader(ctx)
 	if err != nil {
-		if err == storage.ErrObjectNotExist {
-			return false
-		} else {
-			panic(err.Error())
-		}
+		return nil, 0, err
 	}
 	defer reader.Close()
 	data, err := ioutil.ReadAll(reader)
 	if err != nil {
-		panic(err.Error())
+		return nil, 0, err
 	}
-	if err := json.Unmarshal([]byte(data), goObject); err != nil {
-		panic(err.Error())
+	return data, reader.Attrs.Generation, nil
+}
+
+func (s *gcsObjectStore) Exists(ctx context.Context, name string) (bool, error) {
+	bucket, err := s.bucket()
+	if err != nil {
+		return false, err
+	}
+	_, err = bucket.Object(name).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *gcsObjectStore) ListPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	bucket, err := s.bucket()
+	if err != nil {
+		return nil, err
 	}
-	return true
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: "/"})
+	names := make([]string, 0)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if attrs.Prefix != "" {
+			names = append(names, path.Base(attrs.Prefix))
+		}
+	}
+	return names, nil
+}
+
+// seenGeneration returns precondition for write of tracked object
+func (c *GoogleStorageActivityCache) seenGeneration(path string) int64 {
+	c.generationsMutex.Lock()
+	defer c.generationsMutex.Unlock()
+	if generation, ok := c.generations[path]; ok {
+		return generation
+	}
+	return anyGeneration
+}
+
+// seeGeneration remembers generation of tracked object, generations only grow
+func (c *GoogleStorageActivityCache) seeGeneration(path string, generation int64) {
+	c.generationsMutex.Lock()
+	defer c.generationsMutex.Unlock()
+	if c.generations == nil {
+		c.generations = make(map[string]int64)
+	}
+	if seen, ok := c.generations[path]; !ok || generation > seen {
+		c.generations[path] = generation
+	}
+}
+
+func (c *GoogleStorageActivityCache) activityListFilename(athleteId int64) string {
+	return path.Join(c.cacheRoot, fmt.Sprintf("users/%v/activity_list.json", athleteId))
+}
+
+func (c *GoogleStorageActivityCache) syncStateFilename(athleteId int64) string {
+	return path.Join(c.cacheRoot, fmt.Sprintf("users/%v/sync_state.json", athleteId))
+}
+
+func (c *GoogleStorageActivityCache) hydrationStateFilename(athleteId int64) string {
+	return path.Join(c.cacheRoot, fmt.Sprintf("users/%v/hydration_state.json", athleteId))
 }
 
-func (c *GoogleStorageActivityCache) Store(athleteId int64, activities ActivityList) {
+func (c *GoogleStorageActivityCache) activityFilename(athleteId int64, activityId int64) string {
+	return path.Join(
+		c.cacheRoot,
+		fmt.Sprintf("users/%v/activities/%v/activity.json", athleteId, activityId))
+}
+
+func (c *GoogleStorageActivityCache) streamsFilename(athleteId int64, activityId int64) string {
+	return path.Join(
+		c.cacheRoot,
+		fmt.Sprintf("users/%v/activities/%v/streams.dat", athleteId, activityId))
+}
+
+// activities used to be stored without athlete scope
+func (c *GoogleStorageActivityCache) legacyActivityFilename(activityId int64) string {
+	return path.Join(
+		c.cacheRoot,
+		fmt.Sprintf("activities/%v/activity.json", activityId))
+}
+
+func (c *GoogleStorageActivityCache) storeAtPath(ctx context.Context, path string, goObject interface{}, ifGeneration int64) (int64, error) {
+	data, err := encodeEntry(goObject, EntryInfo{StoredAt: now()})
+	if err != nil {
+		return 0, err
+	}
+	return c.store.Write(ctx, path, data, ifGeneration)
+}
+
+func (c *GoogleStorageActivityCache) getFromPath(ctx context.Context, path string, kind string, id int64, goObject interface{}) (EntryInfo, int64, error) {
+	data, generation, err := c.store.Read(ctx, path)
+	if err == storage.ErrObjectNotExist {
+		return EntryInfo{}, noGeneration, &NotFoundError{kind, id}
+	} else if err != nil {
+		return EntryInfo{}, 0, err
+	}
+	info, err := decodeEntry(data, kind, id, goObject)
+	return info, generation, err
+}
+
+// storeTracked writes object unless it was modified since this instance
+// has seen it
+func (c *GoogleStorageActivityCache) storeTracked(ctx context.Context, path string, kind string, id int64, goObject interface{}) error {
+	generation, err := c.storeAtPath(ctx, path, goObject, c.seenGeneration(path))
+	if err == errPreconditionFailed {
+		return &ConflictError{kind, id}
+	} else if err != nil {
+		return err
+	}
+	c.seeGeneration(path, generation)
+	return nil
+}
+
+func (c *GoogleStorageActivityCache) getTracked(ctx context.Context, path string, kind string, id int64, goObject interface{}) (EntryInfo, error) {
+	info, generation, err := c.getFromPath(ctx, path, kind, id, goObject)
+	if err == nil || IsNotFound(err) || IsDecodeError(err) {
+		c.seeGeneration(path, generation)
+	}
+	return info, err
+}
+
+func (c *GoogleStorageActivityCache) Store(ctx context.Context, athleteId int64, activities ActivityList) error {
 	path := c.activityListFilename(athleteId)
-	c.storeAtPath(path, &activities)
+	return c.storeTracked(ctx, path, KIND_ACTIVITY_LIST, athleteId, &activities)
 }
 
-func (c *GoogleStorageActivityCache) Get(athleteId int64) (ActivityList, bool) {
+func (c *GoogleStorageActivityCache) Get(ctx context.Context, athleteId int64) (ActivityList, EntryInfo, error) {
 	path := c.activityListFilename(athleteId)
 	activities := make(ActivityList, 0)
-	ok := c.getFromPath(path, &activities)
-	return activities, ok
+	info, err := c.getTracked(ctx, path, KIND_ACTIVITY_LIST, athleteId, &activities)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return activities, info, nil
+}
+
+func (c *GoogleStorageActivityCache) StoreActivity(ctx context.Context, athleteId int64, activityId int64, activity *ExtendedActivityInfo) error {
+	path := c.activityFilename(athleteId, activityId)
+	_, err := c.storeAtPath(ctx, path, activity, anyGeneration)
+	return err
+}
+
+func (c *GoogleStorageActivityCache) GetActivity(ctx context.Context, athleteId int64, activityId int64) (*ExtendedActivityInfo, EntryInfo, error) {
+	path := c.activityFilename(athleteId, activityId)
+	var activity ExtendedActivityInfo
+	info, _, err := c.getFromPath(ctx, path, KIND_ACTIVITY, activityId, &activity)
+	if IsNotFound(err) {
+		return c.migrateLegacyActivity(ctx, athleteId, activityId)
+	} else if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	if !activity.OwnedBy(athleteId) {
+		return nil, EntryInfo{}, &NotFoundError{KIND_ACTIVITY, activityId}
+	}
+	return &activity, info, nil
 }
 
-func (c *GoogleStorageActivityCache) StoreActivity(activityId int64, activity *ExtendedActivityInfo) {
-	path := c.activityFilename(activityId)
-	c.storeAtPath(path, activity)
+// migrateLegacyActivity copies activity stored without athlete scope under
+// athlete prefix, if it is owned by the athlete
+func (c *GoogleStorageActivityCache) migrateLegacyActivity(ctx context.Context, athleteId int64, activityId int64) (*ExtendedActivityInfo, EntryInfo, error) {
+	legacyPath := c.legacyActivityFilename(activityId)
+	var activity ExtendedActivityInfo
+	info, legacyGeneration, err := c.getFromPath(ctx, legacyPath, KIND_ACTIVITY, activityId, &activity)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	if !activity.OwnedBy(athleteId) {
+		return nil, EntryInfo{}, &NotFoundError{KIND_ACTIVITY, activityId}
+	}
+	infof(ctx, "Migrating %v to %v", legacyPath, c.activityFilename(athleteId, activityId))
+	// activity downloaded concurrently is newer than legacy copy
+	_, err = c.storeAtPath(ctx, c.activityFilename(athleteId, activityId), &activity, noGeneration)
+	if err != nil && err != errPreconditionFailed {
+		return nil, EntryInfo{}, err
+	}
+	if err := c.store.Delete(ctx, legacyPath, legacyGeneration); err != nil {
+		warningf(ctx, "Failed to remove migrated %v: %v", legacyPath, err)
+	}
+	return &activity, info, nil
+}
+
+func (c *GoogleStorageActivityCache) StoreSyncState(ctx context.Context, athleteId int64, state *SyncState) error {
+	path := c.syncStateFilename(athleteId)
+	return c.storeTracked(ctx, path, KIND_SYNC_STATE, athleteId, state)
 }
 
-func (c *GoogleStorageActivityCache) GetActivity(activityId int64) (*ExtendedActivityInfo, bool) {
-	path := c.activityFilename(activityId)
-	var info ExtendedActivityInfo
-	ok := c.getFromPath(path, &info)
-	return &info, ok
+func (c *GoogleStorageActivityCache) GetSyncState(ctx context.Context, athleteId int64) (*SyncState, error) {
+	path := c.syncStateFilename(athleteId)
+	var state SyncState
+	if _, err := c.getTracked(ctx, path, KIND_SYNC_STATE, athleteId, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// checkpoint is written by single running job, so last write wins
+func (c *GoogleStorageActivityCache) StoreHydrationState(ctx context.Context, athleteId int64, state *HydrationState) error {
+	_, err := c.storeAtPath(ctx, c.hydrationStateFilename(athleteId), state, anyGeneration)
+	return err
+}
+
+func (c *GoogleStorageActivityCache) GetHydrationState(ctx context.Context, athleteId int64) (*HydrationState, error) {
+	var state HydrationState
+	if _, _, err := c.getFromPath(ctx, c.hydrationStateFilename(athleteId), KIND_HYDRATION, athleteId, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (c *GoogleStorageActivityCache) StoreStreams(ctx context.Context, athleteId int64, activityId int64, streams *ActivityStreams) error {
+	_, err := c.storeAtPath(ctx, c.streamsFilename(athleteId, activityId), streams, anyGeneration)
+	return err
+}
+
+func (c *GoogleStorageActivityCache) GetStreams(ctx context.Context, athleteId int64, activityId int64) (*ActivityStreams, EntryInfo, error) {
+	var streams ActivityStreams
+	info, _, err := c.getFromPath(ctx, c.streamsFilename(athleteId, activityId), KIND_STREAMS, activityId, &streams)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return &streams, info, nil
+}
+
+// listPrefixes returns names of "directories" directly under prefix
+func (c *GoogleStorageActivityCache) listPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	prefix = strings.TrimPrefix(path.Join(c.cacheRoot, prefix)+"/", "/")
+	return c.store.ListPrefixes(ctx, prefix)
+}
+
+func (c *GoogleStorageActivityCache) ListAthletes(ctx context.Context) ([]int64, error) {
+	names, err := c.listPrefixes(ctx, "users")
+	if err != nil {
+		return nil, err
+	}
+	// athlete directory may only hold activities, streams or sync state
+	athleteIds := make([]int64, 0)
+	for _, athleteId := range parseIds(names) {
+		exists, err := c.store.Exists(ctx, c.activityListFilename(athleteId))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			athleteIds = append(athleteIds, athleteId)
+		}
+	}
+	return athleteIds, nil
+}
+
+func (c *GoogleStorageActivityCache) ListActivities(ctx context.Context, athleteId int64) ([]int64, error) {
+	names, err := c.listPrefixes(ctx, fmt.Sprintf("users/%v/activities", athleteId))
+	if err != nil {
+		return nil, err
+	}
+	return parseIds(names), nil
 }
@@ -0,0 +1,34 @@
+package cache_test
+
+import (
+	"fmt"
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"github.com/chemikadze/strava-analysis-ui/cache/cachetest"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestGoogleStorageCacheIntegration runs conformance tests against storage
+// emulator or real bucket, see README for setup
+func TestGoogleStorageCacheIntegration(t *testing.T) {
+	bucket := os.Getenv("STRAVA_CACHE_GCS_TEST_BUCKET")
+	if bucket == "" {
+		t.Skip("STRAVA_CACHE_GCS_TEST_BUCKET is not set")
+	}
+	endpoint := os.Getenv("STRAVA_CACHE_GCS_TEST_ENDPOINT")
+	run := time.Now().UnixNano()
+	var caches []*cache.GoogleStorageActivityCache
+	defer func() {
+		for _, c := range caches {
+			c.Close()
+		}
+	}()
+	cachetest.Run(t, func(t *testing.T) cache.ActivityCache {
+		// every test case gets its own prefix in shared bucket
+		prefix := fmt.Sprintf("test-%v/%v", run, len(caches))
+		c := cache.NewGoogleStorageActivityCacheWithEndpoint(bucket, prefix, endpoint)
+		caches = append(caches, c)
+		return c
+	})
+}
@@ -1,14 +1,17 @@
 package cache
 
 import (
+	"cloud.google.com/go/storage"
+	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
 	"testing"
 )
 
 func TestObjectKeyFormat(t *testing.T) {
 	cache := GoogleStorageActivityCache{}
 	activityId := int64(1235)
-	expected := "activities/1235/activity.json"
-	actual := cache.activityFilename(activityId)
+	expected := "users/42/activities/1235/activity.json"
+	actual := cache.activityFilename(42, activityId)
 	if expected != actual {
 		t.Errorf("%s != %s", expected, actual)
 	}
@@ -19,8 +22,8 @@ func TestPrefixedObjectKeyFormat(t *testing.T) {
 		cacheRoot: "my/object/prefix",
 	}
 	activityId := int64(1235)
-	expected := "my/object/prefix/activities/1235/activity.json"
-	actual := cache.activityFilename(activityId)
+	expected := "my/object/prefix/users/42/activities/1235/activity.json"
+	actual := cache.activityFilename(42, activityId)
 	if expected != actual {
 		t.Errorf("%s != %s", expected, actual)
 	}
@@ -31,9 +34,67 @@ func TestPrefixedWithSlashObjectKeyFormat(t *testing.T) {
 		cacheRoot: "my/object/prefix/",
 	}
 	activityId := int64(1235)
+	expected := "my/object/prefix/users/42/activities/1235/activity.json"
+	actual := cache.activityFilename(42, activityId)
+	if expected != actual {
+		t.Errorf("%s != %s", expected, actual)
+	}
+}
+
+func TestLegacyObjectKeyFormat(t *testing.T) {
+	cache := GoogleStorageActivityCache{
+		cacheRoot: "my/object/prefix",
+	}
+	activityId := int64(1235)
 	expected := "my/object/prefix/activities/1235/activity.json"
-	actual := cache.activityFilename(activityId)
+	actual := cache.legacyActivityFilename(activityId)
 	if expected != actual {
 		t.Errorf("%s != %s", expected, actual)
 	}
 }
+
+func TestGoogleStorageCacheDetectsConcurrentUpdate(t *testing.T) {
+	ctx := context.Background()
+	store := newFakeObjectStore()
+	first := &GoogleStorageActivityCache{store: store}
+	second := &GoogleStorageActivityCache{store: store}
+	first.Store(ctx, 1, ActivityList{})
+
+	// both instances read the list, second one updates it first
+	first.Get(ctx, 1)
+	second.Get(ctx, 1)
+	if err := second.Store(ctx, 1, ActivityList{&strava.ActivitySummary{Id: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Store(ctx, 1, ActivityList{&strava.ActivitySummary{Id: 1}}); !IsConflict(err) {
+		t.Errorf("Update based on outdated list should conflict, got %v", err)
+	}
+	activities, _, err := first.Get(ctx, 1)
+	if err != nil || len(activities) != 1 || activities[0].Id != 2 {
+		t.Errorf("Concurrent update should be kept, got %v, %v", activities, err)
+	}
+	// after re-reading list can be updated again
+	if err := first.Store(ctx, 1, ActivityList{}); err != nil {
+		t.Errorf("Update after re-read should succeed, got %v", err)
+	}
+}
+
+func TestGoogleStorageCacheMigrationKeepsNewerActivity(t *testing.T) {
+	ctx := context.Background()
+	cache := &GoogleStorageActivityCache{store: newFakeObjectStore()}
+	activityId := int64(12345)
+	cache.storeAtPath(ctx, cache.legacyActivityFilename(activityId), ownedActivity(1, activityId), anyGeneration)
+	newer := ownedActivity(1, activityId)
+	newer.Activity.Name = "Newer"
+	// migration raced with download of the activity
+	cache.storeAtPath(ctx, cache.activityFilename(1, activityId), newer, noGeneration)
+	cache.migrateLegacyActivity(ctx, 1, activityId)
+
+	activity, _, err := cache.GetActivity(ctx, 1, activityId)
+	if err != nil || activity.Activity.Name != "Newer" {
+		t.Errorf("Migration should not overwrite newer activity, got %v, %v", activity, err)
+	}
+	if _, _, err := cache.store.Read(ctx, cache.legacyActivityFilename(activityId)); err != storage.ErrObjectNotExist {
+		t.Errorf("Legacy object should be deleted, got %v", err)
+	}
+}
@@ -0,0 +1,13 @@
+package cache
+
+import (
+	"google.golang.org/appengine/log"
+)
+
+// logging of backends which require App Engine context, replaced in tests
+// which run these backends against in-process fakes
+var (
+	debugf   = log.Debugf
+	infof    = log.Infof
+	warningf = log.Warningf
+)
@@ -1,39 +1,258 @@
 package cache
 
-// in-memory map activity cache
+import (
+	"container/list"
+	"encoding"
+	"encoding/json"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+// in-memory map activity cache, safe for concurrent use, evicts least
+// recently used entries when entry count or byte budget is exceeded. Only
+// activities and streams count against entry budget, so they never push
+// out few lists and job states of each athlete.
 
 type MapActivityCache struct {
-	activityLists   map[int64]ActivityList
-	activityDetails map[int64]*ExtendedActivityInfo
+	mutex      sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	usedBytes  int64
+	// number of entries counting against maxEntries
+	countedEntries int
+	// most recently used entries are at the front
+	lru     *list.List
+	entries map[mapKey]*list.Element
+	stats   CacheStats
+}
+
+type mapKey struct {
+	kind      string
+	athleteId int64
+	id        int64
+}
+
+type mapEntry struct {
+	key   mapKey
+	value interface{}
+	info  EntryInfo
+	size  int64
+	// time entry was put into this cache, differs from info.StoredAt for
+	// entries copied from another cache
+	cachedAt time.Time
+}
+
+// CacheStats holds usage counters of in-memory cache.
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Entries   int
+	Bytes     int64
 }
 
+// NewMapActivityCache creates in-memory cache limited by
+// STRAVA_CACHE_MEMORY_MAX_ENTRIES and STRAVA_CACHE_MEMORY_MAX_BYTES.
 func NewMapActivityCache() ActivityCache {
-	var cache MapActivityCache
-	cache.activityLists = make(map[int64]ActivityList)
-	cache.activityDetails = make(map[int64]*ExtendedActivityInfo)
-	return &cache
+	return NewBoundedMapActivityCache(DEFAULT_MEMORY_MAX_ENTRIES, DEFAULT_MEMORY_MAX_BYTES)
+}
+
+// NewBoundedMapActivityCache creates in-memory cache holding at most maxEntries
+// activities and streams, and entries of total estimated size maxBytes, zero
+// means no limit.
+func NewBoundedMapActivityCache(maxEntries int, maxBytes int64) *MapActivityCache {
+	return &MapActivityCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		lru:        list.New(),
+		entries:    make(map[mapKey]*list.Element),
+	}
+}
+
+// Stats returns snapshot of cache usage counters.
+func (c *MapActivityCache) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	stats.Bytes = c.usedBytes
+	return stats
+}
+
+// estimateSize approximates memory footprint of value by size of its
+// encoding
+func estimateSize(value interface{}) int64 {
+	var data []byte
+	var err error
+	if marshaler, ok := value.(encoding.BinaryMarshaler); ok {
+		data, err = marshaler.MarshalBinary()
+	} else {
+		data, err = json.Marshal(value)
+	}
+	if err != nil {
+		return 0
+	}
+	return int64(len(data))
+}
+
+func (c *MapActivityCache) put(key mapKey, value interface{}, info EntryInfo) {
+	size := int64(0)
+	if c.maxBytes > 0 {
+		size = estimateSize(value)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.removeElement(element)
+	}
+	entry := &mapEntry{key, value, info, size, now()}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.usedBytes += size
+	if countedKind(key.kind) {
+		c.countedEntries++
+	}
+	// newest entry is kept even if it alone exceeds the budget
+	for c.maxEntries > 0 && c.countedEntries > c.maxEntries {
+		element := c.lru.Back()
+		for !countedKind(element.Value.(*mapEntry).key.kind) {
+			element = element.Prev()
+		}
+		c.removeElement(element)
+		c.stats.Evictions++
+	}
+	for c.maxBytes > 0 && c.usedBytes > c.maxBytes && c.lru.Len() > 1 {
+		c.removeElement(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// countedKind tells whether entries of kind count against maxEntries
+func countedKind(kind string) bool {
+	return kind == KIND_ACTIVITY || kind == KIND_STREAMS
+}
+
+func (c *MapActivityCache) get(key mapKey) (*mapEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(element)
+		c.stats.Hits++
+		return element.Value.(*mapEntry), true
+	}
+	c.stats.Misses++
+	return nil, false
+}
+
+func (c *MapActivityCache) remove(key mapKey) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.removeElement(element)
+	}
 }
 
-func (c *MapActivityCache) Store(athleteId int64, activities ActivityList) {
-	c.activityLists[athleteId] = activities
+func (c *MapActivityCache) removeElement(element *list.Element) {
+	entry := element.Value.(*mapEntry)
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+	c.usedBytes -= entry.size
+	if countedKind(entry.key.kind) {
+		c.countedEntries--
+	}
+}
+
+func (c *MapActivityCache) Store(ctx context.Context, athleteId int64, activities ActivityList) error {
+	c.put(mapKey{KIND_ACTIVITY_LIST, athleteId, athleteId}, activities, EntryInfo{StoredAt: now()})
+	return nil
 }
 
-func (c *MapActivityCache) Get(athleteId int64) (ActivityList, bool) {
-	if activities, ok := c.activityLists[athleteId]; ok {
-		return activities, true
+func (c *MapActivityCache) Get(ctx context.Context, athleteId int64) (ActivityList, EntryInfo, error) {
+	if entry, ok := c.get(mapKey{KIND_ACTIVITY_LIST, athleteId, athleteId}); ok {
+		return entry.value.(ActivityList), entry.info, nil
 	} else {
-		return nil, false
+		return nil, EntryInfo{}, &NotFoundError{KIND_ACTIVITY_LIST, athleteId}
 	}
 }
 
-func (c *MapActivityCache) GetActivity(activityId int64) (*ExtendedActivityInfo, bool) {
-	if activity, ok := c.activityDetails[activityId]; ok {
-		return activity, true
+func (c *MapActivityCache) GetActivity(ctx context.Context, athleteId int64, activityId int64) (*ExtendedActivityInfo, EntryInfo, error) {
+	if entry, ok := c.get(mapKey{KIND_ACTIVITY, athleteId, activityId}); ok {
+		if activity := entry.value.(*ExtendedActivityInfo); activity.OwnedBy(athleteId) {
+			return activity, entry.info, nil
+		}
+	}
+	return nil, EntryInfo{}, &NotFoundError{KIND_ACTIVITY, activityId}
+}
+
+func (c *MapActivityCache) StoreActivity(ctx context.Context, athleteId int64, activityId int64, activity *ExtendedActivityInfo) error {
+	c.put(mapKey{KIND_ACTIVITY, athleteId, activityId}, activity, EntryInfo{StoredAt: now()})
+	return nil
+}
+
+func (c *MapActivityCache) StoreSyncState(ctx context.Context, athleteId int64, state *SyncState) error {
+	c.put(mapKey{KIND_SYNC_STATE, athleteId, athleteId}, state, EntryInfo{StoredAt: now()})
+	return nil
+}
+
+func (c *MapActivityCache) GetSyncState(ctx context.Context, athleteId int64) (*SyncState, error) {
+	if entry, ok := c.get(mapKey{KIND_SYNC_STATE, athleteId, athleteId}); ok {
+		return entry.value.(*SyncState), nil
 	} else {
-		return nil, false
+		return nil, &NotFoundError{KIND_SYNC_STATE, athleteId}
 	}
 }
 
-func (c *MapActivityCache) StoreActivity(activityId int64, activity *ExtendedActivityInfo) {
-	c.activityDetails[activityId] = activity
+func (c *MapActivityCache) StoreHydrationState(ctx context.Context, athleteId int64, state *HydrationState) error {
+	c.put(mapKey{KIND_HYDRATION, athleteId, athleteId}, state, EntryInfo{StoredAt: now()})
+	return nil
+}
+
+func (c *MapActivityCache) GetHydrationState(ctx context.Context, athleteId int64) (*HydrationState, error) {
+	if entry, ok := c.get(mapKey{KIND_HYDRATION, athleteId, athleteId}); ok {
+		return entry.value.(*HydrationState), nil
+	}
+	return nil, &NotFoundError{KIND_HYDRATION, athleteId}
+}
+
+func (c *MapActivityCache) StoreStreams(ctx context.Context, athleteId int64, activityId int64, streams *ActivityStreams) error {
+	c.put(mapKey{KIND_STREAMS, athleteId, activityId}, streams, EntryInfo{StoredAt: now()})
+	return nil
+}
+
+func (c *MapActivityCache) GetStreams(ctx context.Context, athleteId int64, activityId int64) (*ActivityStreams, EntryInfo, error) {
+	if entry, ok := c.get(mapKey{KIND_STREAMS, athleteId, activityId}); ok {
+		return entry.value.(*ActivityStreams), entry.info, nil
+	}
+	return nil, EntryInfo{}, &NotFoundError{KIND_STREAMS, activityId}
+}
+
+// listIds returns unique ids of entries of any of kinds
+func (c *MapActivityCache) listIds(athleteId int64, anyAthlete bool, kinds ...string) []int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ids := make([]int64, 0)
+	seen := make(map[int64]bool)
+	for key := range c.entries {
+		if seen[key.id] || !(anyAthlete || key.athleteId == athleteId) {
+			continue
+		}
+		for _, kind := range kinds {
+			if key.kind == kind {
+				seen[key.id] = true
+				ids = append(ids, key.id)
+				break
+			}
+		}
+	}
+	sortIds(ids)
+	return ids
+}
+
+func (c *MapActivityCache) ListAthletes(ctx context.Context) ([]int64, error) {
+	return c.listIds(0, true, KIND_ACTIVITY_LIST), nil
+}
+
+func (c *MapActivityCache) ListActivities(ctx context.Context, athleteId int64) ([]int64, error) {
+	return c.listIds(athleteId, false, KIND_ACTIVITY, KIND_STREAMS), nil
 }
@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
+	"sync"
+	"testing"
+)
+
+func TestMapCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	cache := NewBoundedMapActivityCache(2, 0)
+	cache.StoreActivity(ctx, 1, 1, ownedActivity(1, 1))
+	cache.StoreActivity(ctx, 1, 2, ownedActivity(1, 2))
+	// touch 1, so 2 becomes least recently used
+	cache.GetActivity(ctx, 1, 1)
+	cache.StoreActivity(ctx, 1, 3, ownedActivity(1, 3))
+
+	if _, _, err := cache.GetActivity(ctx, 1, 2); !IsNotFound(err) {
+		t.Errorf("Least recently used entry should be evicted, got %v", err)
+	}
+	for _, activityId := range []int64{1, 3} {
+		if _, _, err := cache.GetActivity(ctx, 1, activityId); err != nil {
+			t.Errorf("Entry %v should be present, got %v", activityId, err)
+		}
+	}
+	stats := cache.Stats()
+	if stats.Evictions != 1 || stats.Hits != 3 || stats.Misses != 1 || stats.Entries != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestMapCacheCountsOnlyActivitiesAgainstEntryBudget(t *testing.T) {
+	ctx := context.Background()
+	cache := NewBoundedMapActivityCache(1, 0)
+	cache.Store(ctx, 1, ActivityList{})
+	cache.StoreSyncState(ctx, 1, &SyncState{})
+	cache.StoreHydrationState(ctx, 1, &HydrationState{})
+	cache.StoreActivity(ctx, 1, 1, ownedActivity(1, 1))
+	cache.StoreActivity(ctx, 1, 2, ownedActivity(1, 2))
+
+	if _, _, err := cache.GetActivity(ctx, 1, 1); !IsNotFound(err) {
+		t.Errorf("Older activity should be evicted, got %v", err)
+	}
+	if _, _, err := cache.Get(ctx, 1); err != nil {
+		t.Errorf("List should not be evicted by activities, got %v", err)
+	}
+	if _, err := cache.GetSyncState(ctx, 1); err != nil {
+		t.Errorf("Sync state should not be evicted by activities, got %v", err)
+	}
+	if stats := cache.Stats(); stats.Entries != 4 || stats.Evictions != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestMapCacheRespectsByteBudget(t *testing.T) {
+	ctx := context.Background()
+	activity := ownedActivity(1, 1)
+	activity.Activity.Name = "Morning Ride"
+	size := estimateSize(activity)
+	cache := NewBoundedMapActivityCache(0, 2*size)
+	for activityId := int64(1); activityId <= 3; activityId++ {
+		cache.StoreActivity(ctx, 1, activityId, activity)
+	}
+	stats := cache.Stats()
+	if stats.Entries != 2 || stats.Bytes > 2*size || stats.Evictions != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if _, _, err := cache.GetActivity(ctx, 1, 1); !IsNotFound(err) {
+		t.Errorf("Oldest activity should be evicted, got %v", err)
+	}
+}
+
+func TestMapCacheOverwriteDoesNotGrow(t *testing.T) {
+	ctx := context.Background()
+	cache := NewBoundedMapActivityCache(0, 0)
+	cache.Store(ctx, 1, ActivityList{})
+	cache.Store(ctx, 1, ActivityList{&strava.ActivitySummary{Id: 5}})
+	activities, _, err := cache.Get(ctx, 1)
+	if err != nil || len(activities) != 1 {
+		t.Errorf("Expected overwritten list, got %v, %v", activities, err)
+	}
+	if stats := cache.Stats(); stats.Entries != 1 {
+		t.Errorf("Overwrite should replace entry, got %+v", stats)
+	}
+}
+
+func TestMapCacheConcurrentAccess(t *testing.T) {
+	ctx := context.Background()
+	cache := NewBoundedMapActivityCache(10, 0)
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				id := int64(worker*100 + i%20)
+				cache.StoreActivity(ctx, id, id, ownedActivity(id, id))
+				cache.GetActivity(ctx, id, id)
+				cache.StoreSyncState(ctx, id, &SyncState{})
+				cache.GetSyncState(ctx, id)
+			}
+		}(worker)
+	}
+	wg.Wait()
+	if stats := cache.Stats(); cache.countedEntries > 10 || stats.Entries > 10+8*20 {
+		t.Errorf("Cache should not exceed max entries: %+v", stats)
+	}
+}
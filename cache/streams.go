@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// ActivityStreams holds time series recorded during activity, nil series
+// were not recorded.
+//
+// Streams are cached in columnar binary format: every series is stored as
+// zigzag varint deltas between consecutive samples, decimal series are
+// scaled to integers first. Altitude and distance keep centimeter precision,
+// coordinates keep 1e-7 degree precision.
+type ActivityStreams struct {
+	Time      []int        `json:"time,omitempty"`
+	Distance  []float64    `json:"distance,omitempty"`
+	Altitude  []float64    `json:"altitude,omitempty"`
+	LatLng    [][2]float64 `json:"latlng,omitempty"`
+	Heartrate []int        `json:"heartrate,omitempty"`
+	Cadence   []int        `json:"cadence,omitempty"`
+	Watts     []int        `json:"watts,omitempty"`
+}
+
+// column ids of binary format, never reuse them
+const (
+	streamColumnTime      = 1
+	streamColumnDistance  = 2
+	streamColumnAltitude  = 3
+	streamColumnLatLng    = 4
+	streamColumnHeartrate = 5
+	streamColumnCadence   = 6
+	streamColumnWatts     = 7
+)
+
+const (
+	streamMetersScale  = 100
+	streamDegreesScale = 1e7
+)
+
+func appendVarint(buf []byte, value int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], value)]...)
+}
+
+func appendUvarint(buf []byte, value uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], value)]...)
+}
+
+// appendDeltas writes count and deltas of values
+func appendDeltas(buf []byte, values []int64) []byte {
+	buf = appendUvarint(buf, uint64(len(values)))
+	previous := int64(0)
+	for _, value := range values {
+		buf = appendVarint(buf, value-previous)
+		previous = value
+	}
+	return buf
+}
+
+func intsToInt64(values []int) []int64 {
+	result := make([]int64, len(values))
+	for i, value := range values {
+		result[i] = int64(value)
+	}
+	return result
+}
+
+func scaleToInt64(values []float64, scale float64) []int64 {
+	result := make([]int64, len(values))
+	for i, value := range values {
+		result[i] = int64(math.Floor(value*scale + 0.5))
+	}
+	return result
+}
+
+// MarshalBinary encodes streams in columnar format.
+func (s *ActivityStreams) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, 1024)
+	appendColumn := func(id byte, values []int64) {
+		buf = append(buf, id)
+		buf = appendDeltas(buf, values)
+	}
+	if s.Time != nil {
+		appendColumn(streamColumnTime, intsToInt64(s.Time))
+	}
+	if s.Distance != nil {
+		appendColumn(streamColumnDistance, scaleToInt64(s.Distance, streamMetersScale))
+	}
+	if s.Altitude != nil {
+		appendColumn(streamColumnAltitude, scaleToInt64(s.Altitude, streamMetersScale))
+	}
+	if s.LatLng != nil {
+		// latitudes followed by longitudes, deltas are small within each half
+		values := make([]float64, 2*len(s.LatLng))
+		for i, point := range s.LatLng {
+			values[i] = point[0]
+			values[len(s.LatLng)+i] = point[1]
+		}
+		appendColumn(streamColumnLatLng, scaleToInt64(values, streamDegreesScale))
+	}
+	if s.Heartrate != nil {
+		appendColumn(streamColumnHeartrate, intsToInt64(s.Heartrate))
+	}
+	if s.Cadence != nil {
+		appendColumn(streamColumnCadence, intsToInt64(s.Cadence))
+	}
+	if s.Watts != nil {
+		appendColumn(streamColumnWatts, intsToInt64(s.Watts))
+	}
+	return buf, nil
+}
+
+func readDeltas(reader *bytes.Reader) ([]int64, error) {
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	// every value takes at least one byte
+	if count > uint64(reader.Len()) {
+		return nil, fmt.Errorf("column of %v values does not fit into %v bytes", count, reader.Len())
+	}
+	values := make([]int64, count)
+	previous := int64(0)
+	for i := range values {
+		delta, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		previous += delta
+		values[i] = previous
+	}
+	return values, nil
+}
+
+func int64ToInts(values []int64) []int {
+	result := make([]int, len(values))
+	for i, value := range values {
+		result[i] = int(value)
+	}
+	return result
+}
+
+func unscale(values []int64, scale float64) []float64 {
+	result := make([]float64, len(values))
+	for i, value := range values {
+		result[i] = float64(value) / scale
+	}
+	return result
+}
+
+// UnmarshalBinary decodes streams written by MarshalBinary.
+func (s *ActivityStreams) UnmarshalBinary(data []byte) error {
+	*s = ActivityStreams{}
+	reader := bytes.NewReader(data)
+	for reader.Len() > 0 {
+		id, _ := reader.ReadByte()
+		values, err := readDeltas(reader)
+		if err != nil {
+			return fmt.Errorf("can not read stream column %v: %s", id, err.Error())
+		}
+		switch id {
+		case streamColumnTime:
+			s.Time = int64ToInts(values)
+		case streamColumnDistance:
+			s.Distance = unscale(values, streamMetersScale)
+		case streamColumnAltitude:
+			s.Altitude = unscale(values, streamMetersScale)
+		case streamColumnLatLng:
+			if len(values)%2 != 0 {
+				return fmt.Errorf("odd number of coordinates: %v", len(values))
+			}
+			degrees := unscale(values, streamDegreesScale)
+			s.LatLng = make([][2]float64, len(values)/2)
+			for i := range s.LatLng {
+				s.LatLng[i] = [2]float64{degrees[i], degrees[len(s.LatLng)+i]}
+			}
+		case streamColumnHeartrate:
+			s.Heartrate = int64ToInts(values)
+		case streamColumnCadence:
+			s.Cadence = int64ToInts(values)
+		case streamColumnWatts:
+			s.Watts = int64ToInts(values)
+		default:
+			// column written by newer version, skipped
+		}
+	}
+	return nil
+}
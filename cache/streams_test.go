@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestStreamsEncodingKeepsPrecision(t *testing.T) {
+	streams := &ActivityStreams{
+		Time:     []int{0, 1, 5, 4},
+		Altitude: []float64{12.3, -4.56, 8848.86},
+		LatLng:   [][2]float64{{52.5162746, 13.3777041}, {-33.8567844, 151.2152967}},
+		Watts:    []int{},
+	}
+	data, err := streams.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ActivityStreams
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Time) != 4 || decoded.Time[2] != 5 || decoded.Time[3] != 4 {
+		t.Errorf("Unexpected time: %v", decoded.Time)
+	}
+	for i, altitude := range streams.Altitude {
+		if math.Abs(decoded.Altitude[i]-altitude) > 0.005 {
+			t.Errorf("Altitude %v decoded as %v", altitude, decoded.Altitude[i])
+		}
+	}
+	for i, point := range streams.LatLng {
+		if math.Abs(decoded.LatLng[i][0]-point[0]) > 1e-7 || math.Abs(decoded.LatLng[i][1]-point[1]) > 1e-7 {
+			t.Errorf("Point %v decoded as %v", point, decoded.LatLng[i])
+		}
+	}
+	if decoded.Watts == nil || len(decoded.Watts) != 0 {
+		t.Errorf("Empty stream should stay empty, got %v", decoded.Watts)
+	}
+	if decoded.Heartrate != nil {
+		t.Errorf("Missing stream should stay missing, got %v", decoded.Heartrate)
+	}
+}
+
+func TestStreamsEncodingIsCompact(t *testing.T) {
+	n := 3600
+	streams := &ActivityStreams{
+		Time:      make([]int, n),
+		Altitude:  make([]float64, n),
+		LatLng:    make([][2]float64, n),
+		Heartrate: make([]int, n),
+		Watts:     make([]int, n),
+	}
+	for i := 0; i < n; i++ {
+		streams.Time[i] = i
+		streams.Altitude[i] = 100 + math.Sin(float64(i)/100)*20
+		streams.LatLng[i] = [2]float64{52.5162746 + float64(i)*0.00003, 13.3777041 + float64(i)*0.00002}
+		streams.Heartrate[i] = 140 + i%20
+		streams.Watts[i] = 200 + i%50
+	}
+	data, _ := streams.MarshalBinary()
+	jsonData, _ := json.Marshal(streams)
+	if len(data)*5 > len(jsonData) {
+		t.Errorf("Binary encoding should be much smaller than json: %v vs %v bytes", len(data), len(jsonData))
+	}
+}
+
+func TestStreamsDecodingRejectsTruncatedData(t *testing.T) {
+	data, _ := (&ActivityStreams{Time: []int{1, 2, 3}}).MarshalBinary()
+	var decoded ActivityStreams
+	if err := decoded.UnmarshalBinary(data[:len(data)-2]); err == nil {
+		t.Error("Truncated streams should not be decoded")
+	}
+}
+
+func TestStreamsAreStoredInBinaryEnvelope(t *testing.T) {
+	data, err := encodeEntry(&ActivityStreams{Cadence: []int{90, 91}}, EntryInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _, err := unpackEntry(data)
+	if err != nil || header.Format != FORMAT_BINARY {
+		t.Errorf("Expected binary payload, got %+v, %v", header, err)
+	}
+	var streams ActivityStreams
+	if _, err := decodeEntry(data, KIND_STREAMS, 1, &streams); err != nil || len(streams.Cadence) != 2 {
+		t.Errorf("Unexpected decoded streams: %v, %v", streams, err)
+	}
+	var activity ExtendedActivityInfo
+	if _, err := decodeEntry(data, KIND_ACTIVITY, 1, &activity); !IsDecodeError(err) {
+		t.Errorf("Binary payload should not be decoded into json type, got %v", err)
+	}
+}
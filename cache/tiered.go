@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"golang.org/x/net/context"
+	"log"
+	"time"
+)
+
+// two-level activity cache: in-process memory cache in front of durable
+// backend, reads go through memory, writes go to backend first and then
+// to memory
+
+type TieredActivityCache struct {
+	front *MapActivityCache
+	back  ActivityCache
+	// entries which spent more than frontTTL in memory are re-read from
+	// backend, so writes made by other instances become visible, zero
+	// means forever
+	frontTTL time.Duration
+}
+
+func NewTieredActivityCache(front *MapActivityCache, back ActivityCache, frontTTL time.Duration) *TieredActivityCache {
+	return &TieredActivityCache{front, back, frontTTL}
+}
+
+// WithFrontCache puts in-memory cache configured by STRAVA_CACHE_FRONT in
+// front of backend.
+func WithFrontCache(backend ActivityCache) ActivityCache {
+	switch DEFAULT_CACHE_FRONT {
+	case "", "none":
+		return backend
+	case "memory":
+		if _, ok := backend.(*MapActivityCache); ok {
+			return backend
+		}
+		log.Printf("Using in-memory front cache, ttl: %v", DEFAULT_CACHE_FRONT_TTL)
+		front := NewBoundedMapActivityCache(DEFAULT_MEMORY_MAX_ENTRIES, DEFAULT_MEMORY_MAX_BYTES)
+		return NewTieredActivityCache(front, backend, DEFAULT_CACHE_FRONT_TTL)
+	default:
+		panic("Unknown front cache impl: " + DEFAULT_CACHE_FRONT)
+	}
+}
+
+// Front returns memory tier, useful to inspect its stats.
+func (c *TieredActivityCache) Front() *MapActivityCache {
+	return c.front
+}
+
+func (c *TieredActivityCache) getFront(key mapKey) (*mapEntry, bool) {
+	entry, ok := c.front.get(key)
+	if ok && c.frontTTL > 0 && now().Sub(entry.cachedAt) > c.frontTTL {
+		c.front.remove(key)
+		return nil, false
+	}
+	return entry, ok
+}
+
+func (c *TieredActivityCache) Store(ctx context.Context, athleteId int64, activities ActivityList) error {
+	key := mapKey{KIND_ACTIVITY_LIST, athleteId, athleteId}
+	if err := c.back.Store(ctx, athleteId, activities); err != nil {
+		if IsConflict(err) {
+			// backend has newer list than memory
+			c.front.remove(key)
+		}
+		return err
+	}
+	c.front.put(key, activities, EntryInfo{StoredAt: now()})
+	return nil
+}
+
+func (c *TieredActivityCache) Get(ctx context.Context, athleteId int64) (ActivityList, EntryInfo, error) {
+	key := mapKey{KIND_ACTIVITY_LIST, athleteId, athleteId}
+	if entry, ok := c.getFront(key); ok {
+		return entry.value.(ActivityList), entry.info, nil
+	}
+	activities, info, err := c.back.Get(ctx, athleteId)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	c.front.put(key, activities, info)
+	return activities, info, nil
+}
+
+func (c *TieredActivityCache) StoreActivity(ctx context.Context, athleteId int64, activityId int64, activity *ExtendedActivityInfo) error {
+	if err := c.back.StoreActivity(ctx, athleteId, activityId, activity); err != nil {
+		return err
+	}
+	c.front.put(mapKey{KIND_ACTIVITY, athleteId, activityId}, activity, EntryInfo{StoredAt: now()})
+	return nil
+}
+
+func (c *TieredActivityCache) GetActivity(ctx context.Context, athleteId int64, activityId int64) (*ExtendedActivityInfo, EntryInfo, error) {
+	key := mapKey{KIND_ACTIVITY, athleteId, activityId}
+	if entry, ok := c.getFront(key); ok {
+		if activity := entry.value.(*ExtendedActivityInfo); activity.OwnedBy(athleteId) {
+			return activity, entry.info, nil
+		}
+		return nil, EntryInfo{}, &NotFoundError{KIND_ACTIVITY, activityId}
+	}
+	activity, info, err := c.back.GetActivity(ctx, athleteId, activityId)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	c.front.put(key, activity, info)
+	return activity, info, nil
+}
+
+func (c *TieredActivityCache) StoreSyncState(ctx context.Context, athleteId int64, state *SyncState) error {
+	key := mapKey{KIND_SYNC_STATE, athleteId, athleteId}
+	if err := c.back.StoreSyncState(ctx, athleteId, state); err != nil {
+		if IsConflict(err) {
+			c.front.remove(key)
+		}
+		return err
+	}
+	c.front.put(key, state, EntryInfo{StoredAt: now()})
+	return nil
+}
+
+func (c *TieredActivityCache) GetSyncState(ctx context.Context, athleteId int64) (*SyncState, error) {
+	key := mapKey{KIND_SYNC_STATE, athleteId, athleteId}
+	if entry, ok := c.getFront(key); ok {
+		return entry.value.(*SyncState), nil
+	}
+	state, err := c.back.GetSyncState(ctx, athleteId)
+	if err != nil {
+		return nil, err
+	}
+	c.front.put(key, state, EntryInfo{StoredAt: now()})
+	return state, nil
+}
+
+// checkpoints change often and are read rarely, so they bypass front cache
+func (c *TieredActivityCache) StoreHydrationState(ctx context.Context, athleteId int64, state *HydrationState) error {
+	return c.back.StoreHydrationState(ctx, athleteId, state)
+}
+
+func (c *TieredActivityCache) GetHydrationState(ctx context.Context, athleteId int64) (*HydrationState, error) {
+	return c.back.GetHydrationState(ctx, athleteId)
+}
+
+func (c *TieredActivityCache) StoreStreams(ctx context.Context, athleteId int64, activityId int64, streams *ActivityStreams) error {
+	if err := c.back.StoreStreams(ctx, athleteId, activityId, streams); err != nil {
+		return err
+	}
+	c.front.put(mapKey{KIND_STREAMS, athleteId, activityId}, streams, EntryInfo{StoredAt: now()})
+	return nil
+}
+
+func (c *TieredActivityCache) GetStreams(ctx context.Context, athleteId int64, activityId int64) (*ActivityStreams, EntryInfo, error) {
+	key := mapKey{KIND_STREAMS, athleteId, activityId}
+	if entry, ok := c.getFront(key); ok {
+		return entry.value.(*ActivityStreams), entry.info, nil
+	}
+	streams, info, err := c.back.GetStreams(ctx, athleteId, activityId)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	c.front.put(key, streams, info)
+	return streams, info, nil
+}
+
+func (c *TieredActivityCache) ListAthletes(ctx context.Context) ([]int64, error) {
+	return c.back.ListAthletes(ctx)
+}
+
+func (c *TieredActivityCache) ListActivities(ctx context.Context, athleteId int64) ([]int64, error) {
+	return c.back.ListActivities(ctx, athleteId)
+}
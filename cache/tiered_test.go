@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+func TestTieredCacheReadThroughKeepsStoredAt(t *testing.T) {
+	ctx := context.Background()
+	storedAt := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	back := NewBoundedMapActivityCache(0, 0)
+	restore := withNow(storedAt)
+	back.Store(ctx, 1, ActivityList{&strava.ActivitySummary{Id: 10}})
+	restore()
+
+	cache := NewTieredActivityCache(NewBoundedMapActivityCache(0, 0), back, 0)
+	for i := 0; i < 2; i++ {
+		activities, info, err := cache.Get(ctx, 1)
+		if err != nil || len(activities) != 1 || !info.StoredAt.Equal(storedAt) {
+			t.Errorf("Unexpected read result: %v, %v, %v", activities, info, err)
+		}
+	}
+	if stats := back.Stats(); stats.Hits != 1 {
+		t.Errorf("Second read should be served from memory, backend stats: %+v", stats)
+	}
+}
+
+func TestTieredCacheWritesThrough(t *testing.T) {
+	ctx := context.Background()
+	front := NewBoundedMapActivityCache(0, 0)
+	back := NewBoundedMapActivityCache(0, 0)
+	cache := NewTieredActivityCache(front, back, 0)
+	activity := ownedActivity(1, 5)
+	if err := cache.StoreActivity(ctx, 1, 5, activity); err != nil {
+		t.Fatal(err)
+	}
+	for _, tier := range []*MapActivityCache{front, back} {
+		if _, _, err := tier.GetActivity(ctx, 1, 5); err != nil {
+			t.Errorf("Activity should be written to both tiers, got %v", err)
+		}
+	}
+}
+
+func TestTieredCacheRereadsAfterFrontTTL(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	back := NewBoundedMapActivityCache(0, 0)
+	cache := NewTieredActivityCache(NewBoundedMapActivityCache(0, 0), back, time.Minute)
+
+	restore := withNow(start)
+	cache.StoreSyncState(ctx, 1, &SyncState{Watermark: start})
+	restore()
+	// another instance updates backend
+	back.StoreSyncState(ctx, 1, &SyncState{Watermark: start.Add(time.Hour)})
+
+	defer withNow(start.Add(2 * time.Minute))()
+	state, err := cache.GetSyncState(ctx, 1)
+	if err != nil || !state.Watermark.Equal(start.Add(time.Hour)) {
+		t.Errorf("Expected state re-read from backend, got %v, %v", state, err)
+	}
+}
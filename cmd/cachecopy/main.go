@@ -0,0 +1,321 @@
+// Command cachecopy copies cached activity lists, sync states, activity
+// details and streams from one ActivityCache backend into another, so switching backends
+// does not require downloading everything from Strava again.
+//
+// Usage:
+//
+//	cachecopy -from file:./cache -to bolt:./cache/activity_cache.db
+//	cachecopy -from file:./cache -to googlestorage:my-bucket/prefix -checkpoint copy.log -verify
+//
+// Backends are specified as memory, file:ROOT, bolt:FILENAME or
+// googlestorage:BUCKET[/PREFIX]. Datastore can only be accessed from
+// App Engine and is not supported.
+//
+// With -checkpoint every copied entry is appended to the checkpoint file and
+// entries listed there are skipped on the next run, so interrupted copy can
+// be resumed.
+//
+// Destination records time of copy as time entries were stored, so TTL
+// policies treat copied entries as freshly downloaded.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"golang.org/x/net/context"
+	"log"
+	"os"
+	"strings"
+)
+
+func openCache(spec string) (cache.ActivityCache, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	impl := parts[0]
+	location := ""
+	if len(parts) == 2 {
+		location = parts[1]
+	}
+	switch impl {
+	case "memory":
+		return cache.NewMapActivityCache(), nil
+	case "file":
+		if location == "" {
+			return nil, fmt.Errorf("file backend requires cache root: file:ROOT")
+		}
+		return cache.NewFileActivityCache(location), nil
+	case "bolt":
+		if location == "" {
+			return nil, fmt.Errorf("bolt backend requires database file: bolt:FILENAME")
+		}
+		return cache.NewBoltActivityCache(location)
+	case "googlestorage":
+		if location == "" {
+			return nil, fmt.Errorf("googlestorage backend requires bucket: googlestorage:BUCKET[/PREFIX]")
+		}
+		bucketAndPrefix := strings.SplitN(location, "/", 2)
+		prefix := ""
+		if len(bucketAndPrefix) == 2 {
+			prefix = bucketAndPrefix[1]
+		}
+		return cache.NewGoogleStorageActivityCache(bucketAndPrefix[0], prefix), nil
+	case "datastore":
+		return nil, fmt.Errorf("datastore backend can only be accessed from App Engine")
+	default:
+		return nil, fmt.Errorf("unknown cache impl: %s", impl)
+	}
+}
+
+// checkpoint remembers copied entries across runs
+type checkpoint struct {
+	done map[string]bool
+	file *os.File
+}
+
+func openCheckpoint(filename string) (*checkpoint, error) {
+	c := &checkpoint{done: make(map[string]bool)}
+	if filename == "" {
+		return c, nil
+	}
+	if existing, err := os.Open(filename); err == nil {
+		scanner := bufio.NewScanner(existing)
+		for scanner.Scan() {
+			c.done[scanner.Text()] = true
+		}
+		existing.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c.file = file
+	return c, nil
+}
+
+func (c *checkpoint) isDone(key string) bool {
+	return c.done[key]
+}
+
+func (c *checkpoint) markDone(key string) error {
+	c.done[key] = true
+	if c.file == nil {
+		return nil
+	}
+	_, err := fmt.Fprintln(c.file, key)
+	return err
+}
+
+func (c *checkpoint) close() {
+	if c.file != nil {
+		c.file.Close()
+	}
+}
+
+type copier struct {
+	ctx        context.Context
+	from       cache.ActivityCache
+	to         cache.ActivityCache
+	dryRun     bool
+	verify     bool
+	checkpoint *checkpoint
+	copied     int
+	skipped    int
+	failed     int
+}
+
+func sameJson(a, b interface{}) (bool, error) {
+	aJson, err := json.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	bJson, err := json.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aJson, bJson), nil
+}
+
+// copyEntry runs copy of single entry unless it is already in checkpoint
+func (c *copier) copyEntry(key string, copyFunc func() error) {
+	if c.checkpoint.isDone(key) {
+		c.skipped++
+		return
+	}
+	if c.dryRun {
+		log.Printf("Would copy %v", key)
+		c.copied++
+		return
+	}
+	if err := copyFunc(); err != nil {
+		log.Printf("Failed to copy %v: %v", key, err)
+		c.failed++
+		return
+	}
+	if err := c.checkpoint.markDone(key); err != nil {
+		log.Fatalf("Failed to write checkpoint: %v", err)
+	}
+	c.copied++
+}
+
+// copyActivityList copies activity list of athlete, if it is present in
+// source, athlete may only have activity details or streams stored
+func (c *copier) copyActivityList(athleteId int64) error {
+	activities, _, err := c.from.Get(c.ctx, athleteId)
+	if cache.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := c.to.Store(c.ctx, athleteId, activities); err != nil {
+		return err
+	}
+	if c.verify {
+		copied, _, err := c.to.Get(c.ctx, athleteId)
+		if err != nil {
+			return fmt.Errorf("verification failed: %s", err.Error())
+		}
+		if same, err := sameJson(activities, copied); err != nil || !same {
+			return fmt.Errorf("verification failed: copied list differs from source")
+		}
+	}
+	return nil
+}
+
+func (c *copier) copySyncState(athleteId int64) error {
+	state, err := c.from.GetSyncState(c.ctx, athleteId)
+	if cache.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return c.to.StoreSyncState(c.ctx, athleteId, state)
+}
+
+// copyActivity copies details and streams of activity, whichever of them
+// is present in source
+func (c *copier) copyActivity(athleteId int64, activityId int64) error {
+	if err := c.copyActivityDetails(athleteId, activityId); err != nil && !cache.IsNotFound(err) {
+		return err
+	}
+	return c.copyStreams(athleteId, activityId)
+}
+
+func (c *copier) copyStreams(athleteId int64, activityId int64) error {
+	streams, _, err := c.from.GetStreams(c.ctx, athleteId, activityId)
+	if cache.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := c.to.StoreStreams(c.ctx, athleteId, activityId, streams); err != nil {
+		return err
+	}
+	if c.verify {
+		copied, _, err := c.to.GetStreams(c.ctx, athleteId, activityId)
+		if err != nil {
+			return fmt.Errorf("verification failed: %s", err.Error())
+		}
+		if same, err := sameJson(streams, copied); err != nil || !same {
+			return fmt.Errorf("verification failed: copied streams differ from source")
+		}
+	}
+	return nil
+}
+
+func (c *copier) copyActivityDetails(athleteId int64, activityId int64) error {
+	activity, _, err := c.from.GetActivity(c.ctx, athleteId, activityId)
+	if err != nil {
+		return err
+	}
+	if err := c.to.StoreActivity(c.ctx, athleteId, activityId, activity); err != nil {
+		return err
+	}
+	if c.verify {
+		copied, _, err := c.to.GetActivity(c.ctx, athleteId, activityId)
+		if err != nil {
+			return fmt.Errorf("verification failed: %s", err.Error())
+		}
+		if same, err := sameJson(activity, copied); err != nil || !same {
+			return fmt.Errorf("verification failed: copied activity differs from source")
+		}
+	}
+	return nil
+}
+
+func (c *copier) run() error {
+	athleteIds, err := c.from.ListAthletes(c.ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Found %v athletes", len(athleteIds))
+	for _, athleteId := range athleteIds {
+		c.copyEntry(fmt.Sprintf("athlete:%v", athleteId), func() error {
+			if err := c.copyActivityList(athleteId); err != nil {
+				return err
+			}
+			return c.copySyncState(athleteId)
+		})
+		activityIds, err := c.from.ListActivities(c.ctx, athleteId)
+		if err != nil {
+			return err
+		}
+		log.Printf("Found %v activities of athlete %v", len(activityIds), athleteId)
+		for _, activityId := range activityIds {
+			c.copyEntry(fmt.Sprintf("activity:%v/%v", athleteId, activityId), func() error {
+				return c.copyActivity(athleteId, activityId)
+			})
+		}
+	}
+	return nil
+}
+
+func main() {
+	from := flag.String("from", "", "source cache, e.g. file:./cache")
+	to := flag.String("to", "", "destination cache, e.g. bolt:./activity_cache.db")
+	dryRun := flag.Bool("dry-run", false, "only print what would be copied")
+	verify := flag.Bool("verify", false, "read back every copied entry and compare with source")
+	checkpointFile := flag.String("checkpoint", "", "file recording copied entries, used to resume interrupted copy")
+	flag.Parse()
+
+	if *from == "" || *to == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	source, err := openCache(*from)
+	if err != nil {
+		log.Fatalf("Can not open source cache: %v", err)
+	}
+	destination, err := openCache(*to)
+	if err != nil {
+		log.Fatalf("Can not open destination cache: %v", err)
+	}
+	checkpoint, err := openCheckpoint(*checkpointFile)
+	if err != nil {
+		log.Fatalf("Can not open checkpoint: %v", err)
+	}
+	defer checkpoint.close()
+
+	c := &copier{
+		ctx:        context.Background(),
+		from:       source,
+		to:         destination,
+		dryRun:     *dryRun,
+		verify:     *verify,
+		checkpoint: checkpoint,
+	}
+	if err := c.run(); err != nil {
+		log.Fatalf("Copy failed: %v", err)
+	}
+	log.Printf("Copied: %v, skipped: %v, failed: %v", c.copied, c.skipped, c.failed)
+	if c.failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"github.com/chemikadze/strava-analysis-ui/cache"
+	"github.com/strava/go.strava"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func ownedActivity(athleteId int64, activityId int64) *cache.ExtendedActivityInfo {
+	return &cache.ExtendedActivityInfo{
+		Activity: &strava.ActivityDetailed{
+			ActivitySummary: strava.ActivitySummary{
+				Id:      activityId,
+				Athlete: strava.AthleteSummary{AthleteMeta: strava.AthleteMeta{Id: athleteId}},
+			},
+		},
+	}
+}
+
+func TestCopyWithResume(t *testing.T) {
+	ctx := context.Background()
+	tmpDir, _ := ioutil.TempDir("", "cachecopy")
+	defer os.RemoveAll(tmpDir)
+
+	source := cache.NewMapActivityCache()
+	source.Store(ctx, 1, cache.ActivityList{&strava.ActivitySummary{Id: 10}})
+	source.StoreSyncState(ctx, 1, &cache.SyncState{})
+	source.StoreActivity(ctx, 1, 10, ownedActivity(1, 10))
+	source.StoreActivity(ctx, 1, 11, ownedActivity(1, 11))
+	destination := cache.NewFileActivityCache(path.Join(tmpDir, "cache"))
+
+	checkpointFile := path.Join(tmpDir, "checkpoint")
+	ioutil.WriteFile(checkpointFile, []byte("activity:1/11\n"), 0644)
+	checkpoint, err := openCheckpoint(checkpointFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &copier{ctx: ctx, from: source, to: destination, verify: true, checkpoint: checkpoint}
+	if err := c.run(); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint.close()
+	if c.copied != 2 || c.skipped != 1 || c.failed != 0 {
+		t.Errorf("Unexpected counters: copied %v, skipped %v, failed %v", c.copied, c.skipped, c.failed)
+	}
+	if _, _, err := destination.GetActivity(ctx, 1, 10); err != nil {
+		t.Errorf("Activity should be copied, got %v", err)
+	}
+	if _, _, err := destination.GetActivity(ctx, 1, 11); !cache.IsNotFound(err) {
+		t.Errorf("Activity from checkpoint should be skipped, got %v", err)
+	}
+	if _, err := destination.GetSyncState(ctx, 1); err != nil {
+		t.Errorf("Sync state should be copied, got %v", err)
+	}
+}
+
+func TestDryRunDoesNotWrite(t *testing.T) {
+	ctx := context.Background()
+	source := cache.NewMapActivityCache()
+	source.Store(ctx, 1, cache.ActivityList{})
+	destination := cache.NewMapActivityCache()
+	checkpoint, _ := openCheckpoint("")
+	c := &copier{ctx: ctx, from: source, to: destination, dryRun: true, checkpoint: checkpoint}
+	if err := c.run(); err != nil {
+		t.Fatal(err)
+	}
+	if athletes, _ := destination.ListAthletes(ctx); len(athletes) != 0 {
+		t.Errorf("Dry run should not write anything, found %v", athletes)
+	}
+}
+
+func TestCopiesStreams(t *testing.T) {
+	ctx := context.Background()
+	source := cache.NewMapActivityCache()
+	source.Store(ctx, 1, cache.ActivityList{})
+	// streams are downloaded without activity details
+	source.StoreStreams(ctx, 1, 10, &cache.ActivityStreams{Time: []int{0, 1}, Watts: []int{200, 210}})
+	destination := cache.NewMapActivityCache()
+
+	checkpoint, _ := openCheckpoint("")
+	c := &copier{ctx: ctx, from: source, to: destination, verify: true, checkpoint: checkpoint}
+	if err := c.run(); err != nil {
+		t.Fatal(err)
+	}
+	if c.failed != 0 {
+		t.Errorf("Copy should not fail, failed %v", c.failed)
+	}
+	if streams, _, err := destination.GetStreams(ctx, 1, 10); err != nil || len(streams.Watts) != 2 {
+		t.Errorf("Streams should be copied, got %v, %v", streams, err)
+	}
+}
+
+// listingCache reports athletes which have no activity list stored
+type listingCache struct {
+	cache.ActivityCache
+	athleteIds []int64
+}
+
+func (c *listingCache) ListAthletes(ctx context.Context) ([]int64, error) {
+	return c.athleteIds, nil
+}
+
+func TestCopiesAthleteWithoutActivityList(t *testing.T) {
+	ctx := context.Background()
+	source := cache.NewMapActivityCache()
+	source.StoreActivity(ctx, 1, 10, ownedActivity(1, 10))
+	destination := cache.NewMapActivityCache()
+
+	checkpoint, _ := openCheckpoint("")
+	c := &copier{ctx: ctx, from: &listingCache{source, []int64{1}}, to: destination, checkpoint: checkpoint}
+	if err := c.run(); err != nil {
+		t.Fatal(err)
+	}
+	if c.failed != 0 {
+		t.Errorf("Missing activity list should not fail copy, failed %v", c.failed)
+	}
+	if _, _, err := destination.GetActivity(ctx, 1, 10); err != nil {
+		t.Errorf("Activity should be copied, got %v", err)
+	}
+	if _, _, err := destination.Get(ctx, 1); !cache.IsNotFound(err) {
+		t.Errorf("Activity list should not be created, got %v", err)
+	}
+}